@@ -0,0 +1,23 @@
+// Package example 演示 microgen 生成的代码，也是 microgen 测试用的样例
+package example
+
+import (
+	"context"
+	"geek_micro/rpc/proto/gen"
+)
+
+//go:generate go run geek_micro/cmd/microgen -type UserAPI -service user-api
+
+// UserAPI 客户端和服务端共用的接口
+type UserAPI interface {
+	GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	GetByIdProto(ctx context.Context, req *gen.GetByIdReq) (*gen.GetByIdResp, error)
+}
+
+type GetByIdReq struct {
+	Id int
+}
+
+type GetByIdResp struct {
+	Msg string
+}
@@ -0,0 +1,75 @@
+// Code generated by microgen. DO NOT EDIT.
+// Source: user.go
+
+package example
+
+import (
+	"context"
+	"geek_micro/rpc"
+	"geek_micro/rpc/proto/gen"
+)
+
+// UserAPIServiceName 客户端和服务端共用的服务名
+const UserAPIServiceName = "user-api"
+
+// 编译期检查客户端、服务端和 mock 的签名和 UserAPI 一致
+var (
+	_ UserAPI            = (*UserAPIClient)(nil)
+	_ UserAPI            = (*MockUserAPI)(nil)
+	_ rpc.HandlerService = (*UserAPIServer)(nil)
+	_ rpc.Service        = (*userAPIStub)(nil)
+)
+
+// userAPIStub 的字段由 rpc.Client 通过反射赋值
+type userAPIStub struct {
+	GetById      func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	GetByIdProto func(ctx context.Context, req *gen.GetByIdReq) (*gen.GetByIdResp, error)
+}
+
+func (s *userAPIStub) Name() string {
+	return UserAPIServiceName
+}
+
+// UserAPIClient 通过 rpc.Client 调用远程的 UserAPI
+type UserAPIClient struct {
+	stub userAPIStub
+}
+
+// NewUserAPIClient 使用 c 的序列化协议和连接创建客户端
+func NewUserAPIClient(c *rpc.Client) (*UserAPIClient, error) {
+	res := &UserAPIClient{}
+	if err := c.InitService(&res.stub); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *UserAPIClient) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	return c.stub.GetById(ctx, req)
+}
+
+func (c *UserAPIClient) GetByIdProto(ctx context.Context, req *gen.GetByIdReq) (*gen.GetByIdResp, error) {
+	return c.stub.GetByIdProto(ctx, req)
+}
+
+// UserAPIServer 把 UserAPI 的实现适配成 rpc.Service
+type UserAPIServer struct {
+	UserAPI
+}
+
+func (s *UserAPIServer) Name() string {
+	return UserAPIServiceName
+}
+
+// Handlers 服务端调用方法的时候不经过反射
+func (s *UserAPIServer) Handlers() map[string]rpc.MethodHandler {
+	return map[string]rpc.MethodHandler{
+		"GetById":      rpc.UnaryHandler(s.UserAPI.GetById),
+		"GetByIdProto": rpc.UnaryHandler(s.UserAPI.GetByIdProto),
+	}
+}
+
+// RegisterUserAPIServer 把 impl 注册到 s
+func RegisterUserAPIServer(s *rpc.Serve, impl UserAPI) error {
+	return s.RegisterService(&UserAPIServer{UserAPI: impl})
+}
@@ -0,0 +1,66 @@
+// Code generated by microgen. DO NOT EDIT.
+// Source: user.go
+
+package example
+
+import (
+	context "context"
+	reflect "reflect"
+
+	gen "geek_micro/rpc/proto/gen"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockUserAPI is a mock of UserAPI interface.
+type MockUserAPI struct {
+	ctrl     *gomock.Controller
+	recorder *MockUserAPIMockRecorder
+}
+
+// MockUserAPIMockRecorder is the mock recorder for MockUserAPI.
+type MockUserAPIMockRecorder struct {
+	mock *MockUserAPI
+}
+
+// NewMockUserAPI creates a new mock instance.
+func NewMockUserAPI(ctrl *gomock.Controller) *MockUserAPI {
+	mock := &MockUserAPI{ctrl: ctrl}
+	mock.recorder = &MockUserAPIMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockUserAPI) EXPECT() *MockUserAPIMockRecorder {
+	return m.recorder
+}
+
+// GetById mocks base method.
+func (m *MockUserAPI) GetById(arg0 context.Context, arg1 *GetByIdReq) (*GetByIdResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetById", arg0, arg1)
+	ret0, _ := ret[0].(*GetByIdResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetById indicates an expected call of GetById.
+func (mr *MockUserAPIMockRecorder) GetById(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetById", reflect.TypeOf((*MockUserAPI)(nil).GetById), arg0, arg1)
+}
+
+// GetByIdProto mocks base method.
+func (m *MockUserAPI) GetByIdProto(arg0 context.Context, arg1 *gen.GetByIdReq) (*gen.GetByIdResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetByIdProto", arg0, arg1)
+	ret0, _ := ret[0].(*gen.GetByIdResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetByIdProto indicates an expected call of GetByIdProto.
+func (mr *MockUserAPIMockRecorder) GetByIdProto(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByIdProto", reflect.TypeOf((*MockUserAPI)(nil).GetByIdProto), arg0, arg1)
+}
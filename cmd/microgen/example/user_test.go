@@ -0,0 +1,47 @@
+package example
+
+import (
+	"context"
+	"geek_micro/rpc"
+	"geek_micro/rpc/status"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestUserAPI(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// 生成的 mock 直接作为服务端的实现
+	impl := NewMockUserAPI(ctrl)
+	impl.EXPECT().GetById(gomock.Any(), &GetByIdReq{Id: 1}).Return(&GetByIdResp{Msg: "tom"}, nil)
+	impl.EXPECT().GetById(gomock.Any(), &GetByIdReq{Id: 2}).
+		Return(nil, status.New(status.NotFound, "user not found"))
+
+	server := rpc.NewServer()
+	require.NoError(t, RegisterUserAPIServer(server, impl))
+	require.NoError(t, server.Listen("tcp", "127.0.0.1:0"))
+	go func() {
+		_ = server.Serve()
+	}()
+	defer func() {
+		_ = server.Close()
+	}()
+
+	c, err := rpc.NewClient(server.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		_ = c.Close()
+	}()
+	client, err := NewUserAPIClient(c)
+	require.NoError(t, err)
+
+	resp, err := client.GetById(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, &GetByIdResp{Msg: "tom"}, resp)
+
+	_, err = client.GetById(context.Background(), &GetByIdReq{Id: 2})
+	assert.Equal(t, status.NotFound, status.CodeOf(err))
+}
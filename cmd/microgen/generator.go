@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// config 生成代码需要的参数
+type config struct {
+	// 源文件的路径，只用于生成的注释和解析
+	source string
+	// 接口的名字
+	typeName string
+	// 服务名，客户端和服务端共用
+	serviceName string
+	// rpc 包的导入路径
+	rpcPath string
+	// 是否生成 mock
+	mock bool
+}
+
+// service 是从接口里面解析出来的服务定义
+type service struct {
+	Source      string
+	Package     string
+	Name        string
+	ServiceName string
+	RPC         imp
+	Mock        bool
+	// 签名里面用到的包，不包括 context
+	Imports []imp
+	Methods []method
+}
+
+type imp struct {
+	Name string
+	Path string
+}
+
+// method 只支持 func(ctx context.Context, req *Req) (*Resp, error) 的形式
+type method struct {
+	Name string
+	Req  string
+	Resp string
+}
+
+// generate 解析 src 里面的接口，返回服务端和客户端的代码，以及 mock 的代码
+// cfg.mock 为 false 的时候不生成 mock
+func generate(cfg config, src []byte) ([]byte, []byte, error) {
+	svc, err := parse(cfg, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	code, err := render(microTpl, svc)
+	if err != nil || !cfg.mock {
+		return code, nil, err
+	}
+	mock, err := render(mockTpl, svc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return code, mock, nil
+}
+
+func parse(cfg config, src []byte) (*service, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, cfg.source, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	var iface *ast.InterfaceType
+	ast.Inspect(file, func(node ast.Node) bool {
+		spec, ok := node.(*ast.TypeSpec)
+		if !ok || spec.Name.Name != cfg.typeName {
+			return true
+		}
+		iface, _ = spec.Type.(*ast.InterfaceType)
+		return false
+	})
+	if iface == nil {
+		return nil, fmt.Errorf("microgen: %s 中没有找到接口 %s", cfg.source, cfg.typeName)
+	}
+
+	res := &service{
+		Source:      path.Base(cfg.source),
+		Package:     file.Name.Name,
+		Name:        cfg.typeName,
+		ServiceName: cfg.serviceName,
+		RPC:         imp{Name: "rpc", Path: cfg.rpcPath},
+		Mock:        cfg.mock,
+	}
+	if res.ServiceName == "" {
+		res.ServiceName = cfg.typeName
+	}
+
+	used := make(map[string]struct{}, 4)
+	var errs []error
+	for _, field := range iface.Methods.List {
+		if len(field.Names) == 0 {
+			errs = append(errs, fmt.Errorf("microgen: %s 不支持嵌入接口", exprString(fset, field.Type)))
+			continue
+		}
+		name := field.Names[0].Name
+		m, err := parseMethod(fset, name, field.Type.(*ast.FuncType))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		res.Methods = append(res.Methods, m)
+		collectPackages(field.Type, used)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(res.Methods) == 0 {
+		return nil, fmt.Errorf("microgen: 接口 %s 没有任何方法", cfg.typeName)
+	}
+
+	imports, err := resolveImports(file, used)
+	if err != nil {
+		return nil, err
+	}
+	res.Imports = imports
+	return res, nil
+}
+
+func parseMethod(fset *token.FileSet, name string, fn *ast.FuncType) (method, error) {
+	signature := name + strings.TrimPrefix(exprString(fset, fn), "func")
+	// 客户端的字段需要导出才能被反射赋值，Name 和 Handlers 是 rpc 包使用的方法
+	if !ast.IsExported(name) || name == "Name" || name == "Handlers" {
+		return method{}, fmt.Errorf("microgen: %s 的方法名必须是导出的，并且不能是 Name 或者 Handlers", signature)
+	}
+	params := flatten(fn.Params)
+	var results []ast.Expr
+	if fn.Results != nil {
+		results = flatten(fn.Results)
+	}
+	if len(params) != 2 || exprString(fset, params[0]) != "context.Context" {
+		return method{}, fmt.Errorf("microgen: %s 的参数必须是 (context.Context, *Req)", signature)
+	}
+	if _, ok := params[1].(*ast.StarExpr); !ok {
+		return method{}, fmt.Errorf("microgen: %s 的请求必须是指针", signature)
+	}
+	if len(results) != 2 || exprString(fset, results[1]) != "error" {
+		return method{}, fmt.Errorf("microgen: %s 的返回值必须是 (*Resp, error)", signature)
+	}
+	if _, ok := results[0].(*ast.StarExpr); !ok {
+		return method{}, fmt.Errorf("microgen: %s 的响应必须是指针", signature)
+	}
+	return method{
+		Name: name,
+		Req:  exprString(fset, params[1]),
+		Resp: exprString(fset, results[0]),
+	}, nil
+}
+
+// flatten 把 (a, b int) 这种写法拆开
+func flatten(fields *ast.FieldList) []ast.Expr {
+	res := make([]ast.Expr, 0, len(fields.List))
+	for _, f := range fields.List {
+		n := len(f.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			res = append(res, f.Type)
+		}
+	}
+	return res
+}
+
+// collectPackages 找出类型里面引用的包名
+func collectPackages(node ast.Node, used map[string]struct{}) {
+	ast.Inspect(node, func(node ast.Node) bool {
+		sel, ok := node.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if ident, ok := sel.X.(*ast.Ident); ok && ident.Name != "context" {
+			used[ident.Name] = struct{}{}
+		}
+		return false
+	})
+}
+
+// resolveImports 在源文件的 import 里面找到引用的包
+// 没有别名的时候，假定包名就是导入路径的最后一段
+func resolveImports(file *ast.File, used map[string]struct{}) ([]imp, error) {
+	res := make([]imp, 0, len(used))
+	for _, spec := range file.Imports {
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Base(p)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		if _, ok := used[name]; !ok {
+			continue
+		}
+		delete(used, name)
+		res = append(res, imp{Name: name, Path: p})
+	}
+	for name := range used {
+		return nil, fmt.Errorf("microgen: 找不到包 %s 的导入路径", name)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Path < res[j].Path
+	})
+	return res, nil
+}
+
+func exprString(fset *token.FileSet, expr ast.Expr) string {
+	var buf bytes.Buffer
+	_ = printer.Fprint(&buf, fset, expr)
+	return buf.String()
+}
+
+func render(tpl *template.Template, svc *service) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, svc); err != nil {
+		return nil, err
+	}
+	res, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("microgen: 格式化生成的代码失败 %w", err)
+	}
+	return res, nil
+}
+
+// importName 包名和导入路径最后一段不一样的时候需要别名
+func importName(i imp) string {
+	if path.Base(i.Path) == i.Name {
+		return ""
+	}
+	return i.Name + " "
+}
+
+func unexported(name string) string {
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+var funcs = template.FuncMap{
+	"importName": importName,
+	"unexported": unexported,
+}
+
+var microTpl = template.Must(template.New("micro").Funcs(funcs).Parse(`// Code generated by microgen. DO NOT EDIT.
+// Source: {{.Source}}
+
+package {{.Package}}
+
+import (
+	"context"
+	{{importName .RPC}}"{{.RPC.Path}}"
+{{- range .Imports}}
+	{{importName .}}"{{.Path}}"
+{{- end}}
+)
+
+// {{.Name}}ServiceName 客户端和服务端共用的服务名
+const {{.Name}}ServiceName = "{{.ServiceName}}"
+
+// 编译期检查客户端、服务端和 mock 的签名和 {{.Name}} 一致
+var (
+	_ {{.Name}}     = (*{{.Name}}Client)(nil)
+{{- if .Mock}}
+	_ {{.Name}}     = (*Mock{{.Name}})(nil)
+{{- end}}
+	_ rpc.HandlerService = (*{{.Name}}Server)(nil)
+	_ rpc.Service        = (*{{unexported .Name}}Stub)(nil)
+)
+
+// {{unexported .Name}}Stub 的字段由 rpc.Client 通过反射赋值
+type {{unexported .Name}}Stub struct {
+{{- range .Methods}}
+	{{.Name}} func(ctx context.Context, req {{.Req}}) ({{.Resp}}, error)
+{{- end}}
+}
+
+func (s *{{unexported .Name}}Stub) Name() string {
+	return {{.Name}}ServiceName
+}
+
+// {{.Name}}Client 通过 rpc.Client 调用远程的 {{.Name}}
+type {{.Name}}Client struct {
+	stub {{unexported .Name}}Stub
+}
+
+// New{{.Name}}Client 使用 c 的序列化协议和连接创建客户端
+func New{{.Name}}Client(c *rpc.Client) (*{{.Name}}Client, error) {
+	res := &{{.Name}}Client{}
+	if err := c.InitService(&res.stub); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+{{range .Methods}}
+func (c *{{$.Name}}Client) {{.Name}}(ctx context.Context, req {{.Req}}) ({{.Resp}}, error) {
+	return c.stub.{{.Name}}(ctx, req)
+}
+{{end}}
+// {{.Name}}Server 把 {{.Name}} 的实现适配成 rpc.Service
+type {{.Name}}Server struct {
+	{{.Name}}
+}
+
+func (s *{{.Name}}Server) Name() string {
+	return {{.Name}}ServiceName
+}
+
+// Handlers 服务端调用方法的时候不经过反射
+func (s *{{.Name}}Server) Handlers() map[string]rpc.MethodHandler {
+	return map[string]rpc.MethodHandler{
+{{- range .Methods}}
+		"{{.Name}}": rpc.UnaryHandler(s.{{$.Name}}.{{.Name}}),
+{{- end}}
+	}
+}
+
+// Register{{.Name}}Server 把 impl 注册到 s
+func Register{{.Name}}Server(s *rpc.Serve, impl {{.Name}}) error {
+	return s.RegisterService(&{{.Name}}Server{ {{.Name}}: impl })
+}
+`))
+
+var mockTpl = template.Must(template.New("mock").Funcs(funcs).Parse(`// Code generated by microgen. DO NOT EDIT.
+// Source: {{.Source}}
+
+package {{.Package}}
+
+import (
+	context "context"
+	reflect "reflect"
+{{range .Imports}}
+	{{.Name}} "{{.Path}}"
+{{- end}}
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// Mock{{.Name}} is a mock of {{.Name}} interface.
+type Mock{{.Name}} struct {
+	ctrl     *gomock.Controller
+	recorder *Mock{{.Name}}MockRecorder
+}
+
+// Mock{{.Name}}MockRecorder is the mock recorder for Mock{{.Name}}.
+type Mock{{.Name}}MockRecorder struct {
+	mock *Mock{{.Name}}
+}
+
+// NewMock{{.Name}} creates a new mock instance.
+func NewMock{{.Name}}(ctrl *gomock.Controller) *Mock{{.Name}} {
+	mock := &Mock{{.Name}}{ctrl: ctrl}
+	mock.recorder = &Mock{{.Name}}MockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *Mock{{.Name}}) EXPECT() *Mock{{.Name}}MockRecorder {
+	return m.recorder
+}
+{{range .Methods}}
+// {{.Name}} mocks base method.
+func (m *Mock{{$.Name}}) {{.Name}}(arg0 context.Context, arg1 {{.Req}}) ({{.Resp}}, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "{{.Name}}", arg0, arg1)
+	ret0, _ := ret[0].({{.Resp}})
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// {{.Name}} indicates an expected call of {{.Name}}.
+func (mr *Mock{{$.Name}}MockRecorder) {{.Name}}(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "{{.Name}}", reflect.TypeOf((*Mock{{$.Name}})(nil).{{.Name}}), arg0, arg1)
+}
+{{end}}`))
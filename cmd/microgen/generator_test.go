@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+// example 目录下的代码由 go generate 生成，同时也是这个测试的期望结果
+func TestGenerate(t *testing.T) {
+	src, err := os.ReadFile("example/user.go")
+	require.NoError(t, err)
+	wantCode, err := os.ReadFile("example/user_micro.go")
+	require.NoError(t, err)
+	wantMock, err := os.ReadFile("example/user_mock.go")
+	require.NoError(t, err)
+
+	code, mock, err := generate(config{
+		source:      "user.go",
+		typeName:    "UserAPI",
+		serviceName: "user-api",
+		rpcPath:     "geek_micro/rpc",
+		mock:        true,
+	}, src)
+	require.NoError(t, err)
+	assert.Equal(t, string(wantCode), string(code))
+	assert.Equal(t, string(wantMock), string(mock))
+
+	// 不生成 mock 的时候也不检查 mock
+	code, mock, err = generate(config{
+		source:   "user.go",
+		typeName: "UserAPI",
+		rpcPath:  "geek_micro/rpc",
+	}, src)
+	require.NoError(t, err)
+	assert.Nil(t, mock)
+	assert.NotContains(t, string(code), "MockUserAPI")
+	assert.Contains(t, string(code), `const UserAPIServiceName = "UserAPI"`)
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	testCases := []struct {
+		name     string
+		typeName string
+		src      string
+		wantErr  string
+	}{
+		{
+			name:     "not found",
+			typeName: "UserAPI",
+			src:      "package example\ntype OrderAPI interface{}",
+			wantErr:  "microgen: user.go 中没有找到接口 UserAPI",
+		},
+		{
+			name:     "not interface",
+			typeName: "UserAPI",
+			src:      "package example\ntype UserAPI struct{}",
+			wantErr:  "microgen: user.go 中没有找到接口 UserAPI",
+		},
+		{
+			name:     "no method",
+			typeName: "UserAPI",
+			src:      "package example\ntype UserAPI interface{}",
+			wantErr:  "microgen: 接口 UserAPI 没有任何方法",
+		},
+		{
+			name:     "embedded",
+			typeName: "UserAPI",
+			src:      "package example\ntype UserAPI interface{ io.Closer }",
+			wantErr:  "microgen: io.Closer 不支持嵌入接口",
+		},
+		{
+			// 所有不合法的方法一起报告
+			name:     "bad signatures",
+			typeName: "UserAPI",
+			src: `package example
+import "context"
+type UserAPI interface {
+	NoCtx(req *Req) (*Resp, error)
+	NotPtr(ctx context.Context, req Req) (*Resp, error)
+	NoErr(ctx context.Context, req *Req) *Resp
+	RespNotPtr(ctx context.Context, req *Req) (Resp, error)
+	Name(ctx context.Context, req *Req) (*Resp, error)
+	Handlers(ctx context.Context, req *Req) (*Resp, error)
+	unexported(ctx context.Context, req *Req) (*Resp, error)
+}`,
+			wantErr: "microgen: NoCtx(req *Req) (*Resp, error) 的参数必须是 (context.Context, *Req)\n" +
+				"microgen: NotPtr(ctx context.Context, req Req) (*Resp, error) 的请求必须是指针\n" +
+				"microgen: NoErr(ctx context.Context, req *Req) *Resp 的返回值必须是 (*Resp, error)\n" +
+				"microgen: RespNotPtr(ctx context.Context, req *Req) (Resp, error) 的响应必须是指针\n" +
+				"microgen: Name(ctx context.Context, req *Req) (*Resp, error) 的方法名必须是导出的，并且不能是 Name 或者 Handlers\n" +
+				"microgen: Handlers(ctx context.Context, req *Req) (*Resp, error) 的方法名必须是导出的，并且不能是 Name 或者 Handlers\n" +
+				"microgen: unexported(ctx context.Context, req *Req) (*Resp, error) 的方法名必须是导出的，并且不能是 Name 或者 Handlers",
+		},
+		{
+			name:     "unknown import",
+			typeName: "UserAPI",
+			src: `package example
+import "context"
+type UserAPI interface {
+	Get(ctx context.Context, req *gen.Req) (*Resp, error)
+}`,
+			wantErr: "microgen: 找不到包 gen 的导入路径",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := generate(config{
+				source:   "user.go",
+				typeName: tc.typeName,
+				rpcPath:  "geek_micro/rpc",
+			}, []byte(tc.src))
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
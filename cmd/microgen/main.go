@@ -0,0 +1,65 @@
+// microgen 根据 Go 接口生成客户端、服务端适配和 gomock 的 mock
+//
+// 在定义接口的文件里面加上：
+//
+//	//go:generate go run geek_micro/cmd/microgen -type UserAPI -service user-service
+//
+// 会在同一个目录下生成 user_micro.go 和 user_mock.go（源文件是 user.go 的时候）
+// 接口的方法必须是 func(ctx context.Context, req *Req) (*Resp, error) 的形式
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	var cfg config
+	var output, mockOutput string
+	flag.StringVar(&cfg.typeName, "type", "", "接口的名字")
+	flag.StringVar(&cfg.serviceName, "service", "", "服务名，默认是接口的名字")
+	flag.StringVar(&cfg.source, "source", os.Getenv("GOFILE"), "定义接口的文件，go:generate 的时候默认是当前文件")
+	flag.StringVar(&cfg.rpcPath, "rpc", "geek_micro/rpc", "rpc 包的导入路径")
+	flag.StringVar(&output, "output", "", "客户端和服务端代码的输出文件，默认是 <source>_micro.go")
+	flag.StringVar(&mockOutput, "mock", "", "mock 的输出文件，默认是 <source>_mock.go，为 - 的时候不生成")
+	flag.Parse()
+
+	if cfg.typeName == "" || cfg.source == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	base := strings.TrimSuffix(cfg.source, filepath.Ext(cfg.source))
+	if output == "" {
+		output = base + "_micro.go"
+	}
+	if mockOutput == "" {
+		mockOutput = base + "_mock.go"
+	}
+	cfg.mock = mockOutput != "-"
+
+	if err := run(cfg, output, mockOutput); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg config, output, mockOutput string) error {
+	src, err := os.ReadFile(cfg.source)
+	if err != nil {
+		return err
+	}
+	code, mock, err := generate(cfg, src)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(output, code, 0o644); err != nil {
+		return err
+	}
+	if cfg.mock {
+		return os.WriteFile(mockOutput, mock, 0o644)
+	}
+	return nil
+}
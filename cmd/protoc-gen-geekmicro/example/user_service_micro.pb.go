@@ -0,0 +1,58 @@
+// Code generated by protoc-gen-geekmicro. DO NOT EDIT.
+// source: user_service.proto
+
+package example
+
+import (
+	context "context"
+	rpc "geek_micro/rpc"
+	proto "geek_micro/rpc/serialize/proto"
+)
+
+// UserServiceServiceName 客户端和服务端共用的服务名
+const UserServiceServiceName = "example.user.UserService"
+
+// UserServiceClient 的字段由 rpc.Client 通过反射赋值，请求和响应使用 proto 序列化
+type UserServiceClient struct {
+	GetById   func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	ListUsers func(ctx context.Context) (*rpc.Stream[ListUsersReq, User], error)
+}
+
+func (c *UserServiceClient) Name() string {
+	return UserServiceServiceName
+}
+
+// NewUserServiceClient 创建 UserService 的客户端，不受 c 默认的序列化协议影响
+func NewUserServiceClient(c *rpc.Client) (*UserServiceClient, error) {
+	res := &UserServiceClient{}
+	if err := c.InitServiceWithSerializer(res, &proto.Serializer{}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UserServiceServer 是 UserService 的服务端需要实现的接口
+type UserServiceServer interface {
+	GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	ListUsers(ctx context.Context, stream *rpc.Stream[User, ListUsersReq]) error
+}
+
+type userServiceServer struct {
+	UserServiceServer
+}
+
+func (s *userServiceServer) Name() string {
+	return UserServiceServiceName
+}
+
+func (s *userServiceServer) Handlers() map[string]rpc.MethodHandler {
+	return map[string]rpc.MethodHandler{
+		"GetById": rpc.UnaryHandler(s.UserServiceServer.GetById),
+	}
+}
+
+// RegisterUserServiceServer 把 impl 注册到 s，同时注册 proto 序列化协议
+func RegisterUserServiceServer(s *rpc.Serve, impl UserServiceServer) error {
+	s.RegisterSerialize(&proto.Serializer{})
+	return s.RegisterService(&userServiceServer{UserServiceServer: impl})
+}
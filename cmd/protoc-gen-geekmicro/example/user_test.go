@@ -0,0 +1,75 @@
+package example
+
+import (
+	"context"
+	"fmt"
+	"geek_micro/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestUserService(t *testing.T) {
+	server := rpc.NewServer()
+	require.NoError(t, RegisterUserServiceServer(server, &userServer{}))
+	require.NoError(t, server.Listen("tcp", "127.0.0.1:0"))
+	go func() {
+		_ = server.Serve()
+	}()
+	defer func() {
+		_ = server.Close()
+	}()
+
+	// 客户端默认使用 json，生成的代码会换成 proto
+	c, err := rpc.NewClient(server.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		_ = c.Close()
+	}()
+	client, err := NewUserServiceClient(c)
+	require.NoError(t, err)
+
+	resp, err := client.GetById(context.Background(), &GetByIdReq{Id: 12})
+	require.NoError(t, err)
+	assert.Equal(t, "user-12", resp.User.Name)
+
+	stream, err := client.ListUsers(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&ListUsersReq{Limit: 3}))
+	require.NoError(t, stream.CloseSend())
+	var names []string
+	for {
+		user, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, user.Name)
+	}
+	assert.Equal(t, []string{"user-0", "user-1", "user-2"}, names)
+}
+
+type userServer struct {
+}
+
+func (u *userServer) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	return &GetByIdResp{User: &User{Id: req.Id, Name: userName(req.Id)}}, nil
+}
+
+func (u *userServer) ListUsers(ctx context.Context, stream *rpc.Stream[User, ListUsersReq]) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < req.Limit; i++ {
+		if err = stream.Send(&User{Id: i, Name: userName(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func userName(id int64) string {
+	return fmt.Sprint("user-", id)
+}
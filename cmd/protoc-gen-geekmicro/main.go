@@ -0,0 +1,27 @@
+// protoc-gen-geekmicro 根据 .proto 文件中的 service 生成 geek_micro 的客户端和服务端代码
+// 请求和响应都使用 proto 序列化
+//
+//	protoc --go_out=. --geekmicro_out=. user.proto
+//
+// 参数 rpc 可以修改 rpc 包的导入路径，例如 --geekmicro_opt=rpc=example.com/rpc
+package main
+
+import (
+	"flag"
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+func main() {
+	var flags flag.FlagSet
+	rpcPath := flags.String("rpc", "geek_micro/rpc", "rpc 包的导入路径")
+	protogen.Options{
+		ParamFunc: flags.Set,
+	}.Run(func(plugin *protogen.Plugin) error {
+		for _, file := range plugin.Files {
+			if file.Generate {
+				generateFile(plugin, file, protogen.GoImportPath(*rpcPath))
+			}
+		}
+		return nil
+	})
+}
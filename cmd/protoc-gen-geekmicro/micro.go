@@ -0,0 +1,116 @@
+package main
+
+import (
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+const (
+	contextPackage = protogen.GoImportPath("context")
+	protoPackage   = protogen.GoImportPath("geek_micro/rpc/serialize/proto")
+)
+
+// generateFile 为 file 里面的所有 service 生成 <name>_micro.pb.go，没有 service 的时候不生成
+func generateFile(plugin *protogen.Plugin, file *protogen.File, rpcPackage protogen.GoImportPath) *protogen.GeneratedFile {
+	if len(file.Services) == 0 {
+		return nil
+	}
+	g := plugin.NewGeneratedFile(file.GeneratedFilenamePrefix+"_micro.pb.go", file.GoImportPath)
+	g.P("// Code generated by protoc-gen-geekmicro. DO NOT EDIT.")
+	g.P("// source: ", file.Desc.Path())
+	g.P()
+	g.P("package ", file.GoPackageName)
+	for _, service := range file.Services {
+		generateService(g, service, rpcPackage)
+	}
+	return g
+}
+
+func generateService(g *protogen.GeneratedFile, service *protogen.Service, rpcPackage protogen.GoImportPath) {
+	name := service.GoName
+	ctx := g.QualifiedGoIdent(contextPackage.Ident("Context"))
+	serializer := g.QualifiedGoIdent(protoPackage.Ident("Serializer"))
+	serviceName := name + "ServiceName"
+	clientName := name + "Client"
+	serverName := name + "Server"
+	adapterName := unexport(serverName)
+
+	g.P()
+	g.P("// ", serviceName, " 客户端和服务端共用的服务名")
+	g.P("const ", serviceName, " = \"", service.Desc.FullName(), "\"")
+	g.P()
+
+	// 客户端
+	g.P("// ", clientName, " 的字段由 rpc.Client 通过反射赋值，请求和响应使用 proto 序列化")
+	g.P("type ", clientName, " struct {")
+	for _, m := range service.Methods {
+		in, out := g.QualifiedGoIdent(m.Input.GoIdent), g.QualifiedGoIdent(m.Output.GoIdent)
+		if isStream(m) {
+			g.P(m.GoName, " func(ctx ", ctx, ") (*", g.QualifiedGoIdent(rpcPackage.Ident("Stream")), "[", in, ", ", out, "], error)")
+		} else {
+			g.P(m.GoName, " func(ctx ", ctx, ", req *", in, ") (*", out, ", error)")
+		}
+	}
+	g.P("}")
+	g.P()
+	g.P("func (c *", clientName, ") Name() string {")
+	g.P("return ", serviceName)
+	g.P("}")
+	g.P()
+	g.P("// New", clientName, " 创建 ", service.Desc.Name(), " 的客户端，不受 c 默认的序列化协议影响")
+	g.P("func New", clientName, "(c *", g.QualifiedGoIdent(rpcPackage.Ident("Client")), ") (*", clientName, ", error) {")
+	g.P("res := &", clientName, "{}")
+	g.P("if err := c.InitServiceWithSerializer(res, &", serializer, "{}); err != nil {")
+	g.P("return nil, err")
+	g.P("}")
+	g.P("return res, nil")
+	g.P("}")
+	g.P()
+
+	// 服务端
+	g.P("// ", serverName, " 是 ", service.Desc.Name(), " 的服务端需要实现的接口")
+	g.P("type ", serverName, " interface {")
+	for _, m := range service.Methods {
+		in, out := g.QualifiedGoIdent(m.Input.GoIdent), g.QualifiedGoIdent(m.Output.GoIdent)
+		if isStream(m) {
+			g.P(m.GoName, "(ctx ", ctx, ", stream *", g.QualifiedGoIdent(rpcPackage.Ident("Stream")), "[", out, ", ", in, "]) error")
+		} else {
+			g.P(m.GoName, "(ctx ", ctx, ", req *", in, ") (*", out, ", error)")
+		}
+	}
+	g.P("}")
+	g.P()
+	g.P("type ", adapterName, " struct {")
+	g.P(serverName)
+	g.P("}")
+	g.P()
+	g.P("func (s *", adapterName, ") Name() string {")
+	g.P("return ", serviceName)
+	g.P("}")
+	g.P()
+	// 流式方法仍然通过反射调用
+	methodHandler := g.QualifiedGoIdent(rpcPackage.Ident("MethodHandler"))
+	g.P("func (s *", adapterName, ") Handlers() map[string]", methodHandler, " {")
+	g.P("return map[string]", methodHandler, "{")
+	for _, m := range service.Methods {
+		if !isStream(m) {
+			g.P("\"", m.GoName, "\": ", g.QualifiedGoIdent(rpcPackage.Ident("UnaryHandler")), "(s.", serverName, ".", m.GoName, "),")
+		}
+	}
+	g.P("}")
+	g.P("}")
+	g.P()
+	g.P("// Register", serverName, " 把 impl 注册到 s，同时注册 proto 序列化协议")
+	g.P("func Register", serverName, "(s *", g.QualifiedGoIdent(rpcPackage.Ident("Serve")), ", impl ", serverName, ") error {")
+	g.P("s.RegisterSerialize(&", serializer, "{})")
+	g.P("return s.RegisterService(&", adapterName, "{", serverName, ": impl})")
+	g.P("}")
+}
+
+// isStream 客户端流、服务端流和双向流都使用 rpc.Stream
+func isStream(m *protogen.Method) bool {
+	return m.Desc.IsStreamingClient() || m.Desc.IsStreamingServer()
+}
+
+func unexport(name string) string {
+	return string(name[0]|0x20) + name[1:]
+}
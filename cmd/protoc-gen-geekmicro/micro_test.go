@@ -0,0 +1,45 @@
+package main
+
+import (
+	"geek_micro/cmd/protoc-gen-geekmicro/example"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
+	"os"
+	"testing"
+)
+
+// example 目录下的代码由 protoc 生成，同时也是这个测试的期望结果
+func TestGenerateFile(t *testing.T) {
+	want, err := os.ReadFile("example/user_service_micro.pb.go")
+	require.NoError(t, err)
+
+	fdp := protodesc.ToFileDescriptorProto(example.File_user_service_proto)
+	plugin, err := protogen.Options{}.New(&pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{fdp.GetName()},
+		ProtoFile:      []*descriptorpb.FileDescriptorProto{fdp},
+		Parameter:      stringPtr("paths=source_relative"),
+	})
+	require.NoError(t, err)
+	g := generateFile(plugin, plugin.Files[0], "geek_micro/rpc")
+	require.NotNil(t, g)
+	content, err := g.Content()
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(content))
+
+	// 没有 service 的文件不生成
+	fdp.Service = nil
+	plugin, err = protogen.Options{}.New(&pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{fdp.GetName()},
+		ProtoFile:      []*descriptorpb.FileDescriptorProto{fdp},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, generateFile(plugin, plugin.Files[0], "geek_micro/rpc"))
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
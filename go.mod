@@ -6,15 +6,12 @@ require github.com/stretchr/testify v1.9.0
 
 require (
 	github.com/golang/mock v1.6.0
-	github.com/silenceper/pool v1.0.0
+	github.com/golang/snappy v1.0.0
 	google.golang.org/protobuf v1.34.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/sirupsen/logrus v1.4.2 // indirect
-	golang.org/x/sys v0.0.0-20210510120138-977fb7262007 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -2,6 +2,7 @@ package net
 
 import (
 	"encoding/binary"
+	"io"
 	"net"
 	"time"
 )
@@ -38,16 +39,19 @@ func (c *Client) Send(data string) (string, error) {
 	}
 
 	lenBs := make([]byte, numOfLengthBytes)
-	_, err = conn.Read(lenBs)
+	_, err = io.ReadFull(conn, lenBs)
 	if err != nil {
 		return "", err
 	}
 
 	// 我响应有多长？
 	length := binary.BigEndian.Uint64(lenBs)
+	if length > maxMsgLength {
+		return "", errMsgTooLarge
+	}
 
 	respBs := make([]byte, length)
-	_, err = conn.Read(respBs)
+	_, err = io.ReadFull(conn, respBs)
 	if err != nil {
 		return "", err
 	}
@@ -2,11 +2,18 @@ package net
 
 import (
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
 )
 
 const numOfLengthBytes = 8
 
+// maxMsgLength 单个消息的最大长度，避免错误的长度导致分配过大的内存
+const maxMsgLength = 4 << 20
+
+var errMsgTooLarge = errors.New("micro: 消息超过了最大长度")
+
 type Serve struct {
 }
 
@@ -30,14 +37,18 @@ func (s *Serve) Start(network, address string) error {
 
 func (s *Serve) handleConn(conn net.Conn) error {
 	for {
+		// 一次 Read 不一定能读满，必须用 io.ReadFull
 		lengthByte := make([]byte, numOfLengthBytes)
-		_, err := conn.Read(lengthByte)
+		_, err := io.ReadFull(conn, lengthByte)
 		if err != nil {
 			return err
 		}
 		length := binary.BigEndian.Uint64(lengthByte)
+		if length > maxMsgLength {
+			return errMsgTooLarge
+		}
 		data := make([]byte, length)
-		_, err = conn.Read(data)
+		_, err = io.ReadFull(conn, data)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,324 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"geek_micro/rpc"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+	"sync"
+	"time"
+)
+
+// ErrOpen 熔断器打开的时候直接返回这个错误，请求不会发出去
+var ErrOpen = status.New(status.Unavailable, "micro: 熔断器已经打开")
+
+type State uint8
+
+const (
+	// Closed 正常放行，统计失败的情况
+	Closed State = iota
+	// Open 拒绝所有的调用，冷却之后进入 HalfOpen
+	Open
+	// HalfOpen 放行少量的探测调用，全部成功之后关闭，有一个失败就重新打开
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Event 熔断器的状态发生了变化
+type Event struct {
+	ServiceName string
+	MethodName  string
+	From        State
+	To          State
+}
+
+// Config 熔断的配置，零值使用默认的配置
+// ConsecutiveFailures 和 ErrorRate 满足一个就会打开，两个都为 0 的时候连续失败 5 次打开
+type Config struct {
+	// 连续失败多少次之后打开，0 表示不按照连续失败判断
+	ConsecutiveFailures int
+	// 统计窗口内的错误率达到多少之后打开，取值 (0, 1]，0 表示不按照错误率判断
+	ErrorRate float64
+	// 窗口内的调用次数达到 MinRequests 之后才按照错误率判断，默认是 20
+	MinRequests int
+	// 错误率的统计窗口，默认是 10s
+	Window time.Duration
+	// 打开之后经过多久进入半开，默认是 5s
+	CoolDown time.Duration
+	// 半开的时候放行的探测调用个数，默认是 1
+	HalfOpenRequests int
+	// 判断调用是不是失败了，默认是 DefaultIsFailure
+	IsFailure func(err error) bool
+	// 状态变化的时候调用，不能阻塞
+	OnStateChange func(e Event)
+}
+
+// DefaultIsFailure 网络错误、超时和服务端的系统错误算失败
+// InvalidArgument 之类的业务错误说明服务端是正常的
+// 熔断器按照方法统计，单个实例过载主动丢弃的请求（status.IsOverloaded）换个实例重试就可以，也不算失败
+func DefaultIsFailure(err error) bool {
+	if status.IsOverloaded(err) {
+		return false
+	}
+	switch status.CodeOf(err) {
+	case status.Unknown, status.DeadlineExceeded, status.ResourceExhausted,
+		status.Internal, status.Unavailable, status.DataLoss:
+		return true
+	default:
+		return false
+	}
+}
+
+// 统计窗口分成多少个桶
+const buckets = 10
+
+// Breakers 按照服务名和方法名各自维护一个熔断器
+type Breakers struct {
+	cfg Config
+	now func() time.Time
+
+	lock     sync.RWMutex
+	breakers map[key]*breaker
+}
+
+type key struct {
+	serviceName string
+	methodName  string
+}
+
+func New(cfg Config) *Breakers {
+	if cfg.ConsecutiveFailures <= 0 && cfg.ErrorRate <= 0 {
+		cfg.ConsecutiveFailures = 5
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Second * 10
+	}
+	if cfg.CoolDown <= 0 {
+		cfg.CoolDown = time.Second * 5
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	if cfg.IsFailure == nil {
+		cfg.IsFailure = DefaultIsFailure
+	}
+	return &Breakers{
+		cfg:      cfg,
+		now:      time.Now,
+		breakers: make(map[key]*breaker, 16),
+	}
+}
+
+// Interceptor 返回客户端拦截器，熔断器打开的时候返回 ErrOpen
+func (b *Breakers) Interceptor() rpc.ClientInterceptor {
+	return func(ctx context.Context, req *message.Request, next rpc.Invoker) (*message.Response, error) {
+		cb := b.get(req.ServiceName, req.MethodName)
+		generation, ok := b.allow(cb)
+		if !ok {
+			return nil, ErrOpen
+		}
+		resp, err := next(ctx, req)
+		if err == nil && resp != nil && len(resp.Error) > 0 {
+			// 服务端返回的错误
+			b.record(cb, generation, status.Decode(resp.Error))
+		} else {
+			b.record(cb, generation, err)
+		}
+		return resp, err
+	}
+}
+
+// State 返回服务的方法当前的状态，冷却时间到了但是还没有调用的时候仍然是 Open
+func (b *Breakers) State(serviceName, methodName string) State {
+	cb := b.get(serviceName, methodName)
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.state
+}
+
+func (b *Breakers) get(serviceName, methodName string) *breaker {
+	k := key{serviceName: serviceName, methodName: methodName}
+	b.lock.RLock()
+	cb, ok := b.breakers[k]
+	b.lock.RUnlock()
+	if ok {
+		return cb
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	cb, ok = b.breakers[k]
+	if !ok {
+		cb = &breaker{key: k, bucketSize: max(b.cfg.Window/buckets, 1)}
+		b.breakers[k] = cb
+	}
+	return cb
+}
+
+// allow 返回放行的时候熔断器所处的代，状态变化之后旧的调用结果不再统计
+func (b *Breakers) allow(cb *breaker) (uint64, bool) {
+	cb.lock.Lock()
+	var events []Event
+	now := b.now()
+	if cb.state == Open && now.Sub(cb.openedAt) >= b.cfg.CoolDown {
+		events = append(events, cb.transition(HalfOpen, now))
+	}
+	ok := false
+	switch cb.state {
+	case Closed:
+		ok = true
+	case HalfOpen:
+		if cb.probes < b.cfg.HalfOpenRequests {
+			cb.probes++
+			ok = true
+		}
+	}
+	generation := cb.generation
+	cb.lock.Unlock()
+	b.notify(events)
+	return generation, ok
+}
+
+func (b *Breakers) record(cb *breaker, generation uint64, err error) {
+	// 调用方自己取消的调用说明不了服务端的情况
+	canceled := errors.Is(err, context.Canceled)
+	failed := err != nil && !canceled && b.cfg.IsFailure(err)
+
+	cb.lock.Lock()
+	var events []Event
+	now := b.now()
+	if generation == cb.generation {
+		switch cb.state {
+		case Closed:
+			if !canceled && b.shouldTrip(cb, now, failed) {
+				events = append(events, cb.transition(Open, now))
+			}
+		case HalfOpen:
+			switch {
+			case failed:
+				events = append(events, cb.transition(Open, now))
+			case canceled:
+				// 把探测的名额还回去
+				cb.probes--
+			default:
+				cb.successes++
+				if cb.successes >= b.cfg.HalfOpenRequests {
+					events = append(events, cb.transition(Closed, now))
+				}
+			}
+		}
+	}
+	cb.lock.Unlock()
+	b.notify(events)
+}
+
+// shouldTrip 记录一次调用的结果，返回是不是需要打开
+func (b *Breakers) shouldTrip(cb *breaker, now time.Time, failed bool) bool {
+	cb.add(now, failed)
+	if !failed {
+		cb.consecutive = 0
+		return false
+	}
+	cb.consecutive++
+	if b.cfg.ConsecutiveFailures > 0 && cb.consecutive >= b.cfg.ConsecutiveFailures {
+		return true
+	}
+	if b.cfg.ErrorRate > 0 {
+		total, failures := cb.sum(now)
+		return total >= b.cfg.MinRequests && float64(failures) >= b.cfg.ErrorRate*float64(total)
+	}
+	return false
+}
+
+func (b *Breakers) notify(events []Event) {
+	if b.cfg.OnStateChange == nil {
+		return
+	}
+	for _, e := range events {
+		b.cfg.OnStateChange(e)
+	}
+}
+
+type breaker struct {
+	key key
+
+	lock  sync.Mutex
+	state State
+	// 每次状态变化加一
+	generation uint64
+	openedAt   time.Time
+
+	// 关闭状态下的统计
+	consecutive int
+	bucketSize  time.Duration
+	window      [buckets]bucket
+
+	// 半开状态下放行的探测调用和成功的探测调用
+	probes    int
+	successes int
+}
+
+type bucket struct {
+	// 这个桶对应的时间段的开始时间
+	start    time.Time
+	total    int
+	failures int
+}
+
+func (cb *breaker) transition(to State, now time.Time) Event {
+	e := Event{
+		ServiceName: cb.key.serviceName,
+		MethodName:  cb.key.methodName,
+		From:        cb.state,
+		To:          to,
+	}
+	cb.state = to
+	cb.generation++
+	cb.consecutive = 0
+	cb.window = [buckets]bucket{}
+	cb.probes = 0
+	cb.successes = 0
+	if to == Open {
+		cb.openedAt = now
+	}
+	return e
+}
+
+func (cb *breaker) add(now time.Time, failed bool) {
+	start := now.Truncate(cb.bucketSize)
+	b := &cb.window[(start.UnixNano()/int64(cb.bucketSize))%buckets]
+	if !b.start.Equal(start) {
+		// 这个桶上一次用的时候已经不在窗口里面了
+		*b = bucket{start: start}
+	}
+	b.total++
+	if failed {
+		b.failures++
+	}
+}
+
+func (cb *breaker) sum(now time.Time) (total, failures int) {
+	windowStart := now.Truncate(cb.bucketSize).Add(-cb.bucketSize * (buckets - 1))
+	for _, b := range cb.window {
+		if !b.start.Before(windowStart) {
+			total += b.total
+			failures += b.failures
+		}
+	}
+	return total, failures
+}
@@ -0,0 +1,189 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+// call 描述一次调用，err 为 nil 的时候调用成功
+type call struct {
+	// 调用之前时钟前进的时间
+	advance time.Duration
+	err     error
+	// 服务端返回的错误
+	respErr *status.Error
+
+	wantErr   error
+	wantState State
+}
+
+func TestBreakers(t *testing.T) {
+	unavailable := status.New(status.Unavailable, "down")
+	overloaded := status.New(status.Unavailable, "overloaded").WithDetails(status.Detail{Type: status.DetailOverloaded})
+	testCases := []struct {
+		name  string
+		cfg   Config
+		calls []call
+
+		wantEvents []Event
+	}{
+		{
+			name: "consecutive failures",
+			cfg:  Config{ConsecutiveFailures: 3},
+			calls: []call{
+				{err: io.EOF, wantErr: io.EOF, wantState: Closed},
+				{err: io.EOF, wantErr: io.EOF, wantState: Closed},
+				// 成功之后重新计数
+				{wantState: Closed},
+				{err: io.EOF, wantErr: io.EOF, wantState: Closed},
+				{respErr: unavailable, wantErr: nil, wantState: Closed},
+				{err: io.EOF, wantErr: io.EOF, wantState: Open},
+				// 打开之后直接失败
+				{wantErr: ErrOpen, wantState: Open},
+			},
+			wantEvents: []Event{{ServiceName: "user", MethodName: "Get", From: Closed, To: Open}},
+		},
+		{
+			name: "business errors",
+			cfg:  Config{ConsecutiveFailures: 2},
+			calls: []call{
+				{respErr: status.New(status.InvalidArgument, "bad"), wantState: Closed},
+				{respErr: status.New(status.NotFound, "no user"), wantState: Closed},
+				{err: context.Canceled, wantErr: context.Canceled, wantState: Closed},
+				{err: context.Canceled, wantErr: context.Canceled, wantState: Closed},
+			},
+		},
+		{
+			// 服务端过载主动丢弃的请求不算失败
+			name: "overloaded",
+			cfg:  Config{ConsecutiveFailures: 1},
+			calls: []call{
+				{respErr: overloaded, wantState: Closed},
+				{respErr: overloaded, wantState: Closed},
+			},
+		},
+		{
+			name: "error rate",
+			cfg:  Config{ErrorRate: 0.5, MinRequests: 4, Window: time.Second},
+			calls: []call{
+				{err: io.EOF, wantErr: io.EOF, wantState: Closed},
+				{wantState: Closed},
+				{err: io.EOF, wantErr: io.EOF, wantState: Closed},
+				// 前面三次调用已经滑出了窗口
+				{advance: time.Second, wantState: Closed},
+				{err: io.EOF, wantErr: io.EOF, wantState: Closed},
+				{wantState: Closed},
+				{err: io.EOF, wantErr: io.EOF, wantState: Open},
+			},
+			wantEvents: []Event{{ServiceName: "user", MethodName: "Get", From: Closed, To: Open}},
+		},
+		{
+			name: "half open success",
+			cfg:  Config{ConsecutiveFailures: 1, CoolDown: time.Second, HalfOpenRequests: 2},
+			calls: []call{
+				{err: io.EOF, wantErr: io.EOF, wantState: Open},
+				{advance: time.Millisecond * 500, wantErr: ErrOpen, wantState: Open},
+				{advance: time.Millisecond * 500, wantState: HalfOpen},
+				{wantState: Closed},
+			},
+			wantEvents: []Event{
+				{ServiceName: "user", MethodName: "Get", From: Closed, To: Open},
+				{ServiceName: "user", MethodName: "Get", From: Open, To: HalfOpen},
+				{ServiceName: "user", MethodName: "Get", From: HalfOpen, To: Closed},
+			},
+		},
+		{
+			name: "half open failure",
+			cfg:  Config{ConsecutiveFailures: 1, CoolDown: time.Second},
+			calls: []call{
+				{err: io.EOF, wantErr: io.EOF, wantState: Open},
+				{advance: time.Second, respErr: unavailable, wantState: Open},
+				// 重新开始冷却
+				{advance: time.Millisecond * 500, wantErr: ErrOpen, wantState: Open},
+				{advance: time.Millisecond * 500, wantState: Closed},
+			},
+			wantEvents: []Event{
+				{ServiceName: "user", MethodName: "Get", From: Closed, To: Open},
+				{ServiceName: "user", MethodName: "Get", From: Open, To: HalfOpen},
+				{ServiceName: "user", MethodName: "Get", From: HalfOpen, To: Open},
+				{ServiceName: "user", MethodName: "Get", From: Open, To: HalfOpen},
+				{ServiceName: "user", MethodName: "Get", From: HalfOpen, To: Closed},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var events []Event
+			tc.cfg.OnStateChange = func(e Event) {
+				events = append(events, e)
+			}
+			b := New(tc.cfg)
+			now := time.Unix(1000, 0)
+			b.now = func() time.Time {
+				return now
+			}
+			interceptor := b.Interceptor()
+			for i, c := range tc.calls {
+				now = now.Add(c.advance)
+				_, err := interceptor(context.Background(), &message.Request{ServiceName: "user", MethodName: "Get"},
+					func(ctx context.Context, req *message.Request) (*message.Response, error) {
+						if c.respErr != nil {
+							return &message.Response{Error: status.Encode(c.respErr)}, nil
+						}
+						return &message.Response{}, c.err
+					})
+				assert.Equal(t, c.wantErr, err, "第 %d 次调用", i)
+				assert.Equal(t, c.wantState, b.State("user", "Get"), "第 %d 次调用", i)
+			}
+			assert.Equal(t, tc.wantEvents, events)
+		})
+	}
+}
+
+func TestBreakersHalfOpenProbes(t *testing.T) {
+	b := New(Config{ConsecutiveFailures: 1, CoolDown: time.Second})
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time {
+		return now
+	}
+	interceptor := b.Interceptor()
+	fail := func(ctx context.Context, req *message.Request) (*message.Response, error) {
+		return nil, io.EOF
+	}
+	req := &message.Request{ServiceName: "user", MethodName: "Get"}
+	_, _ = interceptor(context.Background(), req, fail)
+	assert.Equal(t, Open, b.State("user", "Get"))
+
+	// 同一个服务的其它方法不受影响
+	_, err := interceptor(context.Background(), &message.Request{ServiceName: "user", MethodName: "List"},
+		func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			return &message.Response{}, nil
+		})
+	assert.NoError(t, err)
+
+	// 半开的时候只放行一个探测调用
+	now = now.Add(time.Second)
+	probing, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, er := interceptor(context.Background(), req, func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			close(probing)
+			<-release
+			return &message.Response{}, nil
+		})
+		done <- er
+	}()
+	<-probing
+	_, err = interceptor(context.Background(), req, fail)
+	assert.True(t, errors.Is(err, ErrOpen))
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, Closed, b.State("user", "Get"))
+}
@@ -3,14 +3,22 @@ package rpc
 import (
 	"context"
 	"errors"
+	"fmt"
+	"geek_micro/rpc/compress"
+	"geek_micro/rpc/loadbalance"
+	"geek_micro/rpc/loadbalance/roundrobin"
 	"geek_micro/rpc/message"
+	"geek_micro/rpc/registry"
 	"geek_micro/rpc/serialize"
 	"geek_micro/rpc/serialize/json"
+	"geek_micro/rpc/status"
+	"io"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/silenceper/pool"
 )
 
 // InitService 要为 GetById 之类的函数类型的字段赋值
@@ -18,6 +26,12 @@ func (c *Client) InitService(service Service) error {
 	return setStructFunc(service, c, c.serializer)
 }
 
+// InitServiceWithSerializer 和 InitService 一样，但是这个服务使用 s 而不是客户端默认的序列化协议
+// 服务端需要注册相同的序列化协议
+func (c *Client) InitServiceWithSerializer(service Service, s serialize.Serialize) error {
+	return setStructFunc(service, c, s)
+}
+
 func setStructFunc(service Service, p Proxy, s serialize.Serialize) error {
 	if service == nil {
 		return errors.New("rpc: 不支持 nil")
@@ -29,94 +43,377 @@ func setStructFunc(service Service, p Proxy, s serialize.Serialize) error {
 	}
 	vOf = vOf.Elem()
 	tOf = tOf.Elem()
-	numField := vOf.NumField()
-	for i := 0; i < numField; i++ {
-		fieldVal := vOf.Field(i)
-		fieldTyp := tOf.Field(i)
+	sp, isStreamProxy := p.(StreamProxy)
 
-		if fieldVal.CanSet() {
-			fn := func(args []reflect.Value) (results []reflect.Value) {
-				//args[0] 是 context.Context
-				//args[1] 是 req（用户的请求数据）
-				ctx := args[0].Interface().(context.Context)
-
-				// Out 对那个Type为函数类型时，第i+1个返回值
-				// eg: GetByIdResp
-				retVal := reflect.New(fieldTyp.Type.Out(0).Elem())
-
-				reqData, err := s.Encode(args[1].Interface())
-				if err != nil {
-					return []reflect.Value{retVal, reflect.ValueOf(err)}
-				}
-
-				var meta map[string]string
-				if isOneWay(ctx) {
-					meta = map[string]string{"one-way": "true"}
-				}
-
-				req := &message.Request{
-					Serializer:  s.Code(),
-					ServiceName: service.Name(),
-					MethodName:  fieldTyp.Name,
-					Data:        reqData,
-					Meta:        meta,
-				}
-
-				req.SetHeadLength()
-				req.SetBodyLength()
-
-				// resp => eg: Response { data : []byte("{"Msg": "Hello, world"}") }
-				resp, err := p.Invoke(ctx, req)
-
-				if err != nil {
-					// 这里可能是网络异常
-					return []reflect.Value{retVal, reflect.ValueOf(err)}
-				}
-
-				var retErr error
-				if len(resp.Error) > 0 {
-					// 远端执行返回的错误
-					retErr = errors.New(string(resp.Error))
-				}
-
-				if len(resp.Data) > 0 {
-					// 返回值序列化
-					err = s.Decode(resp.Data, retVal.Interface())
-					if err != nil {
-						// 序列化出错
-						return []reflect.Value{retVal, reflect.ValueOf(err)}
-					}
-				}
-
-				var retErrVal reflect.Value
-				if retErr == nil {
-					retErrVal = reflect.Zero(reflect.TypeOf(new(error)).Elem())
-				} else {
-					retErrVal = reflect.ValueOf(retErr)
-				}
-
-				return []reflect.Value{retVal, retErrVal}
+	// 先检查所有的字段，有一个不对就不赋值
+	fns := make(map[int]reflect.Value, tOf.NumField())
+	var errs []error
+	for i := 0; i < tOf.NumField(); i++ {
+		fieldTyp := tOf.Field(i)
+		// 只处理导出的函数类型的字段，其它的字段不动
+		if !fieldTyp.IsExported() || fieldTyp.Type.Kind() != reflect.Func {
+			continue
+		}
+		if err := checkTag(fieldTyp); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		switch {
+		case isUnaryFunc(fieldTyp.Type):
+			fns[i] = makeUnaryFunc(service.Name(), fieldTyp, p, s)
+		case isStreamFunc(fieldTyp.Type):
+			if !isStreamProxy {
+				errs = append(errs, fmt.Errorf("rpc: %s 是流式调用，但是 Proxy 不支持流", fieldTyp.Name))
+				continue
+			}
+			// 流不经过拦截器，也没有 oneway 的说法
+			if _, ok := fieldTyp.Tag.Lookup("rpc"); ok {
+				errs = append(errs, fmt.Errorf("rpc: %s 是流式调用，不支持 rpc 标签", fieldTyp.Name))
+				continue
 			}
-			fnVal := reflect.MakeFunc(fieldTyp.Type, fn)
-			fieldVal.Set(fnVal)
+			fns[i] = makeStreamFunc(service.Name(), fieldTyp, sp, s)
+		default:
+			errs = append(errs, fmt.Errorf("rpc: %s 的字段 %s 的类型 %s 不支持，"+
+				"只支持 func(context.Context, *Req) (*Resp, error) 和 func(context.Context) (*rpc.Stream[Req, Resp], error)",
+				service.Name(), fieldTyp.Name, fieldTyp.Type))
 		}
 	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	for i, fn := range fns {
+		vOf.Field(i).Set(fn)
+	}
 	return nil
 }
 
+// 字段上的 rpc 标签支持的选项，多个选项用逗号分隔
+const (
+	// 调用的时候不等待响应，和 CtxWithOneWay 一样
+	tagOneWay = "oneway"
+	// 方法是幂等的，可以重试，和 CtxWithIdempotent 一样
+	tagIdempotent = "idempotent"
+)
+
+// checkTag 不认识的选项多半是拼错了，在初始化的时候就报告出来
+func checkTag(field reflect.StructField) error {
+	tag, ok := field.Tag.Lookup("rpc")
+	if !ok {
+		return nil
+	}
+	for _, opt := range strings.Split(tag, ",") {
+		switch strings.TrimSpace(opt) {
+		case tagOneWay, tagIdempotent:
+		default:
+			return fmt.Errorf("rpc: %s 的标签 rpc:%q 中有不支持的选项 %q", field.Name, tag, opt)
+		}
+	}
+	return nil
+}
+
+func hasTagOption(field reflect.StructField, option string) bool {
+	for _, opt := range strings.Split(field.Tag.Get("rpc"), ",") {
+		if strings.TrimSpace(opt) == option {
+			return true
+		}
+	}
+	return false
+}
+
+// makeUnaryFunc 为 func(ctx context.Context, req *Req) (*Resp, error) 类型的字段生成实现
+func makeUnaryFunc(serviceName string, field reflect.StructField, p Proxy, s serialize.Serialize) reflect.Value {
+	oneway, idempotent := hasTagOption(field, tagOneWay), hasTagOption(field, tagIdempotent)
+	return reflect.MakeFunc(field.Type, func(args []reflect.Value) (results []reflect.Value) {
+		//args[0] 是 context.Context
+		//args[1] 是 req（用户的请求数据）
+		ctx := args[0].Interface().(context.Context)
+		if oneway {
+			ctx = CtxWithOneWay(ctx)
+		}
+		if idempotent {
+			ctx = CtxWithIdempotent(ctx)
+		}
+
+		// Out 对那个Type为函数类型时，第i+1个返回值
+		// eg: GetByIdResp
+		retVal := reflect.New(field.Type.Out(0).Elem())
+
+		reqData, err := s.Encode(args[1].Interface())
+		if err != nil {
+			return []reflect.Value{retVal, reflect.ValueOf(err)}
+		}
+
+		meta, err := outgoingMeta(ctx)
+		if err != nil {
+			return []reflect.Value{retVal, reflect.ValueOf(err)}
+		}
+
+		req := &message.Request{
+			Serializer:  s.Code(),
+			ServiceName: serviceName,
+			MethodName:  field.Name,
+			Data:        reqData,
+			Meta:        meta,
+		}
+
+		// resp => eg: Response { data : []byte("{"Msg": "Hello, world"}") }
+		resp, err := p.Invoke(ctx, req)
+
+		if err != nil {
+			// 这里可能是网络异常
+			return []reflect.Value{retVal, reflect.ValueOf(err)}
+		}
+		if isOneWay(ctx) {
+			// 请求已经写出去了，没有响应
+			return []reflect.Value{reflect.Zero(field.Type.Out(0)), reflect.Zero(errorType)}
+		}
+
+		var retErr error
+		if len(resp.Error) > 0 {
+			// 远端执行返回的错误，可以用 errors.As 拿到 *status.Error
+			retErr = status.Decode(resp.Error)
+		}
+
+		if len(resp.Data) > 0 {
+			// 返回值序列化
+			err = s.Decode(resp.Data, retVal.Interface())
+			if err != nil {
+				// 序列化出错
+				return []reflect.Value{retVal, reflect.ValueOf(err)}
+			}
+		}
+
+		var retErrVal reflect.Value
+		if retErr == nil {
+			retErrVal = reflect.Zero(reflect.TypeOf(new(error)).Elem())
+		} else {
+			retErrVal = reflect.ValueOf(retErr)
+		}
+
+		return []reflect.Value{retVal, retErrVal}
+	})
+}
+
+// makeStreamFunc 为 func(ctx context.Context) (*Stream[Req, Resp], error) 类型的字段生成实现
+func makeStreamFunc(serviceName string, field reflect.StructField, sp StreamProxy, s serialize.Serialize) reflect.Value {
+	return reflect.MakeFunc(field.Type, func(args []reflect.Value) []reflect.Value {
+		ctx := args[0].Interface().(context.Context)
+		meta, err := outgoingMeta(ctx)
+		if err != nil {
+			return []reflect.Value{reflect.Zero(field.Type.Out(0)), reflect.ValueOf(&err).Elem()}
+		}
+		raw, err := sp.NewStream(ctx, &message.Request{
+			Serializer:  s.Code(),
+			ServiceName: serviceName,
+			MethodName:  field.Name,
+			Meta:        meta,
+		})
+		if err != nil {
+			return []reflect.Value{reflect.Zero(field.Type.Out(0)), reflect.ValueOf(&err).Elem()}
+		}
+		stream := reflect.New(field.Type.Out(0).Elem())
+		stream.Interface().(streamBinder).bind(raw, s)
+		return []reflect.Value{stream, reflect.Zero(field.Type.Out(1))}
+	})
+}
+
 type Client struct {
-	pool       pool.Pool
+	addr       string
 	serializer serialize.Serialize
+	// 为 nil 的时候不压缩
+	compressor compress.Compressor
+	// 不为 nil 的时候，根据请求的服务名从注册中心获取地址，而不是使用 addr
+	registry registry.Registry
+	// 从一个服务的多个实例中挑选一个，默认是轮询
+	balancer loadbalance.Builder
+	// 为 nil 的时候不做健康检查
+	healthCheck *healthCheck
+
+	// 单个响应的最大长度
+	maxFrameSize uint32
+	// 请求使用的最高协议版本，服务端会用相同的版本返回响应
+	version uint8
+
+	interceptors []ClientInterceptor
+	// 拦截器和 send 组装起来的调用链
+	invoker Invoker
+
+	lock sync.Mutex
+	// 每个地址一个连接，发往同一个地址的调用复用这个连接
+	// 连接断开之后下一次调用会重新建立
+	conns map[string]*clientConn
+	// 正在建立的连接，同一个地址同时只有一个 goroutine 在拨号
+	dials map[string]*dialCall
+	// 每个服务一个 resolver，key 是服务名
+	resolvers map[string]*resolver
+
+	// 用于生成请求的 MessageId
+	messageId atomic.Uint32
+	close     chan struct{}
+	closed    bool
 }
 
+// Invoke 经过所有的拦截器之后把请求发送出去
 func (c *Client) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
-	// rpc通信中 传输需要进行
-	data := message.EncodeReq(req)
-	result, err := c.send(ctx, data)
+	return c.invoker(ctx, req)
+}
+
+// send 是拦截器链的最里层，挑选一个实例并且发送请求
+func (c *Client) send(ctx context.Context, req *message.Request) (*message.Response, error) {
+	cc, done, err := c.pick(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.invoke(ctx, cc, req)
+	done(err)
+	return resp, err
+}
+
+// pick 挑选一个实例并且返回它的连接，调用结束之后需要把结果告诉 done
+func (c *Client) pick(ctx context.Context, req *message.Request) (*clientConn, func(err error), error) {
+	if c.registry == nil {
+		cc, err := c.getConn(ctx, c.addr)
+		return cc, func(err error) {}, err
+	}
+
+	r, err := c.getResolver(req.ServiceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := r.pick(loadbalance.PickInfo{
+		ServiceName: req.ServiceName,
+		MethodName:  req.MethodName,
+		Meta:        req.Meta,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	done := res.Done
+	if done == nil {
+		done = func(err error) {}
+	}
+	cc, err := c.getConn(ctx, res.Instance.Address)
+	if err != nil {
+		done(err)
+		// 连不上的实例先摘掉，等健康检查通过之后再加回来
+		// 调用方自己超时或者取消的时候，说明不了实例的情况
+		if c.healthCheck != nil && ctx.Err() == nil {
+			r.markUnhealthy(res.Instance.Address)
+		}
+		return nil, nil, err
+	}
+	return cc, done, nil
+}
+
+// NewStream 挑选一个实例并且打开一个流
+func (c *Client) NewStream(ctx context.Context, req *message.Request) (RawStream, error) {
+	cc, done, err := c.pick(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	// 复制一份，避免修改调用方持有的请求
+	r := *req
+	req = &r
+	req.MessageId = c.messageId.Add(1)
+	req.Version = uint8(cc.version.Load())
+	req.Flags = message.FlagStream
+	if req.Version < message.Version2 {
+		err = status.New(status.Unimplemented, "micro: 流式调用需要 Version2 以上的协议版本")
+	} else {
+		err = setMeta(ctx, req)
+	}
+	if c.compressor != nil {
+		req.Compresser = c.compressor.Code()
+	}
+	var st *clientStream
+	if err == nil {
+		st, err = cc.openStream(ctx, req, c.compressor)
+	}
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+	go func() {
+		<-st.core.done
+		err := st.core.err
+		if err == io.EOF {
+			err = nil
+		}
+		done(err)
+	}()
+	return st, nil
+}
+
+// invoke 通过 cc 发送请求并等待响应
+func (c *Client) invoke(ctx context.Context, cc *clientConn, req *message.Request) (*message.Response, error) {
+	var err error
+	// 复制一份，避免修改调用方持有的请求
+	r := *req
+	req = &r
+	req.MessageId = c.messageId.Add(1)
+	if err = setMeta(ctx, req); err != nil {
+		return nil, err
+	}
+	if c.compressor != nil {
+		req.Data, err = c.compressor.Compress(req.Data)
+		if err != nil {
+			return nil, err
+		}
+		req.Compresser = c.compressor.Code()
+	}
+	req.Version = uint8(cc.version.Load())
+	req.SetHeadLength()
+	req.SetBodyLength()
+
+	oneway := isOneWay(ctx)
+	resp, err := cc.roundTrip(ctx, req, oneway)
 	if err != nil {
 		return nil, err
 	}
-	return message.DecodeResp(result), nil
+	if oneway {
+		// 服务端不会返回响应，给拦截器一个空的响应
+		return &message.Response{MessageId: req.MessageId, Version: req.Version}, nil
+	}
+	if version, ok := c.downgrade(cc, req.Version, resp); ok {
+		// 服务端不支持这个版本，降级之后重试一次
+		req.MessageId = c.messageId.Add(1)
+		req.Version = version
+		req.SetHeadLength()
+		resp, err = cc.roundTrip(ctx, req, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.Compresser != 0 && len(resp.Data) > 0 {
+		// 服务端使用和请求相同的压缩算法
+		if c.compressor == nil || c.compressor.Code() != resp.Compresser {
+			return nil, errUnsupportedCompressor
+		}
+		resp.Data, err = decompress(c.compressor, resp.Data, c.maxFrameSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// downgrade 服务端拒绝了请求的协议版本时，把连接降级到双方都支持的最高版本
+func (c *Client) downgrade(cc *clientConn, version uint8, resp *message.Response) (uint8, bool) {
+	if len(resp.Error) == 0 {
+		return 0, false
+	}
+	supported, ok := supportedVersions(status.Decode(resp.Error))
+	if !ok {
+		return 0, false
+	}
+	res, ok := negotiate(supported, c.version)
+	// 服务端支持的版本不比现在低，说明不是版本的问题
+	if !ok || res >= version {
+		return 0, false
+	}
+	// 并发的调用可能已经降过级了，保留更低的版本
+	cc.version.CompareAndSwap(uint32(version), uint32(res))
+	return res, true
 }
 
 type ClientOptions func(client *Client)
@@ -127,56 +424,240 @@ func ClientWithSerializer(sl serialize.Serialize) ClientOptions {
 	}
 }
 
-func NewClient(addr string, opts ...ClientOptions) (*Client, error) {
-	p, err := pool.NewChannelPool(&pool.Config{
-		InitialCap:  1,
-		MaxCap:      30,
-		MaxIdle:     10,
-		IdleTimeout: time.Minute,
-		Factory: func() (interface{}, error) {
-			conn, err := net.DialTimeout("tcp", addr, time.Second*3)
-			if err != nil {
-				return nil, err
-			}
-			return conn, nil
-		},
-		Close: func(i interface{}) error {
-			return i.(net.Conn).Close()
-		},
-	})
-	if err != nil {
-		return nil, err
+// ClientWithRegistry 根据服务名从 r 中获取服务实例，并且监听实例的变化
+func ClientWithRegistry(r registry.Registry) ClientOptions {
+	return func(client *Client) {
+		client.registry = r
 	}
+}
+
+// ClientWithBalancer 设置负载均衡算法，只在使用注册中心的时候生效
+func ClientWithBalancer(b loadbalance.Builder) ClientOptions {
+	return func(client *Client) {
+		client.balancer = b
+	}
+}
+
+// ClientWithHealthCheck 每隔 interval 检查一次所有实例能否连上，
+// 连不上的实例不会被负载均衡选中，直到检查再次通过
+func ClientWithHealthCheck(interval, timeout time.Duration) ClientOptions {
+	return func(client *Client) {
+		client.healthCheck = &healthCheck{
+			interval: interval,
+			timeout:  timeout,
+		}
+	}
+}
+
+// ClientWithInterceptors 按照顺序把拦截器包在 Invoke 外面，第一个拦截器在最外层
+func ClientWithInterceptors(interceptors ...ClientInterceptor) ClientOptions {
+	return func(client *Client) {
+		client.interceptors = append(client.interceptors, interceptors...)
+	}
+}
+
+// ClientWithMaxFrameSize 设置单个响应（头部加数据）的最大长度，默认是 DefaultMaxFrameSize
+func ClientWithMaxFrameSize(size uint32) ClientOptions {
+	return func(client *Client) {
+		client.maxFrameSize = size
+	}
+}
+
+// ClientWithProtocolVersion 设置请求使用的最高协议版本，默认是 message.LatestVersion
+// 建立连接的时候会和服务端协商，使用双方都支持的最高版本，不认识协商请求的旧服务端使用 Version1
+func ClientWithProtocolVersion(version uint8) ClientOptions {
+	return func(client *Client) {
+		client.version = version
+	}
+}
+
+// ClientWithCompressor 请求数据使用 c 压缩，服务端需要注册相同的压缩算法
+func ClientWithCompressor(c compress.Compressor) ClientOptions {
+	return func(client *Client) {
+		client.compressor = c
+	}
+}
+
+// NewClient 创建一个连接到 addr 的客户端
+// 使用了 ClientWithRegistry 的时候，地址从注册中心获取，addr 会被忽略
+func NewClient(addr string, opts ...ClientOptions) (*Client, error) {
 	res := &Client{
-		pool:       p,
-		serializer: &json.Serializer{},
+		addr:         addr,
+		serializer:   &json.Serializer{},
+		balancer:     &roundrobin.Builder{},
+		maxFrameSize: DefaultMaxFrameSize,
+		version:      message.LatestVersion,
+		conns:        make(map[string]*clientConn, 4),
+		dials:        make(map[string]*dialCall, 4),
+		resolvers:    make(map[string]*resolver, 4),
+		close:        make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(res)
 	}
+	res.invoker = buildClientChain(res.interceptors, res.send)
+	if res.registry != nil {
+		return res, nil
+	}
+	// 提前建立连接，地址不可用的时候尽早暴露出来
+	if _, err := res.getConn(context.Background(), addr); err != nil {
+		return nil, err
+	}
 	return res, nil
 }
 
-func (c *Client) send(ctx context.Context, req []byte) ([]byte, error) {
-	val, err := c.pool.Get()
+func (c *Client) getResolver(serviceName string) (*resolver, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, errConnClosed
+	}
+	r, ok := c.resolvers[serviceName]
+	if ok {
+		return r, nil
+	}
+	r, err := newResolver(serviceName, c.registry, c.balancer, c.healthCheck, c.closeRemoved, c.close)
 	if err != nil {
 		return nil, err
 	}
-	conn := val.(net.Conn)
-	defer func() {
-		_ = c.pool.Put(val)
-	}()
+	c.resolvers[serviceName] = r
+	return r, nil
+}
+
+// dialCall 一次正在进行的拨号，结束之后关闭 done
+type dialCall struct {
+	done chan struct{}
+	cc   *clientConn
+	err  error
+}
+
+// getConn 返回 addr 的连接，没有的时候建立一个
+// 拨号和协商版本不持有 c.lock，连不上的实例不会影响发往其它实例的调用
+// 同一个地址同时只会拨号一次，等待的调用方超时或者取消的时候直接返回
+func (c *Client) getConn(ctx context.Context, addr string) (*clientConn, error) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil, errConnClosed
+	}
+	if cc, ok := c.conns[addr]; ok && !cc.isClosed() {
+		c.lock.Unlock()
+		return cc, nil
+	}
+	call, ok := c.dials[addr]
+	if !ok {
+		call = &dialCall{done: make(chan struct{})}
+		c.dials[addr] = call
+		// 拨号的结果留给其它调用方，不受发起拨号的调用方的 ctx 影响
+		go c.dial(addr, call)
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.cc, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.close:
+		return nil, errConnClosed
+	}
+}
 
-	_, err = conn.Write(req)
+func (c *Client) dial(addr string, call *dialCall) {
+	cc, err := c.connect(addr)
+	c.lock.Lock()
+	delete(c.dials, addr)
+	if err == nil {
+		if c.closed {
+			cc.close(errConnClosed)
+			cc, err = nil, errConnClosed
+		} else {
+			c.conns[addr] = cc
+		}
+	}
+	c.lock.Unlock()
+	call.cc, call.err = cc, err
+	close(call.done)
+}
+
+func (c *Client) connect(addr string) (*clientConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second*3)
 	if err != nil {
 		return nil, err
 	}
+	cc := newClientConn(conn, c.maxFrameSize, c.version)
+	// 在发送任何请求之前确定协议版本，oneway 请求被拒绝的时候客户端是不知道的
+	if err = c.handshake(cc); err != nil {
+		cc.close(err)
+		return nil, err
+	}
+	return cc, nil
+}
 
-	if isOneWay(ctx) {
-		return nil, errors.New("micro: 这是一个 oneway 调用，你不应该处理任何结果")
+// closeRemoved 注册中心的实例变化之后，关闭所有服务都不再使用的地址的连接
+// 正在进行的调用和流不受影响，结束之后才会真正关闭
+func (c *Client) closeRemoved() {
+	c.lock.Lock()
+	addrs := make(map[string]struct{}, len(c.conns))
+	for _, r := range c.resolvers {
+		for _, ins := range r.list() {
+			addrs[ins.Address] = struct{}{}
+		}
+	}
+	var removed []*clientConn
+	for addr, cc := range c.conns {
+		if _, ok := addrs[addr]; !ok {
+			delete(c.conns, addr)
+			removed = append(removed, cc)
+		}
+	}
+	c.lock.Unlock()
+	for _, cc := range removed {
+		cc.drain()
 	}
+}
 
-	respBs, err := ReadMsg(conn)
+// handshake 用所有服务端都认识的 Version1 询问服务端支持的协议版本，选出双方都支持的最高版本
+// 新的服务端在响应数据里面返回支持的版本，不支持 Version1 的服务端在拒绝的错误里面返回，
+// 旧的服务端不认识这个服务，只支持 Version1
+func (c *Client) handshake(cc *clientConn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	req := &message.Request{
+		MessageId:   c.messageId.Add(1),
+		Version:     message.Version1,
+		ServiceName: handshakeService,
+	}
+	req.SetHeadLength()
+	req.SetBodyLength()
+	resp, err := cc.roundTrip(ctx, req, false)
+	if err != nil {
+		return err
+	}
+	supported := []uint8{message.Version1}
+	if len(resp.Error) == 0 {
+		supported = resp.Data
+	} else if versions, ok := supportedVersions(status.Decode(resp.Error)); ok {
+		supported = versions
+	}
+	// 没有双方都支持的版本的时候保持原样，调用的时候会收到服务端的拒绝
+	if version, ok := negotiate(supported, c.version); ok {
+		cc.version.Store(uint32(version))
+	}
+	return nil
+}
 
-	return respBs, err
+// Close 关闭所有的连接，正在等待响应的调用会返回错误
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.close)
+	for _, cc := range c.conns {
+		cc.close(errConnClosed)
+	}
+	return nil
 }
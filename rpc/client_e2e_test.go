@@ -3,14 +3,46 @@ package rpc
 import (
 	"context"
 	"errors"
+	"fmt"
+	"geek_micro/rpc/compress"
+	"geek_micro/rpc/compress/gzip"
+	"geek_micro/rpc/compress/snappy"
+	"geek_micro/rpc/loadbalance"
+	"geek_micro/rpc/loadbalance/weighted"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/metadata"
 	"geek_micro/rpc/proto/gen"
+	"geek_micro/rpc/registry"
+	"geek_micro/rpc/registry/memory"
 	"geek_micro/rpc/serialize/proto"
+	"geek_micro/rpc/status"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// startServer 在 address 上启动 server，测试结束的时候优雅退出
+// address 的端口为 0 的时候使用随机端口，返回实际监听的地址
+func startServer(t *testing.T, server *Serve, address string) string {
+	require.NoError(t, server.Listen("tcp", address))
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve()
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		assert.Equal(t, ErrServerClosed, <-done)
+	})
+	return server.Addr().String()
+}
+
 func TestInitClientProto(t *testing.T) {
 	// 初始化服务端
 	server := NewServer()
@@ -18,15 +50,11 @@ func TestInitClientProto(t *testing.T) {
 	// 服务端注册方法
 	server.RegisterService(service)
 	server.RegisterSerialize(&proto.Serializer{})
-	go func() {
-		err := server.Start("tcp", ":8081")
-		t.Log(err)
-	}()
-	time.Sleep(time.Second * 3)
+	addr := startServer(t, server, "127.0.0.1:0")
 
 	// 初始化客户端
 	us := &UserService{}
-	client, err := NewClient("localhost:8081", ClientWithSerializer(&proto.Serializer{}))
+	client, err := NewClient(addr, ClientWithSerializer(&proto.Serializer{}))
 	require.NoError(t, err)
 	err = client.InitService(us)
 	require.NoError(t, err)
@@ -54,7 +82,7 @@ func TestInitClientProto(t *testing.T) {
 				service.Err = errors.New("error")
 				service.Msg = ""
 			},
-			wantErr:  errors.New("error"),
+			wantErr:  status.New(status.Unknown, "error"),
 			wantResp: &GetByIdResp{},
 		},
 		{
@@ -63,7 +91,7 @@ func TestInitClientProto(t *testing.T) {
 				service.Err = errors.New("error")
 				service.Msg = "123"
 			},
-			wantErr: errors.New("error"),
+			wantErr: status.New(status.Unknown, "error"),
 			wantResp: &GetByIdResp{
 				Msg: "123",
 			},
@@ -89,15 +117,11 @@ func TestInitClientJSON(t *testing.T) {
 	service := &UserServiceServer{}
 	// 服务端注册方法
 	server.RegisterService(service)
-	go func() {
-		err := server.Start("tcp", ":8081")
-		t.Log(err)
-	}()
-	time.Sleep(time.Second * 3)
+	addr := startServer(t, server, "127.0.0.1:0")
 
 	// 初始化客户端
 	us := &UserService{}
-	client, err := NewClient("localhost:8081")
+	client, err := NewClient(addr)
 	require.NoError(t, err)
 	err = client.InitService(us)
 	require.NoError(t, err)
@@ -125,7 +149,7 @@ func TestInitClientJSON(t *testing.T) {
 				service.Err = errors.New("error")
 				service.Msg = ""
 			},
-			wantErr:  errors.New("error"),
+			wantErr:  status.New(status.Unknown, "error"),
 			wantResp: &GetByIdResp{},
 		},
 		{
@@ -134,7 +158,7 @@ func TestInitClientJSON(t *testing.T) {
 				service.Err = errors.New("error")
 				service.Msg = "123"
 			},
-			wantErr: errors.New("error"),
+			wantErr: status.New(status.Unknown, "error"),
 			wantResp: &GetByIdResp{
 				Msg: "123",
 			},
@@ -156,48 +180,916 @@ func TestInitClientJSON(t *testing.T) {
 func TestInitClientOneWay(t *testing.T) {
 	// 初始化服务端
 	server := NewServer()
-	service := &UserServiceServer{}
-	// 服务端注册方法
-	server.RegisterService(service)
-	go func() {
-		err := server.Start("tcp", ":8081")
-		t.Log(err)
+	service := &onewayServer{received: make(chan int, 4)}
+	require.NoError(t, server.RegisterService(service))
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	// 初始化客户端
+	us := &onewayService{}
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	require.NoError(t, client.InitService(us))
+
+	testCases := []struct {
+		name string
+		call func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+		ctx  context.Context
+	}{
+		{
+			name: "ctx",
+			call: us.Echo,
+			ctx:  CtxWithOneWay(context.Background()),
+		},
+		{
+			name: "tag",
+			call: us.Notify,
+			ctx:  context.Background(),
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// 写出去就返回，业务方法的错误也拿不到
+			resp, er := tc.call(tc.ctx, &GetByIdReq{Id: i})
+			assert.NoError(t, er)
+			assert.Nil(t, resp)
+			select {
+			case id := <-service.received:
+				assert.Equal(t, i, id)
+			case <-time.After(time.Second):
+				t.Fatal("服务端没有收到 oneway 请求")
+			}
+
+			// 服务端没有返回响应，同一个连接上后面的调用拿到的是自己的响应
+			resp, er = us.Echo(context.Background(), &GetByIdReq{Id: 100 + i})
+			require.NoError(t, er)
+			assert.Equal(t, &GetByIdResp{Msg: fmt.Sprint(100 + i)}, resp)
+			<-service.received
+		})
+	}
+}
+
+func TestInitClientOneWayDowngrade(t *testing.T) {
+	// 服务端不支持客户端默认的版本，第一个调用就是 oneway 调用
+	server := NewServer(ServerWithProtocolVersions(message.Version1))
+	service := &onewayServer{received: make(chan int, 1)}
+	require.NoError(t, server.RegisterService(service))
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
 	}()
-	time.Sleep(time.Second * 3)
+	us := &onewayService{}
+	require.NoError(t, client.InitService(us))
+
+	_, err = us.Notify(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	select {
+	case id := <-service.received:
+		assert.Equal(t, 1, id)
+	case <-time.After(time.Second):
+		t.Fatal("服务端没有收到 oneway 请求")
+	}
+}
+
+type onewayService struct {
+	Echo   func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	Notify func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) `rpc:"oneway"`
+}
+
+func (s *onewayService) Name() string {
+	return "oneway"
+}
+
+type onewayServer struct {
+	received chan int
+}
+
+func (s *onewayServer) Name() string {
+	return "oneway"
+}
+
+func (s *onewayServer) Echo(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	s.received <- req.Id
+	return &GetByIdResp{Msg: fmt.Sprint(req.Id)}, nil
+}
+
+func (s *onewayServer) Notify(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	s.received <- req.Id
+	return nil, errors.New("oneway 拿不到这个错误")
+}
+
+func TestClientMultiplexing(t *testing.T) {
+	// 初始化服务端
+	server := NewServer()
+	server.RegisterService(&slowEchoServer{})
+	addr := startServer(t, server, "127.0.0.1:0")
 
 	// 初始化客户端
+	us := &slowEchoService{}
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	err = client.InitService(us)
+	require.NoError(t, err)
+	conn, err := client.getConn(context.Background(), addr)
+	require.NoError(t, err)
+
+	// Id 越大的请求处理得越快，响应是乱序返回的
+	const cnt = 50
+	var wg sync.WaitGroup
+	wg.Add(cnt)
+	for i := 0; i < cnt; i++ {
+		go func(id int) {
+			defer wg.Done()
+			resp, er := us.Echo(context.Background(), &GetByIdReq{Id: id})
+			assert.NoError(t, er)
+			assert.Equal(t, &GetByIdResp{Msg: fmt.Sprint(id)}, resp)
+		}(i)
+	}
+	wg.Wait()
+
+	// 所有的调用复用同一个连接
+	current, err := client.getConn(context.Background(), addr)
+	require.NoError(t, err)
+	assert.Same(t, conn, current)
+}
+
+func TestClientGetConn(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&UserServiceServer{})
+	addr := startServer(t, server, "127.0.0.1:0")
+	var accepted atomic.Int32
+	silent := startSilentListener(t, &accepted)
+
+	// 使用注册中心的时候不会提前建立连接
+	r := memory.NewRegistry()
+	defer func() {
+		_ = r.Close()
+	}()
+	client, err := NewClient("", ClientWithRegistry(r))
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+
+	// 等待协商的调用方按照自己的超时时间返回，同一个地址只会拨号一次
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, er := client.getConn(ctx, silent)
+			assert.Equal(t, context.DeadlineExceeded, er)
+		}()
+	}
+	wg.Wait()
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, int32(1), accepted.Load())
+
+	// 还在和 silent 协商的时候，其它实例的连接不受影响
+	start = time.Now()
+	_, err = client.getConn(context.Background(), addr)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestClientConnDrain(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&slowEchoServer{})
+	addr := startServer(t, server, "127.0.0.1:0")
+	us := &slowEchoService{}
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	require.NoError(t, client.InitService(us))
+	cc, err := client.getConn(context.Background(), addr)
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, er := us.Echo(context.Background(), &GetByIdReq{Id: 0})
+		done <- er
+	}()
+	require.Eventually(t, func() bool {
+		cc.lock.Lock()
+		defer cc.lock.Unlock()
+		return len(cc.pending) == 1
+	}, time.Second, time.Millisecond)
+
+	// 正在进行的调用结束之后才关闭
+	cc.drain()
+	assert.False(t, cc.isClosed())
+	assert.NoError(t, <-done)
+	assert.Eventually(t, cc.isClosed, time.Second, time.Millisecond)
+}
+
+// startSilentListener 接受连接但是从来不响应，连接的个数记录在 accepted 里面
+func startSilentListener(t *testing.T, accepted *atomic.Int32) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var lock sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		_ = listener.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, er := listener.Accept()
+			if er != nil {
+				return
+			}
+			accepted.Add(1)
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+type slowEchoService struct {
+	Echo func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+}
+
+func (s *slowEchoService) Name() string {
+	return "slow-echo"
+}
+
+type slowEchoServer struct {
+}
+
+func (s *slowEchoServer) Echo(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	time.Sleep(time.Millisecond * time.Duration(100-req.Id))
+	return &GetByIdResp{Msg: fmt.Sprint(req.Id)}, nil
+}
+
+func (s *slowEchoServer) Name() string {
+	return "slow-echo"
+}
+
+func TestInitClientCompress(t *testing.T) {
+	// 初始化服务端，只注册了 gzip
+	server := NewServer()
+	service := &UserServiceServer{Msg: strings.Repeat("hello, world", 100)}
+	server.RegisterService(service)
+	server.RegisterCompressor(&gzip.Compressor{})
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	testCases := []struct {
+		name       string
+		compressor compress.Compressor
+
+		wantErr  error
+		wantResp *GetByIdResp
+	}{
+		{
+			name:       "gzip",
+			compressor: &gzip.Compressor{},
+			wantResp:   &GetByIdResp{Msg: service.Msg},
+		},
+		{
+			name:       "unsupported compressor",
+			compressor: &snappy.Compressor{},
+			wantErr:    errUnsupportedCompressor,
+			wantResp:   &GetByIdResp{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			us := &UserService{}
+			client, err := NewClient(addr, ClientWithCompressor(tc.compressor))
+			require.NoError(t, err)
+			defer func() {
+				_ = client.Close()
+			}()
+			err = client.InitService(us)
+			require.NoError(t, err)
+
+			resp, er := us.GetById(context.Background(), &GetByIdReq{Id: 123})
+			assert.Equal(t, tc.wantErr, er)
+			assert.Equal(t, tc.wantResp, resp)
+		})
+	}
+
+	// 压缩之后的响应没有超过上限，解压之后超过了
+	us := &UserService{}
+	client, err := NewClient(addr, ClientWithCompressor(&gzip.Compressor{}), ClientWithMaxFrameSize(512))
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	require.NoError(t, client.InitService(us))
+	_, err = us.GetById(context.Background(), &GetByIdReq{Id: 123})
+	assert.Equal(t, status.ResourceExhausted, status.CodeOf(err))
+}
+
+func TestInitClientRegistry(t *testing.T) {
+	r := memory.NewRegistry()
+	defer func() {
+		_ = r.Close()
+	}()
+
+	// 两个实例返回不同的数据，用来区分请求被发到了哪个实例
+	server1 := NewServer(ServerWithRegistry(r))
+	server1.RegisterService(&UserServiceServer{Msg: "server1"})
+	addr1 := startServer(t, server1, "127.0.0.1:0")
+	_, port, err := net.SplitHostPort(freeAddr(t))
+	require.NoError(t, err)
+	server2 := NewServer(ServerWithRegistry(r), ServerWithAdvertiseAddr("localhost:"+port))
+	server2.RegisterService(&UserServiceServer{Msg: "server2"})
+	_ = startServer(t, server2, ":"+port)
+
+	instances, err := r.ListServices(context.Background(), "user-service")
+	require.NoError(t, err)
+	require.Len(t, instances, 2)
+
+	us := &UserService{}
+	client, err := NewClient("", ClientWithRegistry(r))
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	err = client.InitService(us)
+	require.NoError(t, err)
+
+	msgs := make(map[string]int, 2)
+	for i := 0; i < 50; i++ {
+		resp, er := us.GetById(context.Background(), &GetByIdReq{Id: i})
+		require.NoError(t, er)
+		msgs[resp.Msg]++
+	}
+	assert.Len(t, msgs, 2)
+	client.lock.Lock()
+	cc1 := client.conns[addr1]
+	client.lock.Unlock()
+	require.NotNil(t, cc1)
+
+	// 关闭之后 server1 从注册中心注销，客户端不会再把请求发给它，连接也被关闭
+	require.NoError(t, server1.Close())
+	time.Sleep(time.Millisecond * 100)
+	for i := 0; i < 10; i++ {
+		resp, er := us.GetById(context.Background(), &GetByIdReq{Id: i})
+		require.NoError(t, er)
+		assert.Equal(t, "server2", resp.Msg)
+	}
+	assert.True(t, cc1.isClosed())
+	client.lock.Lock()
+	assert.NotContains(t, client.conns, addr1)
+	client.lock.Unlock()
+
+	// 所有实例都下线了
+	require.NoError(t, server2.Close())
+	time.Sleep(time.Millisecond * 100)
+	_, err = us.GetById(context.Background(), &GetByIdReq{Id: 1})
+	assert.Equal(t, loadbalance.ErrNoAvailableInstance, err)
+}
+
+func TestClientCloseUnsubscribe(t *testing.T) {
+	r := &subscribeRegistry{Registry: memory.NewRegistry()}
+	defer func() {
+		_ = r.Close()
+	}()
+	server := NewServer(ServerWithRegistry(r))
+	server.RegisterService(&UserServiceServer{Msg: "server"})
+	_ = startServer(t, server, "127.0.0.1:0")
+
+	us := &UserService{}
+	client, err := NewClient("", ClientWithRegistry(r))
+	require.NoError(t, err)
+	require.NoError(t, client.InitService(us))
+	_, err = us.GetById(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	require.Len(t, r.events, 1)
+
+	// 客户端关闭之后订阅被取消，channel 被注册中心关闭
+	require.NoError(t, client.Close())
+	select {
+	case _, ok := <-r.events[0]:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("订阅没有被取消")
+	}
+}
+
+// subscribeRegistry 记录客户端订阅拿到的 channel
+type subscribeRegistry struct {
+	registry.Registry
+	events []<-chan registry.Event
+}
+
+func (r *subscribeRegistry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	ch, err := r.Registry.Subscribe(ctx, serviceName)
+	if err == nil {
+		r.events = append(r.events, ch)
+	}
+	return ch, err
+}
+
+func TestInitClientBalancer(t *testing.T) {
+	r := memory.NewRegistry()
+	defer func() {
+		_ = r.Close()
+	}()
+
+	server1 := NewServer(ServerWithRegistry(r), ServerWithWeight(3))
+	server1.RegisterService(&UserServiceServer{Msg: "server1"})
+	_ = startServer(t, server1, "127.0.0.1:0")
+	// 一个还没有启动的实例，健康检查通过之前不会被选中
+	addr2 := freeAddr(t)
+	err := r.Register(context.Background(), registry.ServiceInstance{
+		Name:    "user-service",
+		Address: addr2,
+		Weight:  1,
+	})
+	require.NoError(t, err)
+
 	us := &UserService{}
-	client, err := NewClient("localhost:8081")
+	client, err := NewClient("", ClientWithRegistry(r),
+		ClientWithBalancer(&weighted.Builder{}),
+		ClientWithHealthCheck(time.Millisecond*100, time.Millisecond*50))
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	err = client.InitService(us)
+	require.NoError(t, err)
+
+	// 一轮加权轮询里面有一次选到 addr2，连不上之后它会被摘掉
+	failed := 0
+	for i := 0; i < 4; i++ {
+		if _, er := us.GetById(context.Background(), &GetByIdReq{Id: i}); er != nil {
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+	for i := 0; i < 10; i++ {
+		resp, er := us.GetById(context.Background(), &GetByIdReq{Id: i})
+		require.NoError(t, er)
+		assert.Equal(t, "server1", resp.Msg)
+	}
+
+	// 实例恢复之后重新加回来，按照 3:1 的权重分配请求
+	server2 := NewServer()
+	server2.RegisterService(&UserServiceServer{Msg: "server2"})
+	_ = startServer(t, server2, addr2)
+	time.Sleep(time.Millisecond * 500)
+	msgs := make(map[string]int, 2)
+	for i := 0; i < 40; i++ {
+		resp, er := us.GetById(context.Background(), &GetByIdReq{Id: i})
+		require.NoError(t, er)
+		msgs[resp.Msg]++
+	}
+	assert.Equal(t, map[string]int{"server1": 30, "server2": 10}, msgs)
+}
+
+// freeAddr 返回一个当前没有被占用的本地地址
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	return addr
+}
+
+func TestInitClientTimeout(t *testing.T) {
+	server := NewServer()
+	service := &blockingServer{deadlines: make(chan time.Duration, 1)}
+	server.RegisterService(service)
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	us := &blockingService{}
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	err = client.InitService(us)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	start := time.Now()
+	_, err = us.Block(ctx, &GetByIdReq{Id: 1})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// 服务端的业务方法拿到了客户端剩下的超时时间
+	select {
+	case remaining := <-service.deadlines:
+		assert.True(t, remaining > 0 && remaining <= time.Millisecond*200)
+	case <-time.After(time.Second):
+		t.Fatal("服务端没有感知到超时")
+	}
+}
+
+type blockingService struct {
+	Block func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+}
+
+func (s *blockingService) Name() string {
+	return "blocking"
+}
+
+// blockingServer 一直阻塞到 ctx 过期
+type blockingServer struct {
+	deadlines chan time.Duration
+}
+
+func (s *blockingServer) Block(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil, errors.New("没有超时时间")
+	}
+	remaining := time.Until(deadline)
+	<-ctx.Done()
+	s.deadlines <- remaining
+	return nil, ctx.Err()
+}
+
+func (s *blockingServer) Name() string {
+	return "blocking"
+}
+
+func TestInitClientMetadata(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&metaEchoServer{})
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	us := &metaEchoService{}
+	client, err := NewClient(addr)
 	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
 	err = client.InitService(us)
 	require.NoError(t, err)
 
+	timeoutCtx, cancel := context.WithTimeout(
+		metadata.NewOutgoingContext(context.Background(), metadata.Pairs("request-id", "abc")), time.Second)
+	defer cancel()
 	testCases := []struct {
 		name string
-		mock func()
+		ctx  context.Context
 
-		wantErr  error
 		wantResp *GetByIdResp
+		wantCode status.Code
 	}{
 		{
-			name: "oneway",
-			mock: func() {
-				service.Err = errors.New("mock error")
-				service.Msg = "hello, world"
-			},
+			name:     "no metadata",
+			ctx:      context.Background(),
 			wantResp: &GetByIdResp{},
-			wantErr:  errors.New("micro: 这是一个 oneway 调用，你不应该处理任何结果"),
+		},
+		{
+			name: "metadata",
+			ctx: metadata.AppendToOutgoingContext(
+				metadata.NewOutgoingContext(context.Background(), metadata.Pairs("request-id", "abc")),
+				"tenant-id", "t1"),
+			wantResp: &GetByIdResp{Msg: "abc t1"},
+		},
+		{
+			// 业务方法看不到框架自己的超时时间
+			name:     "timeout",
+			ctx:      timeoutCtx,
+			wantResp: &GetByIdResp{Msg: "abc "},
+		},
+		{
+			// 不能冒充框架的 oneway 标记
+			name:     "reserved key",
+			ctx:      metadata.NewOutgoingContext(context.Background(), metadata.Pairs("micro-one-way", "true")),
+			wantResp: &GetByIdResp{},
+			wantCode: status.InvalidArgument,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			tc.mock()
-			resp, er := us.GetById(CtxWithOneWay(context.Background()), &GetByIdReq{Id: 123})
-			//resp, er := us.GetById(context.Background(), &GetByIdReq{Id: 123})
-			assert.Equal(t, tc.wantErr, er)
+			resp, er := us.Echo(tc.ctx, &GetByIdReq{Id: 1})
+			assert.Equal(t, tc.wantCode, status.CodeOf(er))
+			assert.Equal(t, tc.wantResp, resp)
+		})
+	}
+}
+
+type metaEchoService struct {
+	Echo func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+}
+
+func (s *metaEchoService) Name() string {
+	return "meta-echo"
+}
+
+// metaEchoServer 把收到的元数据返回给客户端
+type metaEchoServer struct {
+}
+
+func (s *metaEchoServer) Echo(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return &GetByIdResp{}, nil
+	}
+	for key := range md {
+		if metadata.IsReserved(key) {
+			return nil, status.Errorf(status.Internal, "收到了框架的元数据 %s", key)
+		}
+	}
+	return &GetByIdResp{Msg: md.Get("request-id") + " " + md.Get("tenant-id")}, nil
+}
+
+func (s *metaEchoServer) Name() string {
+	return "meta-echo"
+}
+
+func TestInitClientProtocolVersion(t *testing.T) {
+	server := NewServer()
+	server.RegisterService(&metaEchoServer{})
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	testCases := []struct {
+		name     string
+		version  uint8
+		tenantId string
+
+		wantResp *GetByIdResp
+		wantCode status.Code
+	}{
+		{
+			// Version1 的字段原样传递，和旧版本的服务端看到的一样
+			name:     "version1",
+			version:  message.Version1,
+			tenantId: "C:\\new",
+			wantResp: &GetByIdResp{Msg: "a\\b C:\\new"},
+		},
+		{
+			// Version1 没法传递分隔符，请求不会发出去
+			name:     "version1 separators",
+			version:  message.Version1,
+			tenantId: "\x00\r\x01",
+			wantCode: status.InvalidArgument,
+		},
+		{
+			name:     "version2",
+			version:  message.Version2,
+			tenantId: "\x00\r\x01",
+			wantResp: &GetByIdResp{Msg: "a\\b \x00\r\x01"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClient(addr, ClientWithProtocolVersion(tc.version))
+			require.NoError(t, err)
+			defer func() {
+				_ = client.Close()
+			}()
+			us := &metaEchoService{}
+			require.NoError(t, client.InitService(us))
+
+			ctx := metadata.NewOutgoingContext(context.Background(),
+				metadata.Pairs("request-id", "a\\b", "tenant-id", tc.tenantId))
+			resp, err := us.Echo(ctx, &GetByIdReq{Id: 1})
+			if tc.wantCode != status.OK {
+				assert.Equal(t, tc.wantCode, status.CodeOf(err))
+				assert.ErrorContains(t, err, "请使用 Version2")
+				return
+			}
+			require.NoError(t, err)
 			assert.Equal(t, tc.wantResp, resp)
 		})
 	}
+}
+
+func TestInitClientVersionNegotiation(t *testing.T) {
+	testCases := []struct {
+		name           string
+		serverVersions []uint8
+		clientVersion  uint8
+
+		wantVersions []uint8
+		wantCode     status.Code
+		wantDetails  []status.Detail
+	}{
+		{
+			name:           "same version",
+			serverVersions: []uint8{message.Version1, message.Version2},
+			clientVersion:  message.Version2,
+			wantVersions:   []uint8{message.Version2, message.Version2},
+		},
+		{
+			// 第一次调用被拒绝之后降级重试，之后的调用直接使用降级之后的版本
+			name:           "downgrade",
+			serverVersions: []uint8{message.Version1},
+			clientVersion:  message.Version2,
+			wantVersions:   []uint8{message.Version1, message.Version1},
+		},
+		{
+			// 服务端配置了没有实现的版本，协商的时候不会告诉客户端
+			name:           "unimplemented server version",
+			serverVersions: []uint8{message.Version1, message.Version2, message.LatestVersion + 1},
+			clientVersion:  message.LatestVersion + 1,
+			wantVersions:   []uint8{message.Version2, message.Version2},
+		},
+		{
+			name:           "no common version",
+			serverVersions: []uint8{message.Version2},
+			clientVersion:  message.Version1,
+			wantCode:       status.Unimplemented,
+			wantDetails: []status.Detail{
+				{Type: detailSupportedVersions, Value: []byte{message.Version2}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var lock sync.Mutex
+			var versions []uint8
+			server := NewServer(ServerWithProtocolVersions(tc.serverVersions...),
+				ServerWithInterceptors(func(ctx context.Context, req *message.Request, next Handler) (*message.Response, error) {
+					lock.Lock()
+					versions = append(versions, req.Version)
+					lock.Unlock()
+					return next(ctx, req)
+				}))
+			server.RegisterService(&UserServiceServer{})
+			addr := startServer(t, server, "127.0.0.1:0")
+
+			client, err := NewClient(addr, ClientWithProtocolVersion(tc.clientVersion))
+			require.NoError(t, err)
+			defer func() {
+				_ = client.Close()
+			}()
+			us := &UserService{}
+			require.NoError(t, client.InitService(us))
+
+			for i := 0; i < 2; i++ {
+				_, err = us.GetById(context.Background(), &GetByIdReq{Id: 1})
+				if tc.wantCode != status.OK {
+					assert.Equal(t, tc.wantCode, status.CodeOf(err))
+					e, ok := status.FromError(err)
+					require.True(t, ok)
+					assert.Equal(t, tc.wantDetails, e.Details)
+					continue
+				}
+				require.NoError(t, err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			assert.Equal(t, tc.wantVersions, versions)
+		})
+	}
+}
+
+func TestInitClientLegacyServer(t *testing.T) {
+	addr := startLegacyServer(t)
+	// 默认使用最高的版本，协商之后降级到 Version1
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	us := &UserService{}
+	require.NoError(t, client.InitService(us))
+
+	for i := 0; i < 2; i++ {
+		resp, er := us.GetById(context.Background(), &GetByIdReq{Id: 1})
+		require.NoError(t, er)
+		assert.Equal(t, &GetByIdResp{Msg: "legacy"}, resp)
+	}
+}
+
+// startLegacyServer 模拟引入协议版本之前的服务端，只认识 Version1
+// 收到其它版本的请求的时候解析失败，直接断开连接
+func startLegacyServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, er := listener.Accept()
+			if er != nil {
+				return
+			}
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+				for {
+					data, e := ReadMsg(conn)
+					if e != nil || data[12] != message.Version1 {
+						return
+					}
+					req, e := message.DecodeReq(data)
+					if e != nil {
+						return
+					}
+					resp := &message.Response{
+						MessageId:  req.MessageId,
+						Version:    req.Version,
+						Serializer: req.Serializer,
+					}
+					if req.ServiceName == "user-service" {
+						resp.Data = []byte(`{"Msg":"legacy"}`)
+					} else {
+						resp.Error = []byte("你要调用的服务不存在")
+					}
+					resp.SetHeadLength()
+					resp.SetBodyLength()
+					if _, e = conn.Write(message.EncodeResp(resp)); e != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestInitClientStatus(t *testing.T) {
+	server := NewServer()
+	service := &UserServiceServer{}
+	server.RegisterService(service)
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+
+	testCases := []struct {
+		name    string
+		service Service
+		mock    func()
+
+		wantCode    status.Code
+		wantMsg     string
+		wantDetails []status.Detail
+	}{
+		{
+			name:     "service not found",
+			service:  &slowEchoService{},
+			wantCode: status.NotFound,
+			wantMsg:  "你要调用的服务不存在",
+		},
+		{
+			name:    "business status",
+			service: &UserService{},
+			mock: func() {
+				service.Err = status.New(status.PermissionDenied, "没有权限").
+					WithDetails(status.Detail{Type: "user", Value: []byte("123")})
+			},
+			wantCode:    status.PermissionDenied,
+			wantMsg:     "没有权限",
+			wantDetails: []status.Detail{{Type: "user", Value: []byte("123")}},
+		},
+		{
+			name:    "business error",
+			service: &UserService{},
+			mock: func() {
+				service.Err = errors.New("error")
+			},
+			wantCode: status.Unknown,
+			wantMsg:  "error",
+		},
+	}
 
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.mock != nil {
+				tc.mock()
+			}
+			require.NoError(t, client.InitService(tc.service))
+			var er error
+			switch svc := tc.service.(type) {
+			case *UserService:
+				_, er = svc.GetById(context.Background(), &GetByIdReq{Id: 1})
+			case *slowEchoService:
+				_, er = svc.Echo(context.Background(), &GetByIdReq{Id: 1})
+			}
+			var se *status.Error
+			require.True(t, errors.As(er, &se))
+			assert.Equal(t, tc.wantCode, se.Code)
+			assert.Equal(t, tc.wantMsg, se.Message)
+			assert.Equal(t, tc.wantDetails, se.Details)
+			assert.Equal(t, tc.wantCode, status.CodeOf(er))
+		})
+	}
 }
@@ -36,6 +36,34 @@ func TestSetStructFunc(t *testing.T) {
 			},
 			wantErr: errors.New("rpc: 只支持指向结构体的一级指针"),
 		},
+		{
+			// 所有签名不对的字段一起报告，其它类型的字段和没有导出的字段不检查
+			name:    "bad signatures",
+			service: &badUserService{},
+			mock: func(ctrl *gomock.Controller) Proxy {
+				return NewMockProxy(ctrl)
+			},
+			wantErr: errors.Join(
+				errors.New("rpc: bad-user-service 的字段 NoCtx 的类型 func(*rpc.GetByIdReq) (*rpc.GetByIdResp, error) 不支持，"+
+					"只支持 func(context.Context, *Req) (*Resp, error) 和 func(context.Context) (*rpc.Stream[Req, Resp], error)"),
+				errors.New("rpc: bad-user-service 的字段 NotPtr 的类型 func(context.Context, rpc.GetByIdReq) (*rpc.GetByIdResp, error) 不支持，"+
+					"只支持 func(context.Context, *Req) (*Resp, error) 和 func(context.Context) (*rpc.Stream[Req, Resp], error)"),
+				errors.New("rpc: bad-user-service 的字段 NoErr 的类型 func(context.Context, *rpc.GetByIdReq) *rpc.GetByIdResp 不支持，"+
+					"只支持 func(context.Context, *Req) (*Resp, error) 和 func(context.Context) (*rpc.Stream[Req, Resp], error)"),
+				errors.New("rpc: Stream 是流式调用，但是 Proxy 不支持流"),
+			),
+		},
+		{
+			name:    "bad tags",
+			service: &badTagService{},
+			mock: func(ctrl *gomock.Controller) Proxy {
+				return &Client{}
+			},
+			wantErr: errors.Join(
+				errors.New(`rpc: Typo 的标签 rpc:"one-way" 中有不支持的选项 "one-way"`),
+				errors.New("rpc: Stream 是流式调用，不支持 rpc 标签"),
+			),
+		},
 		{
 			name:    "ok",
 			service: &UserService{},
@@ -43,6 +71,7 @@ func TestSetStructFunc(t *testing.T) {
 				proxy := NewMockProxy(ctrl)
 				data, _ := s.Encode(&GetByIdReq{Id: 1})
 				proxy.EXPECT().Invoke(gomock.Any(), &message.Request{
+					Serializer:  s.Code(),
 					ServiceName: "user-service",
 					MethodName:  "GetById",
 					Data:        data,
@@ -72,3 +101,26 @@ func TestSetStructFunc(t *testing.T) {
 		})
 	}
 }
+
+type badUserService struct {
+	GetById func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	NoCtx   func(req *GetByIdReq) (*GetByIdResp, error)
+	NotPtr  func(ctx context.Context, req GetByIdReq) (*GetByIdResp, error)
+	NoErr   func(ctx context.Context, req *GetByIdReq) *GetByIdResp
+	Stream  func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error)
+	Timeout int
+	hook    func()
+}
+
+func (s *badUserService) Name() string {
+	return "bad-user-service"
+}
+
+type badTagService struct {
+	Typo   func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)    `rpc:"one-way"`
+	Stream func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error) `rpc:"oneway"`
+}
+
+func (s *badTagService) Name() string {
+	return "bad-tag-service"
+}
@@ -0,0 +1,58 @@
+package compress_test
+
+import (
+	"bytes"
+	"geek_micro/rpc/compress"
+	"geek_micro/rpc/compress/flate"
+	"geek_micro/rpc/compress/gzip"
+	"geek_micro/rpc/compress/snappy"
+	"geek_micro/rpc/compress/zlib"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressor(t *testing.T) {
+	testCases := []struct {
+		name string
+		c    compress.Compressor
+	}{
+		{
+			name: "gzip",
+			c:    &gzip.Compressor{},
+		},
+		{
+			name: "zlib",
+			c:    &zlib.Compressor{},
+		},
+		{
+			name: "flate",
+			c:    &flate.Compressor{},
+		},
+		{
+			name: "snappy",
+			c:    &snappy.Compressor{},
+		},
+	}
+
+	data := bytes.Repeat([]byte(`{"Msg":"hello, world"}`), 100)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.NotEqual(t, byte(0), tc.c.Code())
+			compressed, err := tc.c.Compress(data)
+			require.NoError(t, err)
+			assert.Less(t, len(compressed), len(data))
+			res, err := tc.c.Decompress(compressed, len(data))
+			require.NoError(t, err)
+			assert.Equal(t, data, res)
+
+			// 解压之后超过了上限
+			_, err = tc.c.Decompress(compressed, len(data)-1)
+			assert.ErrorIs(t, err, compress.ErrTooLarge)
+
+			_, err = tc.c.Decompress([]byte("not compressed"), len(data))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package flate
+
+import (
+	"bytes"
+	"compress/flate"
+	"geek_micro/rpc/compress"
+)
+
+// Compressor 不带任何头部的 deflate 数据
+type Compressor struct {
+}
+
+func (c *Compressor) Code() byte {
+	return 3
+}
+
+func (c *Compressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Compressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer func() {
+		_ = r.Close()
+	}()
+	return compress.ReadAll(r, maxSize)
+}
@@ -0,0 +1,32 @@
+package snappy
+
+import (
+	"fmt"
+	"geek_micro/rpc/compress"
+
+	"github.com/golang/snappy"
+)
+
+// Compressor 压缩率不如 gzip，但是速度快得多，适合对延迟敏感的场景
+type Compressor struct {
+}
+
+func (c *Compressor) Code() byte {
+	return 4
+}
+
+func (c *Compressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (c *Compressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	// 解压之前按照数据里面记录的长度分配内存，先检查长度
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, fmt.Errorf("%w: %d 字节超过了 %d 字节", compress.ErrTooLarge, n, maxSize)
+	}
+	return snappy.Decode(nil, data)
+}
@@ -0,0 +1,32 @@
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrTooLarge 解压之后的数据超过了 Decompress 传入的上限
+var ErrTooLarge = errors.New("micro: 解压之后的数据太大")
+
+// Compressor 压缩算法，Code 会被写入协议头部的 Compresser 字段
+// 0 表示不压缩，所以实现不能使用 0 作为 Code
+type Compressor interface {
+	Code() byte
+	Compress(data []byte) ([]byte, error)
+	// Decompress 解压之后的数据超过 maxSize 字节的时候返回 ErrTooLarge
+	// 很小的压缩数据可以解压出非常大的数据，实现不能在检查长度之前分配内存
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+// ReadAll 读出 r 里面的全部数据，超过 maxSize 字节的时候返回 ErrTooLarge
+func ReadAll(r io.Reader, maxSize int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%w: 超过了 %d 字节", ErrTooLarge, maxSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,38 @@
+package zlib
+
+import (
+	"bytes"
+	"compress/zlib"
+	"geek_micro/rpc/compress"
+)
+
+type Compressor struct {
+}
+
+func (c *Compressor) Code() byte {
+	return 2
+}
+
+func (c *Compressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := zlib.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	// Close 的时候才会把剩余数据和校验信息写进去
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Compressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return compress.ReadAll(r, maxSize)
+}
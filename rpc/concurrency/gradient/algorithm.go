@@ -0,0 +1,82 @@
+package gradient
+
+import (
+	"math"
+	"time"
+)
+
+// Algorithm 梯度算法，比较短期延迟和长期延迟的比值（梯度）
+// 短期延迟升高说明开始排队了，按照梯度缩小上限，再加上 sqrt(limit) 的余量继续探测
+type Algorithm struct {
+	// 初始的上限，默认是 20
+	InitialLimit int
+	// 上限的最大值，默认是 1000
+	MaxLimit int
+	// 短期延迟不超过长期延迟的 Tolerance 倍的时候不降低上限，默认是 1.5
+	Tolerance float64
+	// 长期延迟是最近多少个请求的指数移动平均，默认是 600
+	LongWindow int
+
+	limit float64
+	// 长期延迟，单位是纳秒
+	longRtt float64
+	samples int
+}
+
+// 新的上限在旧的上限上面只占这个比例，避免抖动
+const smoothing = 0.2
+
+// 前面这些请求的延迟直接取平均值作为长期延迟
+const warmup = 10
+
+func (a *Algorithm) Limit() int {
+	a.init()
+	return int(a.limit)
+}
+
+func (a *Algorithm) Update(rtt time.Duration, inflight int, dropped bool) int {
+	a.init()
+	shortRtt := float64(rtt)
+	a.samples++
+	if a.samples <= warmup {
+		a.longRtt += (shortRtt - a.longRtt) / float64(a.samples)
+	} else {
+		a.longRtt += (shortRtt - a.longRtt) / float64(a.LongWindow)
+	}
+	// 负载降下来之后让长期延迟更快地恢复
+	if a.longRtt/shortRtt > 2 {
+		a.longRtt *= 0.95
+	}
+
+	switch {
+	case dropped:
+		a.limit *= 0.9
+	case float64(inflight)*2 < a.limit:
+		// 请求不多的时候延迟说明不了上限够不够
+	default:
+		gradient := math.Max(0.5, math.Min(1, a.Tolerance*a.longRtt/shortRtt))
+		newLimit := a.limit*gradient + math.Sqrt(a.limit)
+		a.limit = a.limit*(1-smoothing) + newLimit*smoothing
+	}
+	a.limit = math.Min(math.Max(a.limit, 1), float64(a.MaxLimit))
+	return int(a.limit)
+}
+
+func (a *Algorithm) init() {
+	if a.limit != 0 {
+		return
+	}
+	if a.InitialLimit <= 0 {
+		a.InitialLimit = 20
+	}
+	if a.MaxLimit <= 0 {
+		a.MaxLimit = 1000
+	}
+	if a.Tolerance < 1 {
+		a.Tolerance = 1.5
+	}
+	if a.LongWindow <= 0 {
+		a.LongWindow = 600
+	}
+	a.limit = float64(min(a.InitialLimit, a.MaxLimit))
+}
@@ -0,0 +1,110 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"geek_micro/rpc"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded 正在处理的请求达到了上限，请求在调用业务方法之前就被丢弃，见 rpc.ErrOverloaded
+var ErrOverloaded = rpc.ErrOverloaded
+
+// Algorithm 根据请求的延迟调整允许同时处理的请求个数
+// 不需要并发安全，Limiter 会保证同一时间只有一个调用
+type Algorithm interface {
+	// Limit 返回当前的上限
+	Limit() int
+	// Update 记录一个请求的结果并返回新的上限
+	// inflight 是这个请求开始的时候正在处理的请求个数（包括它自己），dropped 表示请求超时了
+	Update(rtt time.Duration, inflight int, dropped bool) int
+}
+
+// Limiter 限制同时处理的请求个数，上限由 Algorithm 动态调整
+type Limiter struct {
+	lock      sync.Mutex
+	algorithm Algorithm
+	limit     int
+	inflight  int
+}
+
+func NewLimiter(algorithm Algorithm) *Limiter {
+	return &Limiter{
+		algorithm: algorithm,
+		limit:     max(algorithm.Limit(), 1),
+	}
+}
+
+// Acquire 没有达到上限的时候返回 true，处理完之后必须调用 release
+func (l *Limiter) Acquire() (release func(dropped bool), ok bool) {
+	l.lock.Lock()
+	if l.inflight >= l.limit {
+		l.lock.Unlock()
+		return nil, false
+	}
+	l.inflight++
+	inflight := l.inflight
+	l.lock.Unlock()
+
+	start := time.Now()
+	return func(dropped bool) {
+		rtt := time.Since(start)
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		l.inflight--
+		l.limit = max(l.algorithm.Update(rtt, inflight, dropped), 1)
+	}, true
+}
+
+// Limit 返回当前的上限
+func (l *Limiter) Limit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limit
+}
+
+// Inflight 返回正在处理的请求个数
+func (l *Limiter) Inflight() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.inflight
+}
+
+// overloaded 正在处理的请求是不是已经达到了上限
+func (l *Limiter) overloaded() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.inflight >= l.limit
+}
+
+// Interceptor 返回服务端拦截器，超过上限的请求直接返回 ErrOverloaded
+// 拦截器执行的时候请求已经解压并且有了自己的 goroutine，过载的时候优先使用 rpc.ServerWithConcurrencyLimiter
+// 两者不要使用同一个 Limiter，否则一个请求会占用两个名额
+func Interceptor(l *Limiter) rpc.ServerInterceptor {
+	return func(ctx context.Context, req *message.Request, next rpc.Handler) (resp *message.Response, err error) {
+		release, ok := l.Acquire()
+		if !ok {
+			return nil, ErrOverloaded
+		}
+		// 业务方法 panic 的时候也要把名额还回去
+		defer func() {
+			// 超时的请求说明延迟已经超出了客户端能接受的范围
+			release(errors.Is(ctx.Err(), context.DeadlineExceeded) || status.CodeOf(err) == status.DeadlineExceeded)
+		}()
+		return next(ctx, req)
+	}
+}
+
+// StreamInterceptor 返回流的服务端拦截器，正在处理的请求达到上限的时候拒绝打开新的流，返回 ErrOverloaded
+// 流的持续时间不是请求的延迟，所以流不占用名额，也不交给 Algorithm 统计
+func StreamInterceptor(l *Limiter) rpc.StreamServerInterceptor {
+	return func(ctx context.Context, req *message.Request, next rpc.StreamHandler) error {
+		if l.overloaded() {
+			return ErrOverloaded
+		}
+		return next(ctx, req)
+	}
+}
@@ -0,0 +1,363 @@
+package concurrency_test
+
+import (
+	"context"
+	"geek_micro/rpc"
+	"geek_micro/rpc/concurrency"
+	"geek_micro/rpc/concurrency/gradient"
+	"geek_micro/rpc/concurrency/vegas"
+	"geek_micro/rpc/internal/rpctest"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sample 是一个请求的结果
+type sample struct {
+	rtt      time.Duration
+	inflight int
+	dropped  bool
+
+	wantLimit int
+}
+
+func TestVegas(t *testing.T) {
+	ms := time.Millisecond
+	testCases := []struct {
+		name    string
+		alg     *vegas.Algorithm
+		samples []sample
+	}{
+		{
+			name: "no queue",
+			alg:  &vegas.Algorithm{InitialLimit: 10},
+			samples: []sample{
+				// 第一个请求只用来测量最小延迟
+				{rtt: 10 * ms, inflight: 10, wantLimit: 10},
+				{rtt: 10 * ms, inflight: 10, wantLimit: 11},
+				{rtt: 11 * ms, inflight: 11, wantLimit: 12},
+			},
+		},
+		{
+			name: "queueing",
+			alg:  &vegas.Algorithm{InitialLimit: 11},
+			samples: []sample{
+				{rtt: 10 * ms, inflight: 11, wantLimit: 11},
+				// 排队的请求在 alpha 和 beta 之间
+				{rtt: 20 * ms, inflight: 11, wantLimit: 11},
+				{rtt: 40 * ms, inflight: 11, wantLimit: 9},
+			},
+		},
+		{
+			name: "app limited",
+			alg:  &vegas.Algorithm{InitialLimit: 10},
+			samples: []sample{
+				{rtt: 10 * ms, inflight: 2, wantLimit: 10},
+				{rtt: 10 * ms, inflight: 2, wantLimit: 10},
+				{rtt: 100 * ms, inflight: 2, wantLimit: 10},
+			},
+		},
+		{
+			name: "dropped",
+			alg:  &vegas.Algorithm{InitialLimit: 2},
+			samples: []sample{
+				{rtt: 10 * ms, inflight: 1, wantLimit: 2},
+				{rtt: 10 * ms, inflight: 1, dropped: true, wantLimit: 1},
+				// 最小是 1
+				{rtt: 10 * ms, inflight: 1, dropped: true, wantLimit: 1},
+			},
+		},
+		{
+			name: "max limit",
+			alg:  &vegas.Algorithm{InitialLimit: 10, MaxLimit: 11},
+			samples: []sample{
+				{rtt: 10 * ms, inflight: 10, wantLimit: 10},
+				{rtt: 10 * ms, inflight: 10, wantLimit: 11},
+				{rtt: 10 * ms, inflight: 11, wantLimit: 11},
+			},
+		},
+		{
+			name: "probe",
+			alg:  &vegas.Algorithm{InitialLimit: 10, ProbeInterval: 3},
+			samples: []sample{
+				{rtt: 10 * ms, inflight: 10, wantLimit: 10},
+				{rtt: 20 * ms, inflight: 10, wantLimit: 10},
+				// 重新测量最小延迟之后 20ms 不再算排队
+				{rtt: 20 * ms, inflight: 10, wantLimit: 10},
+				{rtt: 20 * ms, inflight: 10, wantLimit: 11},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i, s := range tc.samples {
+				assert.Equal(t, s.wantLimit, tc.alg.Update(s.rtt, s.inflight, s.dropped), "第 %d 个请求", i)
+			}
+			assert.Equal(t, tc.samples[len(tc.samples)-1].wantLimit, tc.alg.Limit())
+		})
+	}
+}
+
+func TestGradient(t *testing.T) {
+	alg := &gradient.Algorithm{InitialLimit: 20}
+	assert.Equal(t, 20, alg.Limit())
+	// 延迟稳定的时候上限逐渐提高
+	for i := 0; i < 20; i++ {
+		alg.Update(time.Millisecond*10, alg.Limit(), false)
+	}
+	high := alg.Limit()
+	assert.Greater(t, high, 20)
+
+	// 请求不多的时候不调整
+	alg.Update(time.Millisecond*100, 1, false)
+	assert.Equal(t, high, alg.Limit())
+
+	// 延迟升高之后上限降低
+	for i := 0; i < 20; i++ {
+		alg.Update(time.Millisecond*40, alg.Limit(), false)
+	}
+	low := alg.Limit()
+	assert.Less(t, low, high)
+
+	alg.Update(time.Millisecond*40, low, true)
+	assert.Less(t, alg.Limit(), low)
+
+	alg = &gradient.Algorithm{InitialLimit: 20, MaxLimit: 10}
+	assert.Equal(t, 10, alg.Limit())
+}
+
+// fixed 是固定上限的算法，记录每个请求的结果
+type fixed struct {
+	limit   int
+	samples []sample
+}
+
+func (f *fixed) Limit() int {
+	return f.limit
+}
+
+func (f *fixed) Update(rtt time.Duration, inflight int, dropped bool) int {
+	f.samples = append(f.samples, sample{inflight: inflight, dropped: dropped})
+	return f.limit
+}
+
+func TestLimiter(t *testing.T) {
+	alg := &fixed{limit: 2}
+	l := concurrency.NewLimiter(alg)
+	release1, ok := l.Acquire()
+	require.True(t, ok)
+	release2, ok := l.Acquire()
+	require.True(t, ok)
+	_, ok = l.Acquire()
+	assert.False(t, ok)
+	assert.Equal(t, 2, l.Inflight())
+
+	release1(false)
+	release3, ok := l.Acquire()
+	require.True(t, ok)
+	release2(true)
+	release3(false)
+	assert.Equal(t, 0, l.Inflight())
+	assert.Equal(t, []sample{
+		{inflight: 1},
+		{inflight: 2, dropped: true},
+		{inflight: 2},
+	}, alg.samples)
+
+	// 上限降低之后正在处理的请求不受影响
+	alg.limit = 1
+	release1, _ = l.Acquire()
+	release2, _ = l.Acquire()
+	release1(false)
+	assert.Equal(t, 1, l.Limit())
+	_, ok = l.Acquire()
+	assert.False(t, ok)
+	release2(false)
+	_, ok = l.Acquire()
+	assert.True(t, ok)
+}
+
+func TestInterceptor(t *testing.T) {
+	testCases := []struct {
+		name string
+		ctx  rpctest.Context
+		err  error
+
+		wantDropped bool
+	}{
+		{
+			name: "success",
+			ctx:  rpctest.Ctx(context.Background()),
+		},
+		{
+			name: "business error",
+			ctx:  rpctest.Ctx(context.Background()),
+			err:  status.New(status.InvalidArgument, "bad"),
+		},
+		{
+			name:        "deadline exceeded",
+			ctx:         rpctest.Ctx(context.Background()),
+			err:         status.New(status.DeadlineExceeded, "timeout"),
+			wantDropped: true,
+		},
+		{
+			name:        "ctx expired",
+			ctx:         rpctest.Timeout(context.Background(), -time.Second),
+			wantDropped: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			alg := &fixed{limit: 1}
+			ctx, cancel := tc.ctx()
+			defer cancel()
+			interceptor := concurrency.Interceptor(concurrency.NewLimiter(alg))
+			_, err := interceptor(ctx, &message.Request{}, func(ctx context.Context, req *message.Request) (*message.Response, error) {
+				// 正在处理的时候达到了上限
+				_, er := interceptor(ctx, req, nil)
+				assert.Equal(t, concurrency.ErrOverloaded, er)
+				return &message.Response{}, tc.err
+			})
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, []sample{{inflight: 1, dropped: tc.wantDropped}}, alg.samples)
+		})
+	}
+}
+
+func TestInterceptorPanic(t *testing.T) {
+	alg := &fixed{limit: 1}
+	l := concurrency.NewLimiter(alg)
+	interceptor := concurrency.Interceptor(l)
+	assert.Panics(t, func() {
+		_, _ = interceptor(context.Background(), &message.Request{}, func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			panic("boom")
+		})
+	})
+	// panic 之后名额还回去了
+	assert.Equal(t, 0, l.Inflight())
+	assert.Equal(t, []sample{{inflight: 1}}, alg.samples)
+	_, err := interceptor(context.Background(), &message.Request{}, func(ctx context.Context, req *message.Request) (*message.Response, error) {
+		return &message.Response{}, nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	alg := &fixed{limit: 1}
+	l := concurrency.NewLimiter(alg)
+	interceptor := concurrency.StreamInterceptor(l)
+	opened := 0
+	next := func(ctx context.Context, req *message.Request) error {
+		opened++
+		// 流不占用名额
+		assert.Equal(t, 0, l.Inflight())
+		return nil
+	}
+	require.NoError(t, interceptor(context.Background(), &message.Request{}, next))
+
+	release, ok := l.Acquire()
+	require.True(t, ok)
+	assert.Equal(t, concurrency.ErrOverloaded, interceptor(context.Background(), &message.Request{}, next))
+	release(false)
+	assert.Equal(t, 1, opened)
+	// 流不会交给 Algorithm 统计
+	assert.Equal(t, []sample{{inflight: 1}}, alg.samples)
+}
+
+func TestInterceptorE2E(t *testing.T) {
+	// 第一个请求等到 release 关闭之后才返回
+	entered, release := make(chan struct{}), make(chan struct{})
+	l := concurrency.NewLimiter(&fixed{limit: 1})
+	server := rpc.NewServer(rpc.ServerWithInterceptors(concurrency.Interceptor(l)),
+		rpc.ServerWithStreamInterceptors(concurrency.StreamInterceptor(l)))
+	uc := rpctest.Start(t, server, &rpctest.UserServer{
+		OnGet: func(ctx context.Context, req *rpctest.Req) (*rpctest.Resp, error) {
+			select {
+			case entered <- struct{}{}:
+				<-release
+			default:
+			}
+			return &rpctest.Resp{}, nil
+		},
+	})
+
+	done := make(chan error)
+	go func() {
+		_, er := uc.Get(context.Background(), &rpctest.Req{})
+		done <- er
+	}()
+	<-entered
+	// 第一个请求还没有处理完，第二个直接被丢弃
+	_, err := uc.Get(context.Background(), &rpctest.Req{})
+	assert.Equal(t, status.Unavailable, status.CodeOf(err))
+	assert.True(t, status.IsOverloaded(err))
+	// 也不能打开新的流
+	stream, err := uc.Watch(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.True(t, status.IsOverloaded(err))
+	close(release)
+	assert.NoError(t, <-done)
+
+	stream, err = uc.Watch(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServerLimiterE2E(t *testing.T) {
+	// 第一个请求等到 release 关闭之后才返回
+	entered, release := make(chan struct{}), make(chan struct{})
+	var intercepted, created atomic.Int32
+	l := concurrency.NewLimiter(&fixed{limit: 1})
+	server := rpc.NewServer(rpc.ServerWithConcurrencyLimiter(l),
+		rpc.ServerWithInterceptors(func(ctx context.Context, req *message.Request, next rpc.Handler) (*message.Response, error) {
+			intercepted.Add(1)
+			return next(ctx, req)
+		}))
+	uc := rpctest.Start(t, server, &rpctest.UserServer{
+		OnGet: func(ctx context.Context, req *rpctest.Req) (*rpctest.Resp, error) {
+			select {
+			case entered <- struct{}{}:
+				<-release
+			default:
+			}
+			return &rpctest.Resp{}, nil
+		},
+		OnCreate: func(ctx context.Context, req *rpctest.Req) (*rpctest.Resp, error) {
+			created.Add(1)
+			return &rpctest.Resp{}, nil
+		},
+	})
+
+	done := make(chan error)
+	go func() {
+		_, er := uc.Get(context.Background(), &rpctest.Req{})
+		done <- er
+	}()
+	<-entered
+	// oneway 请求直接被丢弃
+	_, err := uc.Create(rpc.CtxWithOneWay(context.Background()), &rpctest.Req{})
+	require.NoError(t, err)
+	// 同一个连接上的请求按顺序读取，收到这个响应的时候 oneway 请求已经处理过了
+	_, err = uc.Get(context.Background(), &rpctest.Req{})
+	assert.True(t, status.IsOverloaded(err))
+	// 被丢弃的请求没有经过拦截器
+	assert.Equal(t, int32(1), intercepted.Load())
+	assert.Equal(t, int32(0), created.Load())
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Eventually(t, func() bool { return l.Inflight() == 0 }, time.Second, time.Millisecond)
+
+	_, err = uc.Get(context.Background(), &rpctest.Req{})
+	assert.NoError(t, err)
+	_, err = uc.Create(rpc.CtxWithOneWay(context.Background()), &rpctest.Req{})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return created.Load() == 1 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,75 @@
+package vegas
+
+import (
+	"math"
+	"time"
+)
+
+// Algorithm 借鉴 TCP Vegas 的并发上限算法
+// 用没有排队时候的最小延迟估计排队的请求个数 queue = limit * (1 - minRtt / rtt)，
+// 排队少的时候提高上限，排队多的时候降低上限
+type Algorithm struct {
+	// 初始的上限，默认是 20
+	InitialLimit int
+	// 上限的最大值，默认是 1000
+	MaxLimit int
+	// 每隔多少个请求重新测量一次最小延迟，避免一直使用很久以前的延迟，默认是 1000
+	ProbeInterval int
+
+	limit float64
+	// 没有排队的时候的延迟，为 0 表示需要重新测量
+	minRtt  time.Duration
+	samples int
+}
+
+func (a *Algorithm) Limit() int {
+	a.init()
+	return int(a.limit)
+}
+
+func (a *Algorithm) Update(rtt time.Duration, inflight int, dropped bool) int {
+	a.init()
+	a.samples++
+	if a.samples >= a.ProbeInterval {
+		a.samples = 0
+		a.minRtt = 0
+	}
+	if a.minRtt == 0 || rtt < a.minRtt {
+		a.minRtt = rtt
+		return int(a.limit)
+	}
+
+	// 上限越大，每次调整的幅度越大
+	step := math.Max(1, math.Log10(a.limit))
+	switch {
+	case dropped:
+		a.limit -= step
+	case float64(inflight)*2 < a.limit:
+		// 请求不多的时候延迟说明不了上限够不够
+	default:
+		queue := a.limit * (1 - float64(a.minRtt)/float64(rtt))
+		if queue < 3*step {
+			a.limit += step
+		} else if queue > 6*step {
+			a.limit -= step
+		}
+	}
+	a.limit = math.Min(math.Max(a.limit, 1), float64(a.MaxLimit))
+	return int(a.limit)
+}
+
+func (a *Algorithm) init() {
+	if a.limit != 0 {
+		return
+	}
+	if a.InitialLimit <= 0 {
+		a.InitialLimit = 20
+	}
+	if a.MaxLimit <= 0 {
+		a.MaxLimit = 1000
+	}
+	if a.ProbeInterval <= 0 {
+		a.ProbeInterval = 1000
+	}
+	a.limit = float64(min(a.InitialLimit, a.MaxLimit))
+}
@@ -0,0 +1,355 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"geek_micro/rpc/compress"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var errConnClosed = errors.New("micro: 连接已关闭")
+
+// clientConn 是可以被多个调用并发复用的连接
+// 每个请求使用不同的 MessageId，后台的 readLoop 会根据响应中的 MessageId
+// 把响应分发给对应的调用方，因此响应可以乱序返回
+type clientConn struct {
+	conn net.Conn
+	// 单个响应的最大长度
+	maxFrameSize uint32
+	// 这个连接上的请求使用的协议版本，服务端不支持的时候会降级
+	version atomic.Uint32
+
+	// 保证一个请求的数据被完整写入，不会和其它请求交错
+	writeLock sync.Mutex
+
+	lock sync.Mutex
+	// 等待响应的调用，key 是 MessageId
+	pending map[uint32]chan *message.Response
+	// 正在进行的流，key 是 MessageId
+	streams map[uint32]*clientStream
+	// 实例已经从注册中心下线，等正在进行的调用和流结束之后关闭连接
+	draining bool
+
+	// 连接关闭后 closed 会被关闭，err 记录了关闭的原因
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func newClientConn(conn net.Conn, maxFrameSize uint32, version uint8) *clientConn {
+	cc := &clientConn{
+		conn:         conn,
+		maxFrameSize: maxFrameSize,
+		pending:      make(map[uint32]chan *message.Response, 16),
+		streams:      make(map[uint32]*clientStream, 4),
+		closed:       make(chan struct{}),
+	}
+	cc.version.Store(uint32(version))
+	go cc.readLoop()
+	return cc
+}
+
+func (cc *clientConn) readLoop() {
+	for {
+		// 响应会交给调用方，所以不使用 bufPool
+		data, err := readFrame(cc.conn, cc.maxFrameSize, nil)
+		if err != nil {
+			cc.close(err)
+			return
+		}
+		resp, err := message.DecodeResp(data)
+		if err != nil {
+			// 服务端发过来的数据有问题，这个连接已经不可信了
+			cc.close(err)
+			return
+		}
+
+		cc.lock.Lock()
+		ch, ok := cc.pending[resp.MessageId]
+		delete(cc.pending, resp.MessageId)
+		st := cc.streams[resp.MessageId]
+		idle := cc.idle()
+		cc.lock.Unlock()
+		// 调用方可能已经超时离开了，这种响应直接丢弃
+		if ok {
+			ch <- resp
+		} else if st != nil {
+			st.handle(resp)
+		}
+		if idle {
+			cc.close(errConnClosed)
+		}
+	}
+}
+
+// roundTrip 发送请求并等待对应的响应
+// oneway 为 true 的时候，请求写出去之后就直接返回
+func (cc *clientConn) roundTrip(ctx context.Context, req *message.Request, oneway bool) (*message.Response, error) {
+	// 缓冲为 1，readLoop 投递响应的时候不会被阻塞
+	ch := make(chan *message.Response, 1)
+	if !oneway {
+		cc.lock.Lock()
+		cc.pending[req.MessageId] = ch
+		cc.lock.Unlock()
+	}
+
+	if err := cc.write(ctx, req); err != nil {
+		cc.removePending(req.MessageId)
+		return nil, err
+	}
+
+	if oneway {
+		return nil, nil
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		cc.removePending(req.MessageId)
+		return nil, ctx.Err()
+	case <-cc.closed:
+		// 关闭之前响应可能已经到了
+		select {
+		case resp := <-ch:
+			return resp, nil
+		default:
+			return nil, cc.err
+		}
+	}
+}
+
+// write 把请求完整地写到连接上，写失败之后连接不再可用
+func (cc *clientConn) write(ctx context.Context, req *message.Request) error {
+	// 已经超时的请求不要再写，写到一半超时会导致整个连接被关闭
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// 协商出来的是 Version1 的时候，包含分隔符的元数据发不出去
+	if err := req.Validate(); err != nil {
+		return status.New(status.InvalidArgument, err.Error())
+	}
+	data := message.EncodeReq(req)
+	cc.writeLock.Lock()
+	// 写不出去的时候也不能超过调用方的超时时间
+	deadline, _ := ctx.Deadline()
+	err := cc.conn.SetWriteDeadline(deadline)
+	if err == nil {
+		_, err = cc.conn.Write(data)
+	}
+	cc.writeLock.Unlock()
+	if err != nil {
+		cc.close(err)
+	}
+	return err
+}
+
+func (cc *clientConn) removePending(id uint32) {
+	cc.lock.Lock()
+	delete(cc.pending, id)
+	idle := cc.idle()
+	cc.lock.Unlock()
+	if idle {
+		cc.close(errConnClosed)
+	}
+}
+
+// drain 客户端已经不会再使用这个连接，正在进行的调用和流结束之后关闭
+func (cc *clientConn) drain() {
+	cc.lock.Lock()
+	cc.draining = true
+	idle := cc.idle()
+	cc.lock.Unlock()
+	if idle {
+		cc.close(errConnClosed)
+	}
+}
+
+// idle 必须在持有 lock 的时候调用
+func (cc *clientConn) idle() bool {
+	return cc.draining && len(cc.pending) == 0 && len(cc.streams) == 0
+}
+
+func (cc *clientConn) isClosed() bool {
+	select {
+	case <-cc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cc *clientConn) close(err error) {
+	cc.closeOnce.Do(func() {
+		if err == nil {
+			err = errConnClosed
+		}
+		cc.err = err
+		_ = cc.conn.Close()
+		close(cc.closed)
+
+		cc.lock.Lock()
+		streams := cc.streams
+		cc.streams = make(map[uint32]*clientStream)
+		cc.lock.Unlock()
+		for _, st := range streams {
+			st.core.terminate(err)
+		}
+	})
+}
+
+// openStream 发送打开流的请求，req 需要带上服务名和方法名
+func (cc *clientConn) openStream(ctx context.Context, req *message.Request, c compress.Compressor) (*clientStream, error) {
+	st := &clientStream{
+		cc: cc,
+		header: message.Request{
+			MessageId:  req.MessageId,
+			Version:    req.Version,
+			Compresser: req.Compresser,
+			Serializer: req.Serializer,
+		},
+		compressor: c,
+	}
+	st.core = newStreamCore(ctx, st.windowUpdate)
+
+	cc.lock.Lock()
+	if cc.isClosed() {
+		cc.lock.Unlock()
+		return nil, cc.err
+	}
+	cc.streams[req.MessageId] = st
+	cc.lock.Unlock()
+
+	req.SetHeadLength()
+	req.SetBodyLength()
+	if err := cc.write(ctx, req); err != nil {
+		cc.removeStream(req.MessageId)
+		return nil, err
+	}
+	go st.watch()
+	return st, nil
+}
+
+func (cc *clientConn) removeStream(id uint32) {
+	cc.lock.Lock()
+	delete(cc.streams, id)
+	idle := cc.idle()
+	cc.lock.Unlock()
+	if idle {
+		cc.close(errConnClosed)
+	}
+}
+
+// clientStream 客户端的流，所有的消息使用打开流的时候的 MessageId
+type clientStream struct {
+	cc   *clientConn
+	core *streamCore
+	// 后续消息的头部，不需要再带上服务名和方法名
+	header     message.Request
+	compressor compress.Compressor
+	sendClosed atomic.Bool
+}
+
+func (st *clientStream) Context() context.Context {
+	return st.core.ctx
+}
+
+func (st *clientStream) SendMsg(data []byte) error {
+	if st.sendClosed.Load() {
+		return errors.New("micro: 流已经调用过 CloseSend")
+	}
+	if err := st.core.acquire(); err != nil {
+		return err
+	}
+	if st.compressor != nil {
+		var err error
+		data, err = st.compressor.Compress(data)
+		if err != nil {
+			return err
+		}
+	}
+	return st.send(st.core.ctx, message.FlagStream, data)
+}
+
+func (st *clientStream) RecvMsg() ([]byte, error) {
+	f, err := st.core.recv()
+	if err != nil {
+		// 接收方向结束就是整个流结束了，之后的 Send 都返回 io.EOF
+		st.core.terminate(io.EOF)
+		return nil, err
+	}
+	if f.compresser == 0 || len(f.data) == 0 {
+		return f.data, nil
+	}
+	// 服务端使用和请求相同的压缩算法
+	if st.compressor == nil || st.compressor.Code() != f.compresser {
+		return nil, errUnsupportedCompressor
+	}
+	return decompress(st.compressor, f.data, st.cc.maxFrameSize)
+}
+
+func (st *clientStream) CloseSend() error {
+	if st.sendClosed.Swap(true) {
+		return nil
+	}
+	return st.send(context.Background(), message.FlagStream|message.FlagEndStream, nil)
+}
+
+func (st *clientStream) windowUpdate(n uint32) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, n)
+	// 控制消息不受调用方超时的影响
+	return st.send(context.Background(), message.FlagStream|message.FlagWindowUpdate, data)
+}
+
+func (st *clientStream) send(ctx context.Context, flags uint8, data []byte) error {
+	req := st.header
+	req.Flags = flags
+	req.Data = data
+	req.SetHeadLength()
+	req.SetBodyLength()
+	return st.cc.write(ctx, &req)
+}
+
+// handle 处理服务端发过来的消息，由 readLoop 调用
+func (st *clientStream) handle(resp *message.Response) {
+	switch {
+	case resp.Flags&message.FlagWindowUpdate != 0:
+		if len(resp.Data) == 4 {
+			st.core.addCredits(binary.BigEndian.Uint32(resp.Data))
+		}
+	case resp.Flags&message.FlagStream == 0 || resp.Flags&message.FlagEndStream != 0:
+		// 服务端在打开流之前就拒绝了的时候，返回的是普通的响应
+		st.cc.removeStream(st.header.MessageId)
+		var err error
+		if len(resp.Error) > 0 {
+			err = status.Decode(resp.Error)
+		}
+		st.core.deliver(streamFrame{end: true, err: err})
+		st.core.terminate(io.EOF)
+	default:
+		st.core.deliver(streamFrame{data: resp.Data, compresser: resp.Compresser})
+	}
+}
+
+// watch 调用方放弃了流的时候，通知服务端取消调用
+func (st *clientStream) watch() {
+	select {
+	case <-st.core.ctx.Done():
+	case <-st.core.done:
+		// 调用方取消之后 Recv 也会终止流，这时候还是要通知服务端
+		// 已经正常结束的流，服务端会忽略这个消息
+		if st.core.ctx.Err() == nil {
+			return
+		}
+	}
+	st.cc.removeStream(st.header.MessageId)
+	st.core.terminate(st.core.ctx.Err())
+	_ = st.send(context.Background(), message.FlagStream|message.FlagReset, nil)
+}
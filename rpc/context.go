@@ -1,10 +1,26 @@
 package rpc
 
-import "context"
+import (
+	"context"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/metadata"
+	"geek_micro/rpc/status"
+	"time"
+)
+
+// 框架自己的元数据，业务不能使用这些 key，见 metadata.ReservedPrefix
+const (
+	// 请求剩余的超时时间，格式和 time.Duration.String() 一致
+	metaTimeout = metadata.ReservedPrefix + "timeout"
+	// 值为 true 的时候服务端不返回响应
+	metaOneWay = metadata.ReservedPrefix + "one-way"
+)
 
 type onewayKey struct {
 }
 
+// CtxWithOneWay 标记这次调用是 oneway 调用，请求写出去之后就返回，不等待服务端的响应
+// 只对一元调用生效，也可以在客户端的字段上加上 rpc:"oneway" 标签
 func CtxWithOneWay(ctx context.Context) context.Context {
 	// 推荐：使用结构体作为key
 	return context.WithValue(ctx, onewayKey{}, true)
@@ -15,3 +31,92 @@ func isOneWay(ctx context.Context) bool {
 	oneway, ok := val.(bool)
 	return ok && oneway
 }
+
+type idempotentKey struct {
+}
+
+// CtxWithIdempotent 标记这次调用是幂等的，重试之类的拦截器只会重试幂等的调用
+// 也可以在客户端的字段上加上 rpc:"idempotent" 标签
+func CtxWithIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// IsIdempotent 供客户端拦截器判断调用是不是幂等的
+func IsIdempotent(ctx context.Context) bool {
+	idempotent, ok := ctx.Value(idempotentKey{}).(bool)
+	return ok && idempotent
+}
+
+// withTimeout 按照请求中携带的超时时间构造 context
+// 没有超时时间的请求返回的 cancel 什么也不做
+func withTimeout(ctx context.Context, req *message.Request) (context.Context, context.CancelFunc) {
+	timeout, ok := timeoutOf(req)
+	if !ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutOf 返回客户端设置的超时时间
+func timeoutOf(req *message.Request) (time.Duration, bool) {
+	val, ok := req.Meta[metaTimeout]
+	if !ok {
+		return 0, false
+	}
+	timeout, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, false
+	}
+	return timeout, true
+}
+
+// outgoingMeta 取出 ctx 里面要发给服务端的元数据，使用了保留前缀的 key 返回错误
+func outgoingMeta(ctx context.Context) (map[string]string, error) {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok || len(md) == 0 {
+		return nil, nil
+	}
+	for key := range md {
+		if metadata.IsReserved(key) {
+			return nil, status.Errorf(status.InvalidArgument, "micro: 元数据的 key %s 使用了框架保留的前缀 %s", key, metadata.ReservedPrefix)
+		}
+	}
+	return md.Copy(), nil
+}
+
+// incomingMeta 交给业务方法的元数据，去掉了框架自己的 key
+func incomingMeta(meta map[string]string) metadata.MD {
+	md := make(metadata.MD, len(meta))
+	for key, val := range meta {
+		if !metadata.IsReserved(key) {
+			md[key] = val
+		}
+	}
+	return md
+}
+
+// setMeta 把超时时间和 oneway 标记放进请求，调用方（例如拦截器）放进来的保留 key 会被去掉
+// 传的是剩余时长而不是时间点，避免两边时钟不一致
+func setMeta(ctx context.Context, req *message.Request) error {
+	meta := make(map[string]string, len(req.Meta)+2)
+	for key, val := range req.Meta {
+		if !metadata.IsReserved(key) {
+			meta[key] = val
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+		meta[metaTimeout] = timeout.String()
+	}
+	if isOneWay(ctx) {
+		meta[metaOneWay] = "true"
+	}
+	if len(meta) == 0 {
+		meta = nil
+	}
+	req.Meta = meta
+	return nil
+}
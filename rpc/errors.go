@@ -0,0 +1,24 @@
+package rpc
+
+import (
+	"errors"
+	"geek_micro/rpc/status"
+)
+
+// ErrServerClosed 服务端调用了 Shutdown 或者 Close 之后，Serve 返回这个错误
+var ErrServerClosed = errors.New("micro: 服务端已经关闭")
+
+// ErrOverloaded 服务端正在处理的请求达到了上限，请求在解压和调用拦截器之前就被丢弃
+// 带有 status.DetailOverloaded，客户端可以用 status.IsOverloaded 区分，换一个实例重试
+var ErrOverloaded = status.New(status.Unavailable, "micro: 服务端过载，请求被丢弃").
+	WithDetails(status.Detail{Type: status.DetailOverloaded})
+
+// 框架自身产生的错误，客户端可以通过 status.CodeOf 区分
+var (
+	errServiceNotFound       = status.New(status.NotFound, "你要调用的服务不存在")
+	errMethodNotFound        = status.New(status.NotFound, "micro: 你要调用的方法不存在")
+	errUnsupportedSerializer = status.New(status.Unimplemented, "micro: 不支持的序列化协议")
+	errUnsupportedCompressor = status.New(status.Unimplemented, "micro: 不支持的压缩算法")
+	errServerClosing         = status.New(status.Unavailable, "micro: 服务端正在关闭")
+	errServerPanic           = status.New(status.Internal, "micro: 服务端处理请求的时候发生了 panic")
+)
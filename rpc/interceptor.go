@@ -0,0 +1,58 @@
+package rpc
+
+import (
+	"context"
+	"geek_micro/rpc/message"
+)
+
+// Handler 处理一个请求，返回的 Response 只需要关心 Data
+type Handler func(ctx context.Context, req *message.Request) (*message.Response, error)
+
+// ServerInterceptor 服务端拦截器，调用 next 把请求交给下一个拦截器或者业务方法
+// 不调用 next 就可以直接拒绝请求，例如鉴权失败
+type ServerInterceptor func(ctx context.Context, req *message.Request, next Handler) (*message.Response, error)
+
+func buildServerChain(interceptors []ServerInterceptor, handler Handler) Handler {
+	// 从最里层开始包，第一个拦截器最后被包上去
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return handler
+}
+
+// StreamHandler 执行流式方法，方法返回之后流就结束了
+type StreamHandler func(ctx context.Context, req *message.Request) error
+
+// StreamServerInterceptor 流式调用的服务端拦截器，打开流的时候调用一次，调用 next 之后流式方法才开始执行
+// req 是打开流的请求，没有数据；不调用 next 就可以直接拒绝这个流，例如限流
+type StreamServerInterceptor func(ctx context.Context, req *message.Request, next StreamHandler) error
+
+func buildStreamChain(interceptors []StreamServerInterceptor, handler StreamHandler) StreamHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req *message.Request) error {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return handler
+}
+
+// Invoker 把请求发送到服务端并返回响应
+type Invoker func(ctx context.Context, req *message.Request) (*message.Response, error)
+
+// ClientInterceptor 客户端拦截器，调用 next 把请求交给下一个拦截器或者真正发送出去
+// 可以在这里注入元数据、记录日志或者重试
+type ClientInterceptor func(ctx context.Context, req *message.Request, next Invoker) (*message.Response, error)
+
+func buildClientChain(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, req *message.Request) (*message.Response, error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return invoker
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/serialize/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerInterceptors(t *testing.T) {
+	var logs []string
+	logInterceptor := func(name string) ServerInterceptor {
+		return func(ctx context.Context, req *message.Request, next Handler) (*message.Response, error) {
+			logs = append(logs, name+" before")
+			resp, err := next(ctx, req)
+			logs = append(logs, name+" after")
+			return resp, err
+		}
+	}
+	authInterceptor := func(ctx context.Context, req *message.Request, next Handler) (*message.Response, error) {
+		if req.Meta["token"] != "123" {
+			return nil, errors.New("鉴权失败")
+		}
+		return next(ctx, req)
+	}
+
+	server := NewServer(ServerWithInterceptors(logInterceptor("first"), logInterceptor("second"), authInterceptor))
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	s := &json.Serializer{}
+	data, err := s.Encode(&GetByIdReq{Id: 1})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name string
+		meta map[string]string
+
+		wantLogs []string
+		wantErr  error
+		wantData []byte
+	}{
+		{
+			name:     "ok",
+			meta:     map[string]string{"token": "123"},
+			wantLogs: []string{"first before", "second before", "second after", "first after"},
+			wantData: []byte(`{"Msg":"hello, world"}`),
+		},
+		{
+			name:     "rejected",
+			wantLogs: []string{"first before", "second before", "second after", "first after"},
+			wantErr:  errors.New("鉴权失败"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs = nil
+			resp, err := server.Invoke(context.Background(), &message.Request{
+				MessageId:   12,
+				Serializer:  s.Code(),
+				ServiceName: "user-service",
+				MethodName:  "GetById",
+				Meta:        tc.meta,
+				Data:        data,
+			})
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantLogs, logs)
+			// 拦截器不需要关心响应的头部
+			assert.Equal(t, uint32(12), resp.MessageId)
+			assert.Equal(t, tc.wantData, resp.Data)
+		})
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	// 服务端校验客户端拦截器注入的 token
+	server := NewServer(ServerWithInterceptors(func(ctx context.Context, req *message.Request, next Handler) (*message.Response, error) {
+		if req.Meta["token"] != "123" {
+			return nil, errors.New("鉴权失败")
+		}
+		return next(ctx, req)
+	}))
+	server.RegisterService(&UserServiceServer{Msg: "hello, world"})
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	var logs []string
+	tokenInterceptor := func(ctx context.Context, req *message.Request, next Invoker) (*message.Response, error) {
+		if req.Meta == nil {
+			req.Meta = make(map[string]string, 1)
+		}
+		req.Meta["token"] = "123"
+		return next(ctx, req)
+	}
+	logInterceptor := func(ctx context.Context, req *message.Request, next Invoker) (*message.Response, error) {
+		resp, err := next(ctx, req)
+		logs = append(logs, fmt.Sprintf("%s.%s %s %v", req.ServiceName, req.MethodName, resp.Data, err))
+		return resp, err
+	}
+
+	us := &UserService{}
+	client, err := NewClient(addr, ClientWithInterceptors(logInterceptor, tokenInterceptor))
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	err = client.InitService(us)
+	require.NoError(t, err)
+
+	resp, err := us.GetById(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, &GetByIdResp{Msg: "hello, world"}, resp)
+	assert.Equal(t, []string{`user-service.GetById {"Msg":"hello, world"} <nil>`}, logs)
+}
@@ -0,0 +1,101 @@
+// Package rpctest 是拦截器之类的扩展包的端到端测试共用的服务和启动代码
+package rpctest
+
+import (
+	"context"
+	"geek_micro/rpc"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type Req struct {
+	Id int
+}
+
+type Resp struct {
+	Msg string
+}
+
+// UserClient 是 UserServer 的客户端，Get 是幂等的，Create 不是，Watch 是流式方法
+type UserClient struct {
+	Get    func(ctx context.Context, req *Req) (*Resp, error) `rpc:"idempotent"`
+	Create func(ctx context.Context, req *Req) (*Resp, error)
+	Watch  func(ctx context.Context) (*rpc.Stream[Req, Resp], error)
+}
+
+func (u *UserClient) Name() string {
+	return "user"
+}
+
+// UserServer 的方法交给对应的函数处理，函数为 nil 的时候返回空的响应
+type UserServer struct {
+	OnGet    func(ctx context.Context, req *Req) (*Resp, error)
+	OnCreate func(ctx context.Context, req *Req) (*Resp, error)
+	OnWatch  func(ctx context.Context, stream *rpc.Stream[Resp, Req]) error
+}
+
+func (u *UserServer) Name() string {
+	return "user"
+}
+
+func (u *UserServer) Get(ctx context.Context, req *Req) (*Resp, error) {
+	if u.OnGet == nil {
+		return &Resp{}, nil
+	}
+	return u.OnGet(ctx, req)
+}
+
+func (u *UserServer) Create(ctx context.Context, req *Req) (*Resp, error) {
+	if u.OnCreate == nil {
+		return &Resp{}, nil
+	}
+	return u.OnCreate(ctx, req)
+}
+
+func (u *UserServer) Watch(ctx context.Context, stream *rpc.Stream[Resp, Req]) error {
+	if u.OnWatch == nil {
+		return nil
+	}
+	return u.OnWatch(ctx, stream)
+}
+
+// Start 在随机端口上启动 server 并且注册 us，返回连接到它的客户端
+// 测试结束的时候关闭客户端和服务端
+func Start(t *testing.T, server *rpc.Serve, us *UserServer, opts ...rpc.ClientOptions) *UserClient {
+	require.NoError(t, server.RegisterService(us))
+	require.NoError(t, server.Listen("tcp", "127.0.0.1:0"))
+	go func() {
+		_ = server.Serve()
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	client, err := rpc.NewClient(server.Addr().String(), opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	uc := &UserClient{}
+	require.NoError(t, client.InitService(uc))
+	return uc
+}
+
+// Context 在测试用例里面延迟构造 ctx，超时时间从用例开始执行的时候算起
+type Context func() (context.Context, context.CancelFunc)
+
+// Ctx 直接使用 ctx
+func Ctx(ctx context.Context) Context {
+	return func() (context.Context, context.CancelFunc) {
+		return ctx, func() {}
+	}
+}
+
+// Timeout 在 ctx 上面加上超时时间，d 不大于 0 的时候 ctx 已经过期
+func Timeout(ctx context.Context, d time.Duration) Context {
+	return func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, d)
+	}
+}
@@ -0,0 +1,112 @@
+package loadbalance_test
+
+import (
+	"geek_micro/rpc/loadbalance"
+	"geek_micro/rpc/loadbalance/hash"
+	"geek_micro/rpc/loadbalance/leastactive"
+	"geek_micro/rpc/loadbalance/random"
+	"geek_micro/rpc/loadbalance/roundrobin"
+	"geek_micro/rpc/loadbalance/weighted"
+	"geek_micro/rpc/registry"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var instances = []registry.ServiceInstance{
+	{Name: "user-service", Address: "a", Weight: 5},
+	{Name: "user-service", Address: "b", Weight: 1},
+	{Name: "user-service", Address: "c", Weight: 1},
+}
+
+func TestNoAvailableInstance(t *testing.T) {
+	builders := []loadbalance.Builder{
+		&roundrobin.Builder{},
+		&random.Builder{},
+		&weighted.Builder{},
+		&leastactive.Builder{},
+		&hash.Builder{Key: "user-id"},
+	}
+	for _, b := range builders {
+		_, err := b.Build(nil).Pick(loadbalance.PickInfo{})
+		assert.Equal(t, loadbalance.ErrNoAvailableInstance, err)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	b := (&roundrobin.Builder{}).Build(instances)
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, pickN(t, b, 6))
+}
+
+func TestRandom(t *testing.T) {
+	b := (&random.Builder{}).Build(instances)
+	for _, addr := range pickN(t, b, 10) {
+		assert.Contains(t, []string{"a", "b", "c"}, addr)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	b := (&weighted.Builder{}).Build(instances)
+	assert.Equal(t, []string{"a", "a", "b", "a", "c", "a", "a"}, pickN(t, b, 7))
+}
+
+func TestLeastActive(t *testing.T) {
+	b := (&leastactive.Builder{}).Build(instances)
+	// 三个请求都没有结束，每个实例各分到一个
+	results := make([]loadbalance.PickResult, 0, 3)
+	picked := make(map[string]struct{}, 3)
+	for i := 0; i < 3; i++ {
+		res, err := b.Pick(loadbalance.PickInfo{})
+		require.NoError(t, err)
+		results = append(results, res)
+		picked[res.Instance.Address] = struct{}{}
+	}
+	assert.Len(t, picked, 3)
+
+	// 第一个实例的请求结束了，下一个请求应该落到它上面
+	results[0].Done(nil)
+	res, err := b.Pick(loadbalance.PickInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, results[0].Instance, res.Instance)
+}
+
+func TestHash(t *testing.T) {
+	b := (&hash.Builder{Key: "user-id"}).Build(instances)
+	// 相同的 key 总是落到同一个实例
+	for i := 0; i < 20; i++ {
+		info := loadbalance.PickInfo{Meta: map[string]string{"user-id": strconv.Itoa(i)}}
+		first, err := b.Pick(info)
+		require.NoError(t, err)
+		for j := 0; j < 3; j++ {
+			res, err := b.Pick(info)
+			require.NoError(t, err)
+			assert.Equal(t, first.Instance, res.Instance)
+		}
+	}
+
+	// 去掉一个实例之后，原本不在这个实例上的 key 不受影响
+	smaller := (&hash.Builder{Key: "user-id"}).Build(instances[:2])
+	for i := 0; i < 100; i++ {
+		info := loadbalance.PickInfo{Meta: map[string]string{"user-id": strconv.Itoa(i)}}
+		before, err := b.Pick(info)
+		require.NoError(t, err)
+		if before.Instance.Address == "c" {
+			continue
+		}
+		after, err := smaller.Pick(info)
+		require.NoError(t, err)
+		assert.Equal(t, before.Instance, after.Instance)
+	}
+}
+
+func pickN(t *testing.T, b loadbalance.Balancer, n int) []string {
+	res := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		r, err := b.Pick(loadbalance.PickInfo{})
+		require.NoError(t, err)
+		res = append(res, r.Instance.Address)
+	}
+	return res
+}
@@ -0,0 +1,79 @@
+package hash
+
+import (
+	"geek_micro/rpc/loadbalance"
+	"geek_micro/rpc/registry"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// Balancer 一致性哈希，相同 key 的请求总是落到同一个实例上
+// 实例增减的时候，只有一小部分 key 会换到别的实例
+type Balancer struct {
+	key       string
+	instances []registry.ServiceInstance
+	// 排好序的虚拟节点
+	ring []node
+}
+
+type node struct {
+	hash     uint32
+	instance registry.ServiceInstance
+}
+
+func (b *Balancer) Pick(info loadbalance.PickInfo) (loadbalance.PickResult, error) {
+	if len(b.ring) == 0 {
+		return loadbalance.PickResult{}, loadbalance.ErrNoAvailableInstance
+	}
+	val, ok := info.Meta[b.key]
+	if !ok {
+		// 没有 key 的请求随便挑一个
+		return loadbalance.PickResult{
+			Instance: b.instances[rand.Intn(len(b.instances))],
+		}, nil
+	}
+	h := crc32.ChecksumIEEE([]byte(val))
+	idx := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= h
+	})
+	// 环上最后一个节点之后是第一个节点
+	if idx == len(b.ring) {
+		idx = 0
+	}
+	return loadbalance.PickResult{
+		Instance: b.ring[idx].instance,
+	}, nil
+}
+
+type Builder struct {
+	// 从 Request.Meta 中取哈希 key 用的键，例如 user-id
+	Key string
+	// 每个实例的虚拟节点个数，默认是 100
+	Replicas int
+}
+
+func (b *Builder) Build(instances []registry.ServiceInstance) loadbalance.Balancer {
+	replicas := b.Replicas
+	if replicas <= 0 {
+		replicas = 100
+	}
+	ring := make([]node, 0, len(instances)*replicas)
+	for _, ins := range instances {
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, node{
+				hash:     crc32.ChecksumIEEE([]byte(ins.Address + "#" + strconv.Itoa(i))),
+				instance: ins,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return &Balancer{
+		key:       b.Key,
+		instances: instances,
+		ring:      ring,
+	}
+}
@@ -0,0 +1,53 @@
+package leastactive
+
+import (
+	"geek_micro/rpc/loadbalance"
+	"geek_micro/rpc/registry"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Balancer 选择正在处理的请求最少的实例，处理得慢的实例会自然地分到更少的请求
+type Balancer struct {
+	instances []*activeInstance
+}
+
+type activeInstance struct {
+	instance registry.ServiceInstance
+	active   atomic.Int64
+}
+
+func (b *Balancer) Pick(info loadbalance.PickInfo) (loadbalance.PickResult, error) {
+	if len(b.instances) == 0 {
+		return loadbalance.PickResult{}, loadbalance.ErrNoAvailableInstance
+	}
+	// 从随机的位置开始找，活跃数相同的时候不会总是落到第一个实例上
+	start := rand.Intn(len(b.instances))
+	res := b.instances[start]
+	for i := 1; i < len(b.instances); i++ {
+		ins := b.instances[(start+i)%len(b.instances)]
+		if ins.active.Load() < res.active.Load() {
+			res = ins
+		}
+	}
+	res.active.Add(1)
+	return loadbalance.PickResult{
+		Instance: res.instance,
+		Done: func(err error) {
+			res.active.Add(-1)
+		},
+	}, nil
+}
+
+type Builder struct {
+}
+
+func (b *Builder) Build(instances []registry.ServiceInstance) loadbalance.Balancer {
+	res := make([]*activeInstance, 0, len(instances))
+	for _, ins := range instances {
+		res = append(res, &activeInstance{instance: ins})
+	}
+	return &Balancer{
+		instances: res,
+	}
+}
@@ -0,0 +1,29 @@
+package random
+
+import (
+	"geek_micro/rpc/loadbalance"
+	"geek_micro/rpc/registry"
+	"math/rand"
+)
+
+type Balancer struct {
+	instances []registry.ServiceInstance
+}
+
+func (b *Balancer) Pick(info loadbalance.PickInfo) (loadbalance.PickResult, error) {
+	if len(b.instances) == 0 {
+		return loadbalance.PickResult{}, loadbalance.ErrNoAvailableInstance
+	}
+	return loadbalance.PickResult{
+		Instance: b.instances[rand.Intn(len(b.instances))],
+	}, nil
+}
+
+type Builder struct {
+}
+
+func (b *Builder) Build(instances []registry.ServiceInstance) loadbalance.Balancer {
+	return &Balancer{
+		instances: instances,
+	}
+}
@@ -0,0 +1,31 @@
+package roundrobin
+
+import (
+	"geek_micro/rpc/loadbalance"
+	"geek_micro/rpc/registry"
+	"sync/atomic"
+)
+
+type Balancer struct {
+	instances []registry.ServiceInstance
+	index     atomic.Uint64
+}
+
+func (b *Balancer) Pick(info loadbalance.PickInfo) (loadbalance.PickResult, error) {
+	if len(b.instances) == 0 {
+		return loadbalance.PickResult{}, loadbalance.ErrNoAvailableInstance
+	}
+	idx := b.index.Add(1) - 1
+	return loadbalance.PickResult{
+		Instance: b.instances[idx%uint64(len(b.instances))],
+	}, nil
+}
+
+type Builder struct {
+}
+
+func (b *Builder) Build(instances []registry.ServiceInstance) loadbalance.Balancer {
+	return &Balancer{
+		instances: instances,
+	}
+}
@@ -0,0 +1,33 @@
+package loadbalance
+
+import (
+	"errors"
+	"geek_micro/rpc/registry"
+)
+
+var ErrNoAvailableInstance = errors.New("micro: 没有可用的服务实例")
+
+// Balancer 从可用的实例中挑选一个实例处理请求
+type Balancer interface {
+	Pick(info PickInfo) (PickResult, error)
+}
+
+// Builder 服务实例发生变化的时候，用最新的可用实例构建一个新的 Balancer
+// instances 可能为空，这个时候 Pick 应该返回 ErrNoAvailableInstance
+type Builder interface {
+	Build(instances []registry.ServiceInstance) Balancer
+}
+
+type PickInfo struct {
+	ServiceName string
+	MethodName  string
+	// 请求的元数据，例如一致性哈希需要从里面拿到哈希的 key
+	Meta map[string]string
+}
+
+type PickResult struct {
+	Instance registry.ServiceInstance
+	// Done 在调用结束之后被调用，可以为 nil
+	// 例如最少活跃请求数需要在这里把活跃数减掉
+	Done func(err error)
+}
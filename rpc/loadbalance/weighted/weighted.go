@@ -0,0 +1,62 @@
+package weighted
+
+import (
+	"geek_micro/rpc/loadbalance"
+	"geek_micro/rpc/registry"
+	"sync"
+)
+
+// Balancer 平滑的加权轮询，权重大的实例不会被连续选中
+// 例如权重为 5、1、1 的三个实例，选中的顺序是 a a b a c a a
+type Balancer struct {
+	lock      sync.Mutex
+	instances []*weightedInstance
+}
+
+type weightedInstance struct {
+	instance      registry.ServiceInstance
+	weight        int
+	currentWeight int
+}
+
+func (b *Balancer) Pick(info loadbalance.PickInfo) (loadbalance.PickResult, error) {
+	if len(b.instances) == 0 {
+		return loadbalance.PickResult{}, loadbalance.ErrNoAvailableInstance
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var total int
+	var res *weightedInstance
+	for _, ins := range b.instances {
+		ins.currentWeight += ins.weight
+		total += ins.weight
+		if res == nil || ins.currentWeight > res.currentWeight {
+			res = ins
+		}
+	}
+	res.currentWeight -= total
+	return loadbalance.PickResult{
+		Instance: res.instance,
+	}, nil
+}
+
+type Builder struct {
+}
+
+func (b *Builder) Build(instances []registry.ServiceInstance) loadbalance.Balancer {
+	res := make([]*weightedInstance, 0, len(instances))
+	for _, ins := range instances {
+		weight := int(ins.Weight)
+		// 没有设置权重的实例当做 1
+		if weight == 0 {
+			weight = 1
+		}
+		res = append(res, &weightedInstance{
+			instance: ins,
+			weight:   weight,
+		})
+	}
+	return &Balancer{
+		instances: res,
+	}
+}
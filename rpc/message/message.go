@@ -3,14 +3,54 @@ package message
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
 )
 
-// 头部不定长字段的分隔符
+// 协议版本，由头部的 Version 字段决定头部不定长部分的格式
+const (
+	// Version1 字符串字段之间用分隔符隔开，没有设置版本（0）的旧客户端也按照 Version1 处理
+	Version1 uint8 = 1
+	// Version2 在固定头部之后多了一个字节的标志位，字符串字段都带有 uvarint 编码的长度前缀，
+	// 可以包含任意字节
+	Version2 uint8 = 2
+
+	// LatestVersion 这个包能够编解码的最高版本
+	LatestVersion = Version2
+)
+
+// Version2 头部的标志位，流式调用的所有消息使用同一个 MessageId
+const (
+	// FlagStream 消息属于一个流，第一个带有这个标志的请求打开流
+	FlagStream uint8 = 1 << iota
+	// FlagEndStream 发送方不会再发送数据，服务端的结束消息还会带上调用的错误
+	FlagEndStream
+	// FlagWindowUpdate 接收方处理完了一些消息，Data 是大端序 uint32 表示的消息个数，发送方可以继续发送这么多消息
+	FlagWindowUpdate
+	// FlagReset 客户端放弃了这个流，服务端取消对应的调用
+	FlagReset
+)
+
+// Version1 头部不定长字段的分隔符
+// 字段原样写入，不能包含分隔符，见 Request.Validate
 const (
 	splitter     = '\n'
 	pairSplitter = '\r'
 )
 
+// headLength 头部固定部分的长度
+const headLength = 15
+
+var (
+	// ErrInvalidMessage 消息的长度或者格式不合法
+	ErrInvalidMessage = errors.New("message: 消息格式错误")
+	// ErrUnknownVersion 不认识消息的协议版本
+	ErrUnknownVersion = errors.New("message: 未知的协议版本")
+	// ErrInvalidField Version1 的字段包含了分隔符，需要使用 Version2
+	ErrInvalidField = errors.New("message: Version1 的服务名、方法名和元数据不能包含 \\n 和 \\r，请使用 Version2")
+)
+
 type Request struct {
 	// 头部
 	// 消息长度
@@ -25,6 +65,8 @@ type Request struct {
 	Compresser uint8
 	// 序列化方法
 	Serializer uint8
+	// 标志位，只有 Version2 的消息才有
+	Flags uint8
 
 	// 服务名称和方法名称
 	ServiceName string
@@ -38,8 +80,12 @@ type Request struct {
 }
 
 func (req *Request) SetHeadLength() {
+	if req.Version == Version2 {
+		req.setBinaryHeadLength()
+		return
+	}
 	// uint32 => 4个字节
-	res := 15
+	res := headLength
 	res += len(req.ServiceName)
 	// 分隔符
 	res++
@@ -59,58 +105,111 @@ func (req *Request) SetBodyLength() {
 	req.BodyLength = uint32(len(req.Data))
 }
 
-func EncodeReq(req *Request) []byte {
-	bs := make([]byte, req.HeadLength+req.BodyLength)
-	cur := bs
-
-	binary.BigEndian.PutUint32(cur[:4], req.HeadLength)
-	binary.BigEndian.PutUint32(cur[4:8], req.BodyLength)
-	binary.BigEndian.PutUint32(cur[8:12], req.MessageId)
-	cur[12] = req.Version
-	cur[13] = req.Compresser
-	cur[14] = req.Serializer
-	cur = cur[15:]
-
-	copy(cur, req.ServiceName)
-	cur[len(req.ServiceName)] = splitter
-	cur = cur[len(req.ServiceName)+1:]
+// Validate 检查请求能不能用 req.Version 编码，Version1 的字段不能包含分隔符，否则返回 ErrInvalidField
+// Version1 的字段不转义，和旧版本的客户端、服务端逐字节兼容
+func (req *Request) Validate() error {
+	if req.Version != 0 && req.Version != Version1 {
+		return nil
+	}
+	if hasSplitter(req.ServiceName) || hasSplitter(req.MethodName) {
+		return ErrInvalidField
+	}
+	for key, value := range req.Meta {
+		if hasSplitter(key) || hasSplitter(value) {
+			return fmt.Errorf("%w: 元数据 %q", ErrInvalidField, key)
+		}
+	}
+	return nil
+}
 
-	copy(cur, req.MethodName)
-	cur[len(req.MethodName)] = splitter
-	cur = cur[len(req.MethodName)+1:]
+func hasSplitter(s string) bool {
+	return strings.IndexByte(s, splitter) != -1 || strings.IndexByte(s, pairSplitter) != -1
+}
 
-	for key, value := range req.Meta {
-		copy(cur, key)
-		cur[len(key)] = pairSplitter
-		cur = cur[len(key)+1:]
+func EncodeReq(req *Request) []byte {
+	bs := make([]byte, req.HeadLength+req.BodyLength)
 
-		copy(cur, value)
-		cur[len(value)] = splitter
-		cur = cur[len(value)+1:]
+	binary.BigEndian.PutUint32(bs[:4], req.HeadLength)
+	binary.BigEndian.PutUint32(bs[4:8], req.BodyLength)
+	binary.BigEndian.PutUint32(bs[8:12], req.MessageId)
+	bs[12] = req.Version
+	bs[13] = req.Compresser
+	bs[14] = req.Serializer
+
+	if req.Version == Version2 {
+		req.encodeBinaryHead(bs[:headLength])
+	} else {
+		req.encodeTextHead(bs[:headLength])
 	}
 	if req.BodyLength > 0 {
 		// 剩下的数据
-		copy(cur, req.Data)
+		copy(bs[req.HeadLength:], req.Data)
 	}
 	return bs
 }
 
-func DecodeReq(data []byte) *Request {
+// encodeTextHead 按照 Version1 的格式写入头部不定长的部分
+func (req *Request) encodeTextHead(cur []byte) {
+	// 容量足够，append 不会重新分配
+	cur = append(cur, req.ServiceName...)
+	cur = append(cur, splitter)
+
+	cur = append(cur, req.MethodName...)
+	cur = append(cur, splitter)
+
+	for key, value := range req.Meta {
+		cur = append(cur, key...)
+		cur = append(cur, pairSplitter)
+		cur = append(cur, value...)
+		cur = append(cur, splitter)
+	}
+}
+
+// DecodeReq 还原请求，data 不合法的时候返回 ErrInvalidMessage
+// 返回的 Data 引用的是 data 里面的数据
+func DecodeReq(data []byte) (*Request, error) {
 	req := &Request{}
-	req.HeadLength = binary.BigEndian.Uint32(data[:4])
-	req.HeadLength = binary.BigEndian.Uint32(data[:4])
-	req.BodyLength = binary.BigEndian.Uint32(data[4:8])
+	if err := decodeHeader(data, &req.HeadLength, &req.BodyLength); err != nil {
+		return nil, err
+	}
 	req.MessageId = binary.BigEndian.Uint32(data[8:12])
 	req.Version = data[12]
 	req.Compresser = data[13]
 	req.Serializer = data[14]
-	meta := data[15:req.HeadLength]
 
+	var err error
+	switch req.Version {
+	case 0, Version1:
+		err = req.decodeTextHead(data[headLength:req.HeadLength])
+	case Version2:
+		err = req.decodeBinaryHead(data[headLength:req.HeadLength])
+	default:
+		err = fmt.Errorf("%w: %d", ErrUnknownVersion, req.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.BodyLength > 0 {
+		// 剩下的就是数据了
+		req.Data = data[req.HeadLength:]
+	}
+	return req, nil
+}
+
+// decodeTextHead 按照 Version1 的格式解析头部不定长的部分
+func (req *Request) decodeTextHead(meta []byte) error {
 	index := bytes.IndexByte(meta, splitter)
+	if index == -1 {
+		return fmt.Errorf("%w: 缺少服务名", ErrInvalidMessage)
+	}
 	req.ServiceName = string(meta[:index])
 	meta = meta[index+1:]
 
 	index = bytes.IndexByte(meta, splitter)
+	if index == -1 {
+		return fmt.Errorf("%w: 缺少方法名", ErrInvalidMessage)
+	}
 	req.MethodName = string(meta[:index])
 	meta = meta[index+1:]
 
@@ -119,24 +218,22 @@ func DecodeReq(data []byte) *Request {
 		// 这个地方不好预估容量，但是大部分都很少，我们把现在能够想到的元数据都算法
 		// 也就不超过四个
 		metaMap := make(map[string]string, 4)
-		// 第一对键值对出现的下标
-		index = bytes.IndexByte(meta, splitter)
-		for index != -1 {
+		for len(meta) > 0 {
+			index = bytes.IndexByte(meta, splitter)
+			if index == -1 {
+				return fmt.Errorf("%w: 元数据缺少结尾的分隔符", ErrInvalidMessage)
+			}
 			pair := meta[:index]
 			pairIndex := bytes.IndexByte(pair, pairSplitter)
+			if pairIndex == -1 {
+				return fmt.Errorf("%w: 元数据缺少键值分隔符", ErrInvalidMessage)
+			}
 			metaMap[string(pair[:pairIndex])] = string(pair[pairIndex+1:])
-
 			meta = meta[index+1:]
-			index = bytes.IndexByte(meta, splitter)
 		}
 		req.Meta = metaMap
 	}
-
-	if req.BodyLength > 0 {
-		// 剩下的就是数据了
-		req.Data = data[req.HeadLength:]
-	}
-	return req
+	return nil
 }
 
 type Response struct {
@@ -153,6 +250,8 @@ type Response struct {
 	Compresser uint8
 	// 序列化方法
 	Serializer uint8
+	// 标志位，只有 Version2 的消息才有
+	Flags uint8
 
 	Error []byte
 
@@ -171,10 +270,12 @@ func EncodeResp(resp *Response) []byte {
 	cur[14] = resp.Serializer
 	cur = cur[15:]
 
-	if resp.HeadLength > 15 {
-		copy(cur, resp.Error)
-		cur = cur[len(resp.Error):]
+	if resp.Version == Version2 {
+		cur[0] = resp.Flags
+		cur = cur[1:]
 	}
+	copy(cur, resp.Error)
+	cur = cur[len(resp.Error):]
 
 	if resp.BodyLength > 0 {
 		// 剩下的数据
@@ -184,30 +285,47 @@ func EncodeResp(resp *Response) []byte {
 	return bs
 }
 
-func DecodeResp(data []byte) *Response {
+// DecodeResp 还原响应，data 不合法的时候返回 ErrInvalidMessage
+func DecodeResp(data []byte) (*Response, error) {
 	resp := &Response{}
-	resp.HeadLength = binary.BigEndian.Uint32(data[:4])
-	resp.HeadLength = binary.BigEndian.Uint32(data[:4])
-	resp.BodyLength = binary.BigEndian.Uint32(data[4:8])
+	if err := decodeHeader(data, &resp.HeadLength, &resp.BodyLength); err != nil {
+		return nil, err
+	}
 	resp.MessageId = binary.BigEndian.Uint32(data[8:12])
 	resp.Version = data[12]
 	resp.Compresser = data[13]
 	resp.Serializer = data[14]
 
-	if resp.HeadLength > 15 {
-		resp.Error = data[15:resp.HeadLength]
+	errStart := uint32(headLength)
+	switch resp.Version {
+	case 0, Version1:
+	case Version2:
+		if resp.HeadLength == headLength {
+			return nil, fmt.Errorf("%w: 缺少标志位", ErrInvalidMessage)
+		}
+		resp.Flags = data[headLength]
+		errStart++
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVersion, resp.Version)
+	}
+	if resp.HeadLength > errStart {
+		resp.Error = data[errStart:resp.HeadLength]
 	}
 
 	if resp.BodyLength > 0 {
 		// 剩下的就是数据了
 		resp.Data = data[resp.HeadLength:]
 	}
-	return resp
+	return resp, nil
 }
 
 func (r *Response) SetHeadLength() {
 	// uint32 => 4个字节
-	res := 15
+	res := headLength
+	if r.Version == Version2 {
+		// 标志位
+		res++
+	}
 	res += len(r.Error)
 	r.HeadLength = uint32(res)
 }
@@ -215,3 +333,104 @@ func (r *Response) SetHeadLength() {
 func (r *Response) SetBodyLength() {
 	r.BodyLength = uint32(len(r.Data))
 }
+
+// decodeHeader 解析并且校验两个长度字段，校验通过之后可以放心地读取固定头部
+func decodeHeader(data []byte, head, body *uint32) error {
+	if len(data) < headLength {
+		return fmt.Errorf("%w: 长度 %d 小于固定头部的长度", ErrInvalidMessage, len(data))
+	}
+	*head = binary.BigEndian.Uint32(data[:4])
+	*body = binary.BigEndian.Uint32(data[4:8])
+	if *head < headLength {
+		return fmt.Errorf("%w: 头部长度 %d 小于固定头部的长度", ErrInvalidMessage, *head)
+	}
+	// 用 uint64 避免两个长度相加溢出
+	if uint64(*head)+uint64(*body) != uint64(len(data)) {
+		return fmt.Errorf("%w: 头部长度 %d 加数据长度 %d 和消息长度 %d 不一致",
+			ErrInvalidMessage, *head, *body, len(data))
+	}
+	return nil
+}
+
+// setBinaryHeadLength 计算 Version2 的头部长度
+func (req *Request) setBinaryHeadLength() {
+	// 固定头部加标志位
+	res := headLength + 1
+	res += prefixedLen(req.ServiceName)
+	res += prefixedLen(req.MethodName)
+	for key, value := range req.Meta {
+		res += prefixedLen(key)
+		res += prefixedLen(value)
+	}
+	req.HeadLength = uint32(res)
+}
+
+// encodeBinaryHead 按照 Version2 的格式写入头部不定长的部分
+func (req *Request) encodeBinaryHead(cur []byte) {
+	cur = append(cur, req.Flags)
+	cur = appendPrefixed(cur, req.ServiceName)
+	cur = appendPrefixed(cur, req.MethodName)
+	for key, value := range req.Meta {
+		cur = appendPrefixed(cur, key)
+		cur = appendPrefixed(cur, value)
+	}
+}
+
+// decodeBinaryHead 按照 Version2 的格式解析头部不定长的部分
+func (req *Request) decodeBinaryHead(head []byte) error {
+	if len(head) == 0 {
+		return fmt.Errorf("%w: 缺少标志位", ErrInvalidMessage)
+	}
+	req.Flags = head[0]
+	head = head[1:]
+
+	var err error
+	if req.ServiceName, head, err = readPrefixed(head); err != nil {
+		return fmt.Errorf("%w: 服务名 %w", ErrInvalidMessage, err)
+	}
+	if req.MethodName, head, err = readPrefixed(head); err != nil {
+		return fmt.Errorf("%w: 方法名 %w", ErrInvalidMessage, err)
+	}
+	if len(head) > 0 {
+		metaMap := make(map[string]string, 4)
+		for len(head) > 0 {
+			var key, value string
+			if key, head, err = readPrefixed(head); err != nil {
+				return fmt.Errorf("%w: 元数据的键 %w", ErrInvalidMessage, err)
+			}
+			if value, head, err = readPrefixed(head); err != nil {
+				return fmt.Errorf("%w: 元数据 %s 的值 %w", ErrInvalidMessage, key, err)
+			}
+			metaMap[key] = value
+		}
+		req.Meta = metaMap
+	}
+	return nil
+}
+
+var errBadPrefix = errors.New("长度前缀不合法")
+
+func prefixedLen(s string) int {
+	n := len(s)
+	res := n + 1
+	for n >= 0x80 {
+		n >>= 7
+		res++
+	}
+	return res
+}
+
+func appendPrefixed(dst []byte, s string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// readPrefixed 读取一个带长度前缀的字符串，返回剩下的数据
+func readPrefixed(bs []byte) (string, []byte, error) {
+	n, size := binary.Uvarint(bs)
+	if size <= 0 || n > uint64(len(bs)-size) {
+		return "", nil, errBadPrefix
+	}
+	end := size + int(n)
+	return string(bs[size:end]), bs[end:], nil
+}
@@ -2,7 +2,10 @@
 package message
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
@@ -10,12 +13,13 @@ func TestEncodeDecodeRequest(t *testing.T) {
 	testCases := []struct {
 		name string
 		req  *Request
+		// 只有 Version2 能够编码
+		v2Only bool
 	}{
 		{
 			name: "with meta",
 			req: &Request{
 				MessageId:   123,
-				Version:     12,
 				Compresser:  25,
 				Serializer:  17,
 				ServiceName: "user-service",
@@ -32,7 +36,6 @@ func TestEncodeDecodeRequest(t *testing.T) {
 			name: "no meta",
 			req: &Request{
 				MessageId:   123,
-				Version:     12,
 				Compresser:  25,
 				Serializer:  17,
 				ServiceName: "user-service",
@@ -44,7 +47,6 @@ func TestEncodeDecodeRequest(t *testing.T) {
 			name: "empty value",
 			req: &Request{
 				MessageId:   123,
-				Version:     12,
 				Compresser:  25,
 				Serializer:  17,
 				ServiceName: "user-service",
@@ -56,16 +58,53 @@ func TestEncodeDecodeRequest(t *testing.T) {
 				},
 			},
 		},
+		{
+			// Version1 的字段原样写入，反斜杠没有特殊含义
+			name: "backslash",
+			req: &Request{
+				ServiceName: "user\\service",
+				MethodName:  "GetById\\",
+				Meta: map[string]string{
+					"path": "C:\\new",
+					"sign": "\\\\",
+				},
+			},
+		},
+		{
+			name:   "separators in fields",
+			v2Only: true,
+			req: &Request{
+				MessageId:   123,
+				Compresser:  25,
+				Serializer:  17,
+				ServiceName: "user\nservice",
+				MethodName:  "Get\rById",
+				Meta: map[string]string{
+					"multi\nline": "a\r\nb",
+					"path":        "C:\\\\tmp\\",
+					"sign":        string([]byte{0, '\n', 0xff, '\r', '\\'}),
+				},
+				Data: []byte("hello\n\rworld"),
+			},
+		},
 	}
 
 	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			tc.req.SetHeadLength()
-			tc.req.SetBodyLength()
-			bs := EncodeReq(tc.req)
-			req := DecodeReq(bs)
-			assert.Equal(t, tc.req, req)
-		})
+		for _, version := range []uint8{Version1, Version2} {
+			if tc.v2Only && version != Version2 {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s v%d", tc.name, version), func(t *testing.T) {
+				want := *tc.req
+				want.Version = version
+				want.SetHeadLength()
+				want.SetBodyLength()
+				bs := EncodeReq(&want)
+				req, err := DecodeReq(bs)
+				require.NoError(t, err)
+				assert.Equal(t, &want, req)
+			})
+		}
 	}
 }
 
@@ -78,7 +117,6 @@ func TestEncodeDecodeResponse(t *testing.T) {
 			name: "with no error",
 			resp: &Response{
 				MessageId:  123,
-				Version:    12,
 				Compresser: 25,
 				Serializer: 17,
 				Data:       []byte("hello, world"),
@@ -88,7 +126,6 @@ func TestEncodeDecodeResponse(t *testing.T) {
 			name: "error",
 			resp: &Response{
 				MessageId:  123,
-				Version:    12,
 				Compresser: 25,
 				Serializer: 17,
 				Error:      []byte("123"),
@@ -98,7 +135,6 @@ func TestEncodeDecodeResponse(t *testing.T) {
 			name: "error and data",
 			resp: &Response{
 				MessageId:  123,
-				Version:    12,
 				Compresser: 25,
 				Serializer: 17,
 				Error:      []byte("123"),
@@ -107,13 +143,344 @@ func TestEncodeDecodeResponse(t *testing.T) {
 		},
 	}
 
+	for _, tc := range testCases {
+		for _, version := range []uint8{Version1, Version2} {
+			t.Run(fmt.Sprintf("%s v%d", tc.name, version), func(t *testing.T) {
+				want := *tc.resp
+				want.Version = version
+				want.SetHeadLength()
+				want.SetBodyLength()
+				bs := EncodeResp(&want)
+				resp, err := DecodeResp(bs)
+				require.NoError(t, err)
+				assert.Equal(t, &want, resp)
+			})
+		}
+	}
+}
+
+func TestDecodeReqInvalid(t *testing.T) {
+	valid := &Request{
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Meta:        map[string]string{"trace-id": "123"},
+		Data:        []byte("hello"),
+	}
+	valid.SetHeadLength()
+	valid.SetBodyLength()
+
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "shorter than fixed header",
+			data: EncodeReq(valid)[:10],
+		},
+		{
+			name: "head length too small",
+			data: withLength(EncodeReq(valid), 3, valid.BodyLength),
+		},
+		{
+			name: "head length too large",
+			data: withLength(EncodeReq(valid), 1000, valid.BodyLength),
+		},
+		{
+			name: "truncated body",
+			data: EncodeReq(valid)[:len(EncodeReq(valid))-1],
+		},
+		{
+			name: "length overflow",
+			data: withLength(EncodeReq(valid), 0xFFFFFFFF, 0xFFFFFFFF),
+		},
+		{
+			name: "no service name splitter",
+			data: rawReq("user-service", nil),
+		},
+		{
+			name: "no method name splitter",
+			data: rawReq("user-service\nGetById", nil),
+		},
+		{
+			name: "no pair splitter",
+			data: rawReq("user-service\nGetById\ntrace-id\n", nil),
+		},
+		{
+			name: "meta without trailing splitter",
+			data: rawReq("user-service\nGetById\ntrace-id\r123", nil),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeReq(tc.data)
+			assert.ErrorIs(t, err, ErrInvalidMessage)
+		})
+	}
+}
+
+func TestDecodeReqVersion2Invalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "unknown version",
+			data: rawBinaryReq(3, nil),
+		},
+		{
+			name: "no flags",
+			data: rawBinaryReq(Version2, nil),
+		},
+		{
+			name: "no service name",
+			data: rawBinaryReq(Version2, []byte{0}),
+		},
+		{
+			name: "service name too long",
+			data: rawBinaryReq(Version2, []byte{0, 20, 'a'}),
+		},
+		{
+			name: "bad length prefix",
+			data: rawBinaryReq(Version2, []byte{0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}),
+		},
+		{
+			name: "no method name",
+			data: rawBinaryReq(Version2, []byte{0, 1, 'a'}),
+		},
+		{
+			name: "meta without value",
+			data: rawBinaryReq(Version2, []byte{0, 1, 'a', 1, 'b', 1, 'k'}),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeReq(tc.data)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDecodeVersion(t *testing.T) {
+	_, err := DecodeReq(rawBinaryReq(3, []byte{0, 1, 'a', 1, 'b'}))
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+
+	// Version2 的标志位
+	req := &Request{Version: Version2, Flags: 7, ServiceName: "a", MethodName: "b"}
+	req.SetHeadLength()
+	res, err := DecodeReq(EncodeReq(req))
+	require.NoError(t, err)
+	assert.Equal(t, req, res)
+
+	resp := &Response{Version: Version2, Flags: 7}
+	resp.SetHeadLength()
+	bs := EncodeResp(resp)
+	resp2, err := DecodeResp(bs)
+	require.NoError(t, err)
+	assert.Equal(t, resp, resp2)
+
+	// 缺少标志位
+	bs[3] = headLength
+	_, err = DecodeResp(bs[:headLength])
+	assert.ErrorIs(t, err, ErrInvalidMessage)
+
+	bs[12] = 3
+	_, err = DecodeResp(bs[:headLength])
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+}
+
+func TestDecodeRespInvalid(t *testing.T) {
+	valid := &Response{Error: []byte("error"), Data: []byte("hello")}
+	valid.SetHeadLength()
+	valid.SetBodyLength()
+
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "head length too small",
+			data: withLength(EncodeResp(valid), 3, valid.BodyLength),
+		},
+		{
+			name: "body length too large",
+			data: withLength(EncodeResp(valid), valid.HeadLength, 1000),
+		},
+	}
+
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			tc.resp.SetHeadLength()
-			tc.resp.SetBodyLength()
-			bs := EncodeResp(tc.resp)
-			resp := DecodeResp(bs)
-			assert.Equal(t, tc.resp, resp)
+			_, err := DecodeResp(tc.data)
+			assert.ErrorIs(t, err, ErrInvalidMessage)
 		})
 	}
 }
+
+// Version1 和旧版本逐字节兼容，字段不转义
+func TestVersion1Raw(t *testing.T) {
+	head := "user-service\nGetById\npath\rC:\\new\\\n"
+	req, err := DecodeReq(rawReq(head, nil))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"path": "C:\\new\\"}, req.Meta)
+
+	req.SetHeadLength()
+	assert.Equal(t, rawReq(head, nil), EncodeReq(req))
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		req     *Request
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			req:  &Request{ServiceName: "a\\b", MethodName: "c", Meta: map[string]string{"k": "\\v"}},
+		},
+		{
+			name:    "service name",
+			req:     &Request{ServiceName: "a\nb", MethodName: "c"},
+			wantErr: true,
+		},
+		{
+			name:    "method name",
+			req:     &Request{Version: Version1, ServiceName: "a", MethodName: "c\r"},
+			wantErr: true,
+		},
+		{
+			name:    "meta key",
+			req:     &Request{ServiceName: "a", MethodName: "c", Meta: map[string]string{"k\r": "v"}},
+			wantErr: true,
+		},
+		{
+			name:    "meta value",
+			req:     &Request{ServiceName: "a", MethodName: "c", Meta: map[string]string{"k": "a\nb"}},
+			wantErr: true,
+		},
+		{
+			name: "version2",
+			req:  &Request{Version: Version2, ServiceName: "a\nb", MethodName: "c\r", Meta: map[string]string{"k\r": "a\nb"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.req.Validate()
+			if tc.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidField)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func FuzzDecodeReq(f *testing.F) {
+	req := &Request{
+		MessageId:   1,
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Meta:        map[string]string{"trace-id": "123", "path": "C:\\new"},
+		Data:        []byte(`{"Id":1}`),
+	}
+	req.SetHeadLength()
+	req.SetBodyLength()
+	f.Add(EncodeReq(req))
+	f.Add(rawReq("user-service", nil))
+	f.Add(rawReq("user-service\nGetById\ntrace-id\n", []byte("data")))
+	req.Version = Version2
+	req.SetHeadLength()
+	f.Add(EncodeReq(req))
+	f.Add(rawBinaryReq(Version2, []byte{0, 20, 'a'}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := DecodeReq(data)
+		if err != nil {
+			return
+		}
+		// 能够解析的数据，重新编码之后还能解析出相同的请求
+		req.SetHeadLength()
+		req.SetBodyLength()
+		res, err := DecodeReq(EncodeReq(req))
+		require.NoError(t, err)
+		assert.Equal(t, req, res)
+	})
+}
+
+func FuzzDecodeResp(f *testing.F) {
+	resp := &Response{MessageId: 1, Error: []byte("error"), Data: []byte("hello")}
+	resp.SetHeadLength()
+	resp.SetBodyLength()
+	f.Add(EncodeResp(resp))
+	f.Add(withLength(EncodeResp(resp), 3, resp.BodyLength))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resp, err := DecodeResp(data)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, data, EncodeResp(resp))
+	})
+}
+
+func FuzzEncodeDecodeReq(f *testing.F) {
+	f.Add(Version1, "user-service", "GetById", "trace-id", "123", []byte("hello"))
+	f.Add(Version1, "a\nb", "c\rd", "e\\f", "\\", []byte(nil))
+	f.Add(Version1, "a\\b", "GetById", "path", "C:\\new", []byte(nil))
+	f.Add(Version2, "a\nb", "c\rd", "e\\f", "\x00\xff", []byte(nil))
+	f.Fuzz(func(t *testing.T, version uint8, service, method, key, value string, data []byte) {
+		if version != Version2 {
+			version = Version1
+		}
+		req := &Request{
+			Version:     version,
+			ServiceName: service,
+			MethodName:  method,
+			Meta:        map[string]string{key: value},
+			Data:        data,
+		}
+		if len(data) == 0 {
+			req.Data = nil
+		}
+		if err := req.Validate(); err != nil {
+			// Version1 不能编码包含分隔符的字段
+			assert.Equal(t, Version1, version)
+			return
+		}
+		req.SetHeadLength()
+		req.SetBodyLength()
+		res, err := DecodeReq(EncodeReq(req))
+		require.NoError(t, err)
+		assert.Equal(t, req, res)
+	})
+}
+
+// withLength 修改 data 里面的两个长度字段
+func withLength(data []byte, head, body uint32) []byte {
+	res := make([]byte, len(data))
+	copy(res, data)
+	binary.BigEndian.PutUint32(res[:4], head)
+	binary.BigEndian.PutUint32(res[4:8], body)
+	return res
+}
+
+// rawReq 用原始的头部内容构造请求，不做任何转义
+func rawReq(head string, data []byte) []byte {
+	res := make([]byte, 15+len(head)+len(data))
+	binary.BigEndian.PutUint32(res[:4], uint32(15+len(head)))
+	binary.BigEndian.PutUint32(res[4:8], uint32(len(data)))
+	copy(res[15:], head)
+	copy(res[15+len(head):], data)
+	return res
+}
+
+// rawBinaryReq 用原始的头部内容构造指定版本的请求
+func rawBinaryReq(version uint8, head []byte) []byte {
+	res := rawReq(string(head), nil)
+	res[12] = version
+	return res
+}
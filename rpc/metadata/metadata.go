@@ -0,0 +1,79 @@
+package metadata
+
+import (
+	"context"
+	"strings"
+)
+
+// ReservedPrefix 框架自己使用的 key 的前缀，例如超时时间和 oneway 标记
+// 业务的元数据不能使用这个前缀，客户端发送的时候会报错，服务端也不会交给业务方法
+const ReservedPrefix = "micro-"
+
+// IsReserved 判断 key 是不是框架保留的，不区分大小写
+func IsReserved(key string) bool {
+	return len(key) >= len(ReservedPrefix) && strings.EqualFold(key[:len(ReservedPrefix)], ReservedPrefix)
+}
+
+// MD 跟随请求传递的元数据，客户端放进去的数据最终会出现在 Request.Meta 里面
+// 例如 request-id、tenant-id、鉴权的 token
+type MD map[string]string
+
+// Pairs 按照 key, value, key, value 的顺序构造 MD，多出来的最后一个 key 会被忽略
+func Pairs(kv ...string) MD {
+	md := make(MD, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+// Join 合并多个 MD，相同的 key 后面的覆盖前面的
+func Join(mds ...MD) MD {
+	res := make(MD, 4)
+	for _, md := range mds {
+		for key, val := range md {
+			res[key] = val
+		}
+	}
+	return res
+}
+
+func (md MD) Get(key string) string {
+	return md[key]
+}
+
+func (md MD) Copy() MD {
+	return Join(md)
+}
+
+type outgoingKey struct {
+}
+
+type incomingKey struct {
+}
+
+// NewOutgoingContext 返回的 ctx 发起调用的时候会把 md 带给服务端
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext 在 ctx 已有的元数据上追加键值对，不会修改 ctx 原本的元数据
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	return NewOutgoingContext(ctx, Join(md, Pairs(kv...)))
+}
+
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// NewIncomingContext 由服务端调用，把请求携带的元数据交给业务方法
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
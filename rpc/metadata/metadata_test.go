@@ -0,0 +1,60 @@
+package metadata
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPairs(t *testing.T) {
+	assert.Equal(t, MD{"a": "1", "b": "2"}, Pairs("a", "1", "b", "2", "c"))
+}
+
+func TestOutgoingContext(t *testing.T) {
+	ctx := context.Background()
+	_, ok := FromOutgoingContext(ctx)
+	assert.False(t, ok)
+
+	ctx = NewOutgoingContext(ctx, Pairs("request-id", "123"))
+	appended := AppendToOutgoingContext(ctx, "tenant-id", "abc", "request-id", "456")
+
+	md, ok := FromOutgoingContext(ctx)
+	assert.True(t, ok)
+	// 追加的时候不会修改原本的元数据
+	assert.Equal(t, MD{"request-id": "123"}, md)
+	md, ok = FromOutgoingContext(appended)
+	assert.True(t, ok)
+	assert.Equal(t, MD{"request-id": "456", "tenant-id": "abc"}, md)
+
+	// 出站和入站的元数据互不影响
+	_, ok = FromIncomingContext(appended)
+	assert.False(t, ok)
+}
+
+func TestIncomingContext(t *testing.T) {
+	ctx := NewIncomingContext(context.Background(), MD{"token": "abc"})
+	md, ok := FromIncomingContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "abc", md.Get("token"))
+	assert.Equal(t, "", md.Get("tenant-id"))
+}
+
+func TestIsReserved(t *testing.T) {
+	testCases := []struct {
+		key  string
+		want bool
+	}{
+		{key: "micro-timeout", want: true},
+		{key: "Micro-One-Way", want: true},
+		{key: "micro-", want: true},
+		{key: "micro", want: false},
+		{key: "one-way", want: false},
+		{key: "request-id", want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			assert.Equal(t, tc.want, IsReserved(tc.key))
+		})
+	}
+}
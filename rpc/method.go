@@ -0,0 +1,229 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/serialize"
+	"geek_micro/rpc/status"
+	"reflect"
+	"slices"
+)
+
+// MethodHandler 不经过反射直接调用业务方法
+// dec 把请求数据反序列化到传入的指针里面，返回的响应会用同一个序列化协议编码，为 nil 的时候没有数据
+type MethodHandler func(ctx context.Context, dec func(req any) error) (any, error)
+
+// HandlerService 由生成的代码实现，Handlers 返回方法名到 MethodHandler 的映射
+// 注册的时候调用一次，没有出现在里面的方法（例如流式方法）仍然通过反射调用
+// 每个 MethodHandler 都不能为 nil，并且要对应一个签名正确的一元方法，否则注册失败
+type HandlerService interface {
+	Service
+	Handlers() map[string]MethodHandler
+}
+
+// UnaryHandler 把 func(ctx context.Context, req *Req) (*Resp, error) 形式的方法包装成 MethodHandler
+func UnaryHandler[Req any, Resp any](fn func(ctx context.Context, req *Req) (*Resp, error)) MethodHandler {
+	return func(ctx context.Context, dec func(req any) error) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		resp, err := fn(ctx, req)
+		if resp == nil {
+			// 不能把 (*Resp)(nil) 当成 any 返回，否则判断不出来没有响应
+			return nil, err
+		}
+		return resp, err
+	}
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// isUnaryFunc 判断是不是 func(ctx context.Context, req *Req) (*Resp, error)
+// 服务端的方法（已经绑定了接收者）和客户端的字段都是这个形式
+func isUnaryFunc(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Func && !typ.IsVariadic() &&
+		typ.NumIn() == 2 && typ.In(0) == contextType && typ.In(1).Kind() == reflect.Pointer &&
+		typ.NumOut() == 2 && typ.Out(0).Kind() == reflect.Pointer && typ.Out(1) == errorType
+}
+
+// isStreamMethod 判断是不是服务端的 func(ctx context.Context, stream *Stream[Resp, Req]) error
+func isStreamMethod(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Func && !typ.IsVariadic() &&
+		typ.NumIn() == 2 && typ.In(0) == contextType && typ.In(1).Implements(streamBinderType) &&
+		typ.NumOut() == 1 && typ.Out(0) == errorType
+}
+
+// methodDesc 注册的时候解析好的方法，处理请求的时候不再需要 MethodByName
+type methodDesc struct {
+	// 不为 nil 的时候直接调用，不经过反射
+	handler MethodHandler
+	// 反射调用的方法，已经绑定了接收者
+	fn reflect.Value
+	// 一元方法是请求的类型，流式方法是 Stream 的类型
+	in     reflect.Type
+	stream bool
+}
+
+// serviceStub 是注册到服务端的服务，方法表在注册的时候构建
+type serviceStub struct {
+	s          Service
+	methods    map[string]*methodDesc
+	serializes map[uint8]serialize.Serialize
+}
+
+// newServiceStub 检查 service 所有导出的方法，返回所有签名不对的方法
+func newServiceStub(service Service, serializes map[uint8]serialize.Serialize) (*serviceStub, error) {
+	if service == nil {
+		return nil, errors.New("micro: 不支持 nil")
+	}
+	hs, isHandlerService := service.(HandlerService)
+	val := reflect.ValueOf(service)
+	typ := val.Type()
+	methods := make(map[string]*methodDesc, typ.NumMethod())
+	var errs []error
+	for i := 0; i < typ.NumMethod(); i++ {
+		name := typ.Method(i).Name
+		// Service 和 HandlerService 自己的方法
+		if name == "Name" || (isHandlerService && name == "Handlers") {
+			continue
+		}
+		fn := val.Method(i)
+		ft := fn.Type()
+		switch {
+		case isUnaryFunc(ft):
+			methods[name] = &methodDesc{fn: fn, in: ft.In(1).Elem()}
+		case isStreamMethod(ft):
+			methods[name] = &methodDesc{fn: fn, in: ft.In(1).Elem(), stream: true}
+		default:
+			errs = append(errs, fmt.Errorf("micro: %s 的方法 %s 的签名 %s 不支持，"+
+				"只支持 func(context.Context, *Req) (*Resp, error) 和 func(context.Context, *rpc.Stream[Resp, Req]) error",
+				service.Name(), name, ft))
+		}
+	}
+	var handlers map[string]MethodHandler
+	if isHandlerService {
+		handlers = hs.Handlers()
+		// MethodHandler 只能替换签名正确的一元方法，排序之后错误的顺序是固定的
+		names := make([]string, 0, len(handlers))
+		for name := range handlers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			method, ok := methods[name]
+			switch {
+			case handlers[name] == nil:
+				errs = append(errs, fmt.Errorf("micro: %s 的 Handlers 里面的 %s 为 nil", service.Name(), name))
+			case !ok:
+				errs = append(errs, fmt.Errorf("micro: %s 的 Handlers 里面的 %s 没有对应的方法", service.Name(), name))
+			case method.stream:
+				errs = append(errs, fmt.Errorf("micro: %s 的 Handlers 里面的 %s 是流式方法，不能使用 MethodHandler", service.Name(), name))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	for name, handler := range handlers {
+		methods[name].handler = handler
+	}
+	return &serviceStub{
+		s:          service,
+		methods:    methods,
+		serializes: serializes,
+	}, nil
+}
+
+// hasUnary 判断 methodName 是不是注册了的一元方法
+func (s *serviceStub) hasUnary(methodName string) bool {
+	method, ok := s.methods[methodName]
+	return ok && !method.stream
+}
+
+// hasStream 判断 methodName 是不是注册了的流式方法
+func (s *serviceStub) hasStream(methodName string) bool {
+	method, ok := s.methods[methodName]
+	return ok && method.stream
+}
+
+func errNotStreamMethod(methodName string) error {
+	return status.Errorf(status.Unimplemented, "micro: %s 不是流式方法", methodName)
+}
+
+func (s *serviceStub) invoke(ctx context.Context, req *message.Request) ([]byte, error) {
+	method, ok := s.methods[req.MethodName]
+	if !ok || method.stream {
+		return nil, errMethodNotFound
+	}
+	serializer, ok := s.serializes[req.Serializer]
+	if !ok {
+		return nil, errUnsupportedSerializer
+	}
+
+	var resp any
+	var err error
+	if method.handler != nil {
+		resp, err = method.handler(ctx, func(in any) error {
+			return decodeReq(serializer, req.Data, in)
+		})
+	} else {
+		resp, err = method.call(ctx, serializer, req.Data)
+	}
+	if resp == nil {
+		return nil, err
+	}
+	res, er := serializer.Encode(resp)
+	if er != nil {
+		return nil, status.Errorf(status.Internal, "micro: 序列化响应数据失败 %v", er)
+	}
+	return res, err
+}
+
+// call 通过反射调用 func(ctx context.Context, req *Req) (*Resp, error)
+func (m *methodDesc) call(ctx context.Context, serializer serialize.Serialize, data []byte) (any, error) {
+	inReq := reflect.New(m.in)
+	if err := decodeReq(serializer, data, inReq.Interface()); err != nil {
+		return nil, err
+	}
+	result := m.fn.Call([]reflect.Value{reflect.ValueOf(ctx), inReq})
+	var err error
+	if e := result[1].Interface(); e != nil {
+		err = e.(error)
+	}
+	if result[0].IsNil() {
+		return nil, err
+	}
+	return result[0].Interface(), err
+}
+
+func decodeReq(serializer serialize.Serialize, data []byte, req any) error {
+	if err := serializer.Decode(data, req); err != nil {
+		return status.Errorf(status.InvalidArgument, "micro: 反序列化请求数据失败 %v", err)
+	}
+	return nil
+}
+
+// invokeStream 调用 func(ctx context.Context, stream *Stream[Resp, Req]) error 形式的方法
+func (s *serviceStub) invokeStream(ctx context.Context, methodName string, serializerCode uint8, raw RawStream) error {
+	method, ok := s.methods[methodName]
+	if !ok || !method.stream {
+		return errNotStreamMethod(methodName)
+	}
+	serializer, ok := s.serializes[serializerCode]
+	if !ok {
+		return errUnsupportedSerializer
+	}
+	stream := reflect.New(method.in)
+	stream.Interface().(streamBinder).bind(raw, serializer)
+	result := method.fn.Call([]reflect.Value{reflect.ValueOf(ctx), stream})
+	if err := result[0].Interface(); err != nil {
+		return err.(error)
+	}
+	return nil
+}
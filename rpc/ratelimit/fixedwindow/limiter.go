@@ -0,0 +1,62 @@
+package fixedwindow
+
+import (
+	"geek_micro/rpc/ratelimit"
+	"sync"
+	"time"
+)
+
+// Limiter 固定窗口，每个窗口内最多放行 limit 个请求
+// 实现简单，但是两个窗口交界的地方可能放行两倍的请求
+type Limiter struct {
+	window time.Duration
+	limit  int
+
+	lock sync.Mutex
+	// 当前窗口的开始时间
+	start time.Time
+	cnt   int
+}
+
+func (l *Limiter) Reserve() (time.Duration, func(), bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if now.Sub(l.start) >= l.window {
+		l.start = now
+		l.cnt = 0
+	}
+	if l.cnt >= l.limit {
+		return 0, nil, false
+	}
+	l.cnt++
+	start := l.start
+	return 0, func() {
+		l.lock.Lock()
+		// 已经到了下一个窗口的时候不用还
+		if l.start.Equal(start) {
+			l.cnt--
+		}
+		l.lock.Unlock()
+	}, true
+}
+
+type Builder struct {
+	// 窗口的长度，必须大于 0
+	Window time.Duration
+	// 每个窗口内最多放行的请求个数，必须大于 0
+	Limit int
+}
+
+func (b *Builder) Build() (ratelimit.Limiter, error) {
+	if b.Window <= 0 {
+		return nil, ratelimit.ErrInvalidWindow
+	}
+	if b.Limit <= 0 {
+		return nil, ratelimit.ErrInvalidLimit
+	}
+	return &Limiter{
+		window: b.Window,
+		limit:  b.Limit,
+	}, nil
+}
@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"geek_micro/rpc"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+	"sync"
+	"time"
+)
+
+// ErrLimited 被限流的请求返回这个错误，不会调用业务方法
+var ErrLimited = status.New(status.ResourceExhausted, "micro: 请求太多，触发了限流")
+
+// Rule 一条限流规则，请求需要通过所有匹配的规则
+// 只有所有的规则都放行的时候才会占用名额，被其中一条规则拒绝的请求不会消耗其它规则的名额
+type Rule struct {
+	// 为空的时候匹配所有的服务
+	ServiceName string
+	// 为空的时候匹配服务的所有方法
+	MethodName string
+	// 不为空的时候按照 Request.Meta 中这个键的值分别限流，例如调用方的身份
+	// 没有这个键的请求共用一个 Limiter
+	MetaKey string
+	// 最多保存多少个 key 的 Limiter，超过之后淘汰最久没有用过的，默认是 10000
+	// 服务名和方法名只会是注册了的，MetaKey 的值由客户端决定，不限制的话内存会被撑大
+	MaxKeys int
+	Builder Builder
+}
+
+func (r *Rule) match(req *message.Request) bool {
+	return (r.ServiceName == "" || r.ServiceName == req.ServiceName) &&
+		(r.MethodName == "" || r.MethodName == req.MethodName)
+}
+
+// limiters 一条规则下每个 key 一个 Limiter，按照最近使用的顺序淘汰
+type limiters struct {
+	rule Rule
+
+	lock sync.Mutex
+	// key 是服务名、方法名和 MetaKey 的值
+	limiters map[key]*list.Element
+	// 最近用过的在前面，元素是 *entry
+	lru *list.List
+}
+
+type key struct {
+	serviceName string
+	methodName  string
+	caller      string
+}
+
+type entry struct {
+	key     key
+	limiter Limiter
+}
+
+func (l *limiters) get(req *message.Request) (Limiter, error) {
+	k := key{}
+	// 规则没有指定的时候，每个服务（方法）单独限流
+	if l.rule.ServiceName == "" {
+		k.serviceName = req.ServiceName
+	}
+	if l.rule.MethodName == "" {
+		k.methodName = req.MethodName
+	}
+	if l.rule.MetaKey != "" {
+		k.caller = req.Meta[l.rule.MetaKey]
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if elem, ok := l.limiters[k]; ok {
+		l.lru.MoveToFront(elem)
+		return elem.Value.(*entry).limiter, nil
+	}
+	limiter, err := l.rule.Builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	if l.lru.Len() >= l.rule.MaxKeys {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.limiters, oldest.Value.(*entry).key)
+	}
+	l.limiters[k] = l.lru.PushFront(&entry{key: k, limiter: limiter})
+	return limiter, nil
+}
+
+// RateLimiter 按照规则限流，一元调用和流共用同一份名额
+type RateLimiter struct {
+	limiters []*limiters
+}
+
+// New 按照 rules 创建限流器，规则的配置不合法的时候返回错误
+func New(rules ...Rule) (*RateLimiter, error) {
+	ls := make([]*limiters, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Builder == nil {
+			return nil, fmt.Errorf("micro: 第 %d 条限流规则没有 Builder", i)
+		}
+		// 提前检查配置，处理请求的时候再发现就晚了
+		if _, err := rule.Builder.Build(); err != nil {
+			return nil, fmt.Errorf("micro: 第 %d 条限流规则 %w", i, err)
+		}
+		if rule.MaxKeys <= 0 {
+			rule.MaxKeys = 10000
+		}
+		ls = append(ls, &limiters{
+			rule:     rule,
+			limiters: make(map[key]*list.Element, 16),
+			lru:      list.New(),
+		})
+	}
+	return &RateLimiter{limiters: ls}, nil
+}
+
+// Interceptor 返回一元调用的服务端拦截器，被拒绝的请求返回 ErrLimited
+func (r *RateLimiter) Interceptor() rpc.ServerInterceptor {
+	return func(ctx context.Context, req *message.Request, next rpc.Handler) (*message.Response, error) {
+		if err := r.acquire(ctx, req); err != nil {
+			return nil, err
+		}
+		return next(ctx, req)
+	}
+}
+
+// StreamInterceptor 返回流的服务端拦截器，打开一个流占用一个名额，流上的消息不限流
+// 被拒绝的流返回 ErrLimited
+func (r *RateLimiter) StreamInterceptor() rpc.StreamServerInterceptor {
+	return func(ctx context.Context, req *message.Request, next rpc.StreamHandler) error {
+		if err := r.acquire(ctx, req); err != nil {
+			return err
+		}
+		return next(ctx, req)
+	}
+}
+
+// acquire 在所有匹配的规则上预留名额，有一条规则拒绝的时候把已经预留的名额都还回去
+func (r *RateLimiter) acquire(ctx context.Context, req *message.Request) error {
+	var delay time.Duration
+	var cancels []func()
+	reject := func(err error) error {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		return err
+	}
+	for _, l := range r.limiters {
+		if !l.rule.match(req) {
+			continue
+		}
+		limiter, err := l.get(req)
+		if err != nil {
+			return reject(status.Errorf(status.Internal, "micro: 创建限流器失败 %v", err))
+		}
+		d, cancel, ok := limiter.Reserve()
+		if !ok {
+			return reject(ErrLimited)
+		}
+		cancels = append(cancels, cancel)
+		delay = max(delay, d)
+	}
+	if delay > 0 && !wait(ctx, delay) {
+		return reject(ErrLimited)
+	}
+	return nil
+}
+
+// wait 等待 delay，等到的时候调用方已经超时了就不再等待
+func wait(ctx context.Context, delay time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
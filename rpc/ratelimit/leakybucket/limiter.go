@@ -0,0 +1,63 @@
+package leakybucket
+
+import (
+	"geek_micro/rpc/ratelimit"
+	"sync"
+	"time"
+)
+
+// Limiter 漏桶，请求在桶里排队，按照固定的间隔一个一个地放行
+// 和令牌桶不同，漏桶会把突发流量削平，排队的请求超过容量的时候直接拒绝
+type Limiter struct {
+	interval time.Duration
+	// 最多排队等待的时间
+	maxWait time.Duration
+
+	lock sync.Mutex
+	// 下一个请求可以通过的时间
+	next time.Time
+}
+
+func (l *Limiter) Reserve() (time.Duration, func(), bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	if wait > l.maxWait {
+		return 0, nil, false
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	return wait, func() {
+		l.lock.Lock()
+		// 只有后面没有人排队的时候才能把位置还回去，否则后面的请求顺延
+		if l.next.Equal(at.Add(l.interval)) {
+			l.next = at
+		}
+		l.lock.Unlock()
+	}, true
+}
+
+type Builder struct {
+	// 每秒放行的请求个数，必须大于 0
+	Rate float64
+	// 最多排队的请求个数，0 表示不排队
+	Capacity int
+}
+
+func (b *Builder) Build() (ratelimit.Limiter, error) {
+	if b.Rate <= 0 {
+		return nil, ratelimit.ErrInvalidRate
+	}
+	if b.Capacity < 0 {
+		return nil, ratelimit.ErrInvalidCapacity
+	}
+	interval := time.Duration(float64(time.Second) / b.Rate)
+	return &Limiter{
+		interval: interval,
+		maxWait:  interval * time.Duration(b.Capacity),
+	}, nil
+}
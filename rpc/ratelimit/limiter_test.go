@@ -0,0 +1,291 @@
+package ratelimit_test
+
+import (
+	"context"
+	"geek_micro/rpc"
+	"geek_micro/rpc/internal/rpctest"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/ratelimit"
+	"geek_micro/rpc/ratelimit/fixedwindow"
+	"geek_micro/rpc/ratelimit/leakybucket"
+	"geek_micro/rpc/ratelimit/slidingwindow"
+	"geek_micro/rpc/ratelimit/tokenbucket"
+	"geek_micro/rpc/status"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	l := build(t, &tokenbucket.Builder{Rate: 10, Burst: 3})
+	// 一开始桶是满的
+	assert.Equal(t, []bool{true, true, true, false}, allowN(l, 4))
+	// 100ms 放进去一个令牌
+	time.Sleep(time.Millisecond * 120)
+	_, cancel, ok := l.Reserve()
+	require.True(t, ok)
+	_, _, ok = l.Reserve()
+	assert.False(t, ok)
+	// 令牌还回去之后可以再用
+	cancel()
+	assert.Equal(t, []bool{true, false}, allowN(l, 2))
+}
+
+func TestLeakyBucket(t *testing.T) {
+	l := build(t, &leakybucket.Builder{Rate: 20, Capacity: 2})
+	// 一个直接通过，两个排队，一个被拒绝
+	var delays []time.Duration
+	var cancels []func()
+	for i := 0; i < 3; i++ {
+		delay, cancel, ok := l.Reserve()
+		require.True(t, ok)
+		delays = append(delays, delay)
+		cancels = append(cancels, cancel)
+	}
+	_, _, ok := l.Reserve()
+	assert.False(t, ok)
+	assert.Equal(t, time.Duration(0), delays[0])
+	assert.InDelta(t, time.Millisecond*50, delays[1], float64(time.Millisecond*10))
+	assert.InDelta(t, time.Millisecond*100, delays[2], float64(time.Millisecond*10))
+
+	// 后面有人排队的位置还不回去
+	cancels[1]()
+	_, _, ok = l.Reserve()
+	assert.False(t, ok)
+	// 最后一个位置可以还回去
+	cancels[2]()
+	delay, _, ok := l.Reserve()
+	assert.True(t, ok)
+	assert.InDelta(t, time.Millisecond*100, delay, float64(time.Millisecond*10))
+}
+
+func TestFixedWindow(t *testing.T) {
+	l := build(t, &fixedwindow.Builder{Window: time.Millisecond * 100, Limit: 2})
+	_, cancel, ok := l.Reserve()
+	require.True(t, ok)
+	assert.Equal(t, []bool{true, false}, allowN(l, 2))
+	cancel()
+	assert.Equal(t, []bool{true, false}, allowN(l, 2))
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, []bool{true, true, false}, allowN(l, 3))
+}
+
+func TestSlidingWindow(t *testing.T) {
+	l := build(t, &slidingwindow.Builder{Window: time.Millisecond * 100, Limit: 2})
+	assert.Equal(t, []bool{true}, allowN(l, 1))
+	time.Sleep(time.Millisecond * 60)
+	_, cancel, ok := l.Reserve()
+	require.True(t, ok)
+	cancel()
+	assert.Equal(t, []bool{true, false}, allowN(l, 2))
+	// 第一个请求滑出了窗口，第二个还在
+	time.Sleep(time.Millisecond * 60)
+	assert.Equal(t, []bool{true, false}, allowN(l, 2))
+}
+
+func TestBuilderValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		builder ratelimit.Builder
+		wantErr error
+	}{
+		{name: "token bucket rate", builder: &tokenbucket.Builder{Burst: 1}, wantErr: ratelimit.ErrInvalidRate},
+		{name: "leaky bucket rate", builder: &leakybucket.Builder{Rate: -1}, wantErr: ratelimit.ErrInvalidRate},
+		{name: "leaky bucket capacity", builder: &leakybucket.Builder{Rate: 1, Capacity: -1}, wantErr: ratelimit.ErrInvalidCapacity},
+		{name: "fixed window window", builder: &fixedwindow.Builder{Limit: 1}, wantErr: ratelimit.ErrInvalidWindow},
+		{name: "fixed window limit", builder: &fixedwindow.Builder{Window: time.Second}, wantErr: ratelimit.ErrInvalidLimit},
+		{name: "sliding window window", builder: &slidingwindow.Builder{Window: -time.Second, Limit: 1}, wantErr: ratelimit.ErrInvalidWindow},
+		{name: "sliding window limit", builder: &slidingwindow.Builder{Window: time.Second, Limit: -1}, wantErr: ratelimit.ErrInvalidLimit},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.builder.Build()
+			assert.Equal(t, tc.wantErr, err)
+			_, err = ratelimit.New(ratelimit.Rule{Builder: tc.builder})
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+	_, err := ratelimit.New(ratelimit.Rule{})
+	assert.Error(t, err)
+}
+
+func build(t *testing.T, b ratelimit.Builder) ratelimit.Limiter {
+	l, err := b.Build()
+	require.NoError(t, err)
+	return l
+}
+
+func allowN(l ratelimit.Limiter, n int) []bool {
+	res := make([]bool, 0, n)
+	for i := 0; i < n; i++ {
+		_, _, ok := l.Reserve()
+		res = append(res, ok)
+	}
+	return res
+}
+
+func TestInterceptor(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rules []ratelimit.Rule
+		calls []call
+	}{
+		{
+			name: "all rules",
+			rules: []ratelimit.Rule{
+				// 每个方法每个窗口 3 个请求
+				{
+					ServiceName: "user",
+					Builder:     &fixedwindow.Builder{Window: time.Hour, Limit: 3},
+				},
+				// 每个调用方调用 Create 每个窗口 1 个请求
+				{
+					ServiceName: "user",
+					MethodName:  "Create",
+					MetaKey:     "caller",
+					Builder:     &fixedwindow.Builder{Window: time.Hour, Limit: 1},
+				},
+			},
+			calls: []call{
+				{req: newReq("user", "Get", "")},
+				{req: newReq("user", "Get", "")},
+				{req: newReq("user", "Get", "")},
+				{req: newReq("user", "Get", ""), wantErr: ratelimit.ErrLimited},
+				{req: newReq("order", "Get", "")},
+				{req: newReq("user", "Create", "a")},
+				// 被调用方的规则拒绝了，不占用方法的限额
+				{req: newReq("user", "Create", "a"), wantErr: ratelimit.ErrLimited},
+				{req: newReq("user", "Create", "b")},
+				{req: newReq("user", "Create", "c")},
+				// 同一个方法上调用方共享的限额用完了
+				{req: newReq("user", "Create", "d"), wantErr: ratelimit.ErrLimited},
+			},
+		},
+		{
+			// 只保存最近用过的两个调用方
+			name: "max keys",
+			rules: []ratelimit.Rule{
+				{
+					MetaKey: "caller",
+					MaxKeys: 2,
+					Builder: &fixedwindow.Builder{Window: time.Hour, Limit: 1},
+				},
+			},
+			calls: []call{
+				{req: newReq("user", "Get", "a")},
+				{req: newReq("user", "Get", "b")},
+				{req: newReq("user", "Get", "a"), wantErr: ratelimit.ErrLimited},
+				// 淘汰了 b
+				{req: newReq("user", "Get", "c")},
+				// 淘汰了 a
+				{req: newReq("user", "Get", "b")},
+				{req: newReq("user", "Get", "a")},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rl, err := ratelimit.New(tc.rules...)
+			require.NoError(t, err)
+			interceptor := rl.Interceptor()
+			for i, c := range tc.calls {
+				called := false
+				_, err = interceptor(context.Background(), c.req, func(ctx context.Context, req *message.Request) (*message.Response, error) {
+					called = true
+					return &message.Response{}, nil
+				})
+				assert.Equal(t, c.wantErr, err, "第 %d 次调用", i)
+				// 被拒绝的请求不会调用业务方法
+				assert.Equal(t, c.wantErr == nil, called, "第 %d 次调用", i)
+			}
+		})
+	}
+}
+
+type call struct {
+	req     *message.Request
+	wantErr error
+}
+
+func TestInterceptorDelay(t *testing.T) {
+	rl, err := ratelimit.New(ratelimit.Rule{
+		Builder: &leakybucket.Builder{Rate: 10, Capacity: 1},
+	}, ratelimit.Rule{
+		MetaKey: "caller",
+		Builder: &fixedwindow.Builder{Window: time.Hour, Limit: 1},
+	})
+	require.NoError(t, err)
+	interceptor := rl.Interceptor()
+	next := func(ctx context.Context, req *message.Request) (*message.Response, error) {
+		return &message.Response{}, nil
+	}
+
+	_, err = interceptor(context.Background(), newReq("user", "Get", "a"), next)
+	require.NoError(t, err)
+	// 排队的时间超过了调用方的超时时间，直接拒绝，不用等到超时
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err = interceptor(ctx, newReq("user", "Get", "b"), next)
+	assert.Equal(t, ratelimit.ErrLimited, err)
+	assert.Less(t, time.Since(start), time.Millisecond*50)
+	// 被固定窗口拒绝的请求把漏桶里面排队的位置还回去了
+	_, err = interceptor(context.Background(), newReq("user", "Get", "a"), next)
+	assert.Equal(t, ratelimit.ErrLimited, err)
+
+	// 放行之前需要排队
+	_, err = interceptor(context.Background(), newReq("user", "Get", "c"), next)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*90)
+	assert.Less(t, time.Since(start), time.Millisecond*150)
+}
+
+func newReq(serviceName, methodName, caller string) *message.Request {
+	req := &message.Request{ServiceName: serviceName, MethodName: methodName}
+	if caller != "" {
+		req.Meta = map[string]string{"caller": caller}
+	}
+	return req
+}
+
+func TestInterceptorE2E(t *testing.T) {
+	var cnt atomic.Int32
+	rl, err := ratelimit.New(ratelimit.Rule{
+		ServiceName: "user",
+		Builder:     &fixedwindow.Builder{Window: time.Hour, Limit: 1},
+	})
+	require.NoError(t, err)
+	server := rpc.NewServer(rpc.ServerWithInterceptors(rl.Interceptor()),
+		rpc.ServerWithStreamInterceptors(rl.StreamInterceptor()))
+	uc := rpctest.Start(t, server, &rpctest.UserServer{
+		OnGet: func(ctx context.Context, req *rpctest.Req) (*rpctest.Resp, error) {
+			cnt.Add(1)
+			return &rpctest.Resp{}, nil
+		},
+		OnWatch: func(ctx context.Context, stream *rpc.Stream[rpctest.Resp, rpctest.Req]) error {
+			cnt.Add(1)
+			return stream.Send(&rpctest.Resp{Msg: "watch"})
+		},
+	})
+
+	_, err = uc.Get(context.Background(), &rpctest.Req{})
+	require.NoError(t, err)
+	stream, err := uc.Watch(context.Background())
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "watch", resp.Msg)
+
+	// 每个方法一个名额，流和一元调用一样被限流
+	_, err = uc.Get(context.Background(), &rpctest.Req{})
+	assert.Equal(t, status.ResourceExhausted, status.CodeOf(err))
+	stream, err = uc.Watch(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, status.ResourceExhausted, status.CodeOf(err))
+	assert.Equal(t, int32(2), cnt.Load())
+}
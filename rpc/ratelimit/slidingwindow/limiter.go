@@ -0,0 +1,70 @@
+package slidingwindow
+
+import (
+	"geek_micro/rpc/ratelimit"
+	"sync"
+	"time"
+)
+
+// Limiter 滑动窗口，任意 window 长度的时间内最多放行 limit 个请求
+// 记录了窗口内每个请求的时间，内存和 limit 成正比
+type Limiter struct {
+	window time.Duration
+	limit  int
+
+	lock sync.Mutex
+	// 窗口内放行的请求的时间，按照时间排序
+	times []time.Time
+}
+
+func (l *Limiter) Reserve() (time.Duration, func(), bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	// 去掉已经滑出窗口的请求
+	expired := 0
+	for expired < len(l.times) && now.Sub(l.times[expired]) >= l.window {
+		expired++
+	}
+	l.times = l.times[expired:]
+	if len(l.times) >= l.limit {
+		return 0, nil, false
+	}
+	l.times = append(l.times, now)
+	return 0, func() {
+		l.cancel(now)
+	}, true
+}
+
+// cancel 去掉 at 这个时间放行的请求，已经滑出窗口的不用处理
+func (l *Limiter) cancel(at time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := len(l.times) - 1; i >= 0; i-- {
+		if l.times[i].Equal(at) {
+			l.times = append(l.times[:i], l.times[i+1:]...)
+			return
+		}
+	}
+}
+
+type Builder struct {
+	// 窗口的长度，必须大于 0
+	Window time.Duration
+	// 任意一个窗口内最多放行的请求个数，必须大于 0
+	Limit int
+}
+
+func (b *Builder) Build() (ratelimit.Limiter, error) {
+	if b.Window <= 0 {
+		return nil, ratelimit.ErrInvalidWindow
+	}
+	if b.Limit <= 0 {
+		return nil, ratelimit.ErrInvalidLimit
+	}
+	return &Limiter{
+		window: b.Window,
+		limit:  b.Limit,
+		times:  make([]time.Time, 0, b.Limit),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package tokenbucket
+
+import (
+	"geek_micro/rpc/ratelimit"
+	"sync"
+	"time"
+)
+
+// Limiter 令牌桶，令牌按照固定的速率放进桶里，每个请求拿走一个
+// 桶里攒下的令牌允许短时间的突发流量
+type Limiter struct {
+	// 每秒放进去的令牌个数
+	rate  float64
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (l *Limiter) Reserve() (time.Duration, func(), bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return 0, nil, false
+	}
+	l.tokens--
+	return 0, l.cancel, true
+}
+
+// cancel 把令牌放回桶里
+func (l *Limiter) cancel() {
+	l.lock.Lock()
+	l.tokens = min(l.burst, l.tokens+1)
+	l.lock.Unlock()
+}
+
+type Builder struct {
+	// 每秒放进去的令牌个数，必须大于 0
+	Rate float64
+	// 桶的容量，也就是允许的突发请求个数，默认是 1
+	Burst int
+}
+
+func (b *Builder) Build() (ratelimit.Limiter, error) {
+	if b.Rate <= 0 {
+		return nil, ratelimit.ErrInvalidRate
+	}
+	burst := float64(max(b.Burst, 1))
+	return &Limiter{
+		rate:   b.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}, nil
+}
@@ -0,0 +1,28 @@
+package ratelimit
+
+import (
+	"errors"
+	"time"
+)
+
+// 各个 Builder 配置不合法的时候返回的错误
+var (
+	ErrInvalidRate     = errors.New("micro: 限流的速率必须大于 0")
+	ErrInvalidLimit    = errors.New("micro: 限流的请求个数必须大于 0")
+	ErrInvalidWindow   = errors.New("micro: 限流的窗口必须大于 0")
+	ErrInvalidCapacity = errors.New("micro: 排队的请求个数不能小于 0")
+)
+
+// Limiter 判断一个请求能不能通过，不能阻塞
+type Limiter interface {
+	// Reserve 为一个请求占用名额，ok 为 false 的时候没有占用任何名额
+	// delay 是请求还需要等待多久才能通过，例如在漏桶里面排队的时间
+	// 请求最终没有通过的时候（例如被其它规则拒绝了）调用 cancel 把名额还回去
+	Reserve() (delay time.Duration, cancel func(), ok bool)
+}
+
+// Builder 为每个限流的 key 创建一个 Limiter，例如每个调用方一个
+// 配置不合法的时候返回错误
+type Builder interface {
+	Build() (Limiter, error)
+}
@@ -0,0 +1,283 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"geek_micro/rpc/registry"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errRegistryClosed = errors.New("registry: 注册中心已经关闭")
+
+// Registry 把服务实例保存在一个 JSON 文件里面，通过轮询文件发现变化
+// 同一个文件可以被多个进程共享，但是写入没有跨进程的锁，
+// 不适合多个进程同时频繁注册的场景
+type Registry struct {
+	path     string
+	interval time.Duration
+
+	// 保护文件的读写
+	fileLock sync.Mutex
+
+	lock        sync.Mutex
+	subscribers map[string][]chan registry.Event
+	// 每个被订阅的服务上一次轮询时看到的实例，key 是地址
+	snapshots map[string]map[string]registry.ServiceInstance
+	watching  bool
+	closed    bool
+	close     chan struct{}
+}
+
+type Option func(r *Registry)
+
+// WithPollInterval 设置检查文件变化的间隔，默认是一秒
+func WithPollInterval(interval time.Duration) Option {
+	return func(r *Registry) {
+		r.interval = interval
+	}
+}
+
+func NewRegistry(path string, opts ...Option) (*Registry, error) {
+	res := &Registry{
+		path:        path,
+		interval:    time.Second,
+		subscribers: make(map[string][]chan registry.Event, 8),
+		snapshots:   make(map[string]map[string]registry.ServiceInstance, 8),
+		close:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	// 文件不存在的时候先创建一个空的
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err = res.save(map[string][]registry.ServiceInstance{}); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (r *Registry) Register(ctx context.Context, si registry.ServiceInstance) error {
+	if r.isClosed() {
+		return errRegistryClosed
+	}
+	return r.update(func(services map[string][]registry.ServiceInstance) {
+		instances := services[si.Name]
+		for i, ins := range instances {
+			if ins.Address == si.Address {
+				instances[i] = si
+				return
+			}
+		}
+		services[si.Name] = append(instances, si)
+	})
+}
+
+func (r *Registry) Unregister(ctx context.Context, si registry.ServiceInstance) error {
+	if r.isClosed() {
+		return errRegistryClosed
+	}
+	return r.update(func(services map[string][]registry.ServiceInstance) {
+		instances := services[si.Name]
+		for i, ins := range instances {
+			if ins.Address == si.Address {
+				services[si.Name] = append(instances[:i:i], instances[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+func (r *Registry) ListServices(ctx context.Context, serviceName string) ([]registry.ServiceInstance, error) {
+	if r.isClosed() {
+		return nil, errRegistryClosed
+	}
+	r.fileLock.Lock()
+	defer r.fileLock.Unlock()
+	services, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return services[serviceName], nil
+}
+
+func (r *Registry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	// 先拿到当前的实例，之后的变化才会被当做事件
+	instances, err := r.ListServices(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil, errRegistryClosed
+	}
+	if _, ok := r.snapshots[serviceName]; !ok {
+		r.snapshots[serviceName] = toSnapshot(instances)
+	}
+	ch := make(chan registry.Event, 16)
+	r.subscribers[serviceName] = append(r.subscribers[serviceName], ch)
+	if !r.watching {
+		r.watching = true
+		go r.watch()
+	}
+	context.AfterFunc(ctx, func() {
+		r.unsubscribe(serviceName, ch)
+	})
+	return ch, nil
+}
+
+func (r *Registry) unsubscribe(serviceName string, ch chan registry.Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// 关闭的时候已经关掉了所有的 channel
+	if r.closed {
+		return
+	}
+	chs := r.subscribers[serviceName]
+	for i, c := range chs {
+		if c == ch {
+			close(ch)
+			if len(chs) == 1 {
+				// 没有订阅方的服务不需要再比较变化
+				delete(r.subscribers, serviceName)
+				delete(r.snapshots, serviceName)
+			} else {
+				r.subscribers[serviceName] = append(chs[:i:i], chs[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+func (r *Registry) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.close)
+	for _, chs := range r.subscribers {
+		for _, ch := range chs {
+			close(ch)
+		}
+	}
+	r.subscribers = nil
+	return nil
+}
+
+func (r *Registry) watch() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+		}
+		r.fileLock.Lock()
+		services, err := r.load()
+		r.fileLock.Unlock()
+		if err != nil {
+			// 文件可能正在被替换，下一轮再检查
+			continue
+		}
+		r.lock.Lock()
+		if r.closed {
+			r.lock.Unlock()
+			return
+		}
+		for name, old := range r.snapshots {
+			current := toSnapshot(services[name])
+			for addr, ins := range current {
+				if oldIns, ok := old[addr]; !ok || oldIns != ins {
+					r.notify(registry.Event{Type: registry.EventTypeAdd, Instance: ins})
+				}
+			}
+			for addr, ins := range old {
+				if _, ok := current[addr]; !ok {
+					r.notify(registry.Event{Type: registry.EventTypeDelete, Instance: ins})
+				}
+			}
+			r.snapshots[name] = current
+		}
+		r.lock.Unlock()
+	}
+}
+
+// notify 必须在持有 lock 的时候调用
+func (r *Registry) notify(event registry.Event) {
+	for _, ch := range r.subscribers[event.Instance.Name] {
+		select {
+		case ch <- event:
+		default:
+			// 订阅方还有没处理完的事件，它处理的时候会拿到最新的实例列表
+		}
+	}
+}
+
+func (r *Registry) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+func (r *Registry) update(fn func(services map[string][]registry.ServiceInstance)) error {
+	r.fileLock.Lock()
+	defer r.fileLock.Unlock()
+	services, err := r.load()
+	if err != nil {
+		return err
+	}
+	fn(services)
+	return r.save(services)
+}
+
+func (r *Registry) load() (map[string][]registry.ServiceInstance, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string][]registry.ServiceInstance, 8)
+	if len(data) == 0 {
+		return services, nil
+	}
+	err = json.Unmarshal(data, &services)
+	return services, err
+}
+
+// save 先写临时文件再重命名，读的一方不会看到写了一半的文件
+func (r *Registry) save(services map[string][]registry.ServiceInstance) error {
+	data, err := json.MarshalIndent(services, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+func toSnapshot(instances []registry.ServiceInstance) map[string]registry.ServiceInstance {
+	res := make(map[string]registry.ServiceInstance, len(instances))
+	for _, ins := range instances {
+		res[ins.Address] = ins
+	}
+	return res
+}
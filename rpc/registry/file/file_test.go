@@ -0,0 +1,80 @@
+package file
+
+import (
+	"context"
+	"geek_micro/rpc/registry"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	ctx := context.Background()
+	// 模拟两个进程共享同一个文件
+	server, err := NewRegistry(path)
+	require.NoError(t, err)
+	client, err := NewRegistry(path, WithPollInterval(time.Millisecond*10))
+	require.NoError(t, err)
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+
+	ch, err := client.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+
+	si1 := registry.ServiceInstance{Name: "user-service", Address: "127.0.0.1:8081"}
+	si2 := registry.ServiceInstance{Name: "user-service", Address: "127.0.0.1:8082"}
+	require.NoError(t, server.Register(ctx, si1))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeAdd, Instance: si1}, waitEvent(t, ch))
+	require.NoError(t, server.Register(ctx, si2))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeAdd, Instance: si2}, waitEvent(t, ch))
+
+	instances, err := client.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{si1, si2}, instances)
+
+	require.NoError(t, server.Unregister(ctx, si1))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeDelete, Instance: si1}, waitEvent(t, ch))
+	instances, err = client.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{si2}, instances)
+
+	require.NoError(t, client.Close())
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	r, err := NewRegistry(filepath.Join(t.TempDir(), "registry.json"), WithPollInterval(time.Millisecond*10))
+	require.NoError(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+	// 没有订阅方的服务不再比较变化
+	r.lock.Lock()
+	assert.Empty(t, r.subscribers)
+	assert.Empty(t, r.snapshots)
+	r.lock.Unlock()
+}
+
+func waitEvent(t *testing.T, ch <-chan registry.Event) registry.Event {
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("没有收到事件")
+		return registry.Event{}
+	}
+}
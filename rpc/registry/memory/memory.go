@@ -0,0 +1,136 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"geek_micro/rpc/registry"
+	"sync"
+)
+
+var errRegistryClosed = errors.New("registry: 注册中心已经关闭")
+
+// Registry 基于内存的注册中心，只能在同一个进程内使用，一般用于测试
+type Registry struct {
+	lock        sync.RWMutex
+	services    map[string][]registry.ServiceInstance
+	subscribers map[string][]chan registry.Event
+	closed      bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		services:    make(map[string][]registry.ServiceInstance, 8),
+		subscribers: make(map[string][]chan registry.Event, 8),
+	}
+}
+
+func (r *Registry) Register(ctx context.Context, si registry.ServiceInstance) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return errRegistryClosed
+	}
+	instances := r.services[si.Name]
+	for i, ins := range instances {
+		// 重复注册的时候更新实例信息
+		if ins.Address == si.Address {
+			instances[i] = si
+			r.notify(registry.Event{Type: registry.EventTypeAdd, Instance: si})
+			return nil
+		}
+	}
+	r.services[si.Name] = append(instances, si)
+	r.notify(registry.Event{Type: registry.EventTypeAdd, Instance: si})
+	return nil
+}
+
+func (r *Registry) Unregister(ctx context.Context, si registry.ServiceInstance) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return errRegistryClosed
+	}
+	instances := r.services[si.Name]
+	for i, ins := range instances {
+		if ins.Address == si.Address {
+			r.services[si.Name] = append(instances[:i:i], instances[i+1:]...)
+			r.notify(registry.Event{Type: registry.EventTypeDelete, Instance: ins})
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *Registry) ListServices(ctx context.Context, serviceName string) ([]registry.ServiceInstance, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.closed {
+		return nil, errRegistryClosed
+	}
+	instances := r.services[serviceName]
+	res := make([]registry.ServiceInstance, len(instances))
+	copy(res, instances)
+	return res, nil
+}
+
+func (r *Registry) Subscribe(ctx context.Context, serviceName string) (<-chan registry.Event, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil, errRegistryClosed
+	}
+	ch := make(chan registry.Event, 16)
+	r.subscribers[serviceName] = append(r.subscribers[serviceName], ch)
+	context.AfterFunc(ctx, func() {
+		r.unsubscribe(serviceName, ch)
+	})
+	return ch, nil
+}
+
+func (r *Registry) unsubscribe(serviceName string, ch chan registry.Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// 关闭的时候已经关掉了所有的 channel
+	if r.closed {
+		return
+	}
+	chs := r.subscribers[serviceName]
+	for i, c := range chs {
+		if c == ch {
+			close(ch)
+			if len(chs) == 1 {
+				delete(r.subscribers, serviceName)
+			} else {
+				r.subscribers[serviceName] = append(chs[:i:i], chs[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+func (r *Registry) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	for _, chs := range r.subscribers {
+		for _, ch := range chs {
+			close(ch)
+		}
+	}
+	r.subscribers = nil
+	return nil
+}
+
+// notify 必须在持有锁的时候调用
+func (r *Registry) notify(event registry.Event) {
+	for _, ch := range r.subscribers[event.Instance.Name] {
+		select {
+		case ch <- event:
+		default:
+			// 订阅方还有没处理完的事件，它处理的时候会拿到最新的实例列表
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"context"
+	"geek_micro/rpc/registry"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	ctx := context.Background()
+	ch, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+
+	si1 := registry.ServiceInstance{Name: "user-service", Address: "127.0.0.1:8081"}
+	si2 := registry.ServiceInstance{Name: "user-service", Address: "127.0.0.1:8082"}
+	require.NoError(t, r.Register(ctx, si1))
+	require.NoError(t, r.Register(ctx, si2))
+	// 其它服务的变化不会通知过来
+	require.NoError(t, r.Register(ctx, registry.ServiceInstance{Name: "order-service", Address: "127.0.0.1:8083"}))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeAdd, Instance: si1}, <-ch)
+	assert.Equal(t, registry.Event{Type: registry.EventTypeAdd, Instance: si2}, <-ch)
+
+	instances, err := r.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{si1, si2}, instances)
+
+	require.NoError(t, r.Unregister(ctx, si1))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeDelete, Instance: si1}, <-ch)
+	instances, err = r.ListServices(ctx, "user-service")
+	require.NoError(t, err)
+	assert.Equal(t, []registry.ServiceInstance{si2}, instances)
+
+	require.NoError(t, r.Close())
+	_, ok := <-ch
+	assert.False(t, ok)
+	_, err = r.ListServices(ctx, "user-service")
+	assert.Equal(t, errRegistryClosed, err)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	r := NewRegistry()
+	defer func() {
+		_ = r.Close()
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := r.Subscribe(ctx, "user-service")
+	require.NoError(t, err)
+	other, err := r.Subscribe(context.Background(), "user-service")
+	require.NoError(t, err)
+
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+	r.lock.RLock()
+	assert.Len(t, r.subscribers["user-service"], 1)
+	r.lock.RUnlock()
+
+	// 其它订阅方不受影响
+	si := registry.ServiceInstance{Name: "user-service", Address: "127.0.0.1:8081"}
+	require.NoError(t, r.Register(context.Background(), si))
+	assert.Equal(t, registry.Event{Type: registry.EventTypeAdd, Instance: si}, <-other)
+}
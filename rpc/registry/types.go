@@ -0,0 +1,44 @@
+package registry
+
+import (
+	"context"
+	"io"
+)
+
+// Registry 注册中心
+// 服务端启动的时候注册自身，关闭的时候注销
+// 客户端通过服务名拿到可用的实例，并且订阅实例的变化
+type Registry interface {
+	Register(ctx context.Context, si ServiceInstance) error
+	Unregister(ctx context.Context, si ServiceInstance) error
+
+	ListServices(ctx context.Context, serviceName string) ([]ServiceInstance, error)
+	// Subscribe 订阅服务实例的变化，ctx 被取消之后取消订阅并且关闭返回的 channel
+	// Registry 关闭之后返回的 channel 也会被关闭
+	// 事件可能会被合并，订阅方收到事件之后应该重新调用 ListServices 获取最新的实例
+	Subscribe(ctx context.Context, serviceName string) (<-chan Event, error)
+
+	io.Closer
+}
+
+type ServiceInstance struct {
+	// 服务名，例如 user-service
+	Name string
+	// 客户端连接使用的地址，例如 127.0.0.1:8081
+	Address string
+	// 权重，加权轮询的时候使用，0 当做 1 处理
+	Weight uint32
+}
+
+type EventType int
+
+const (
+	EventTypeUnknown EventType = iota
+	EventTypeAdd
+	EventTypeDelete
+)
+
+type Event struct {
+	Type     EventType
+	Instance ServiceInstance
+}
@@ -0,0 +1,186 @@
+package rpc
+
+import (
+	"context"
+	"geek_micro/rpc/loadbalance"
+	"geek_micro/rpc/registry"
+	"net"
+	"sync"
+	"time"
+)
+
+// resolver 维护一个服务的可用实例，实例变化的时候由注册中心通知
+// 开启了健康检查的时候，检查失败的实例会被暂时摘掉，恢复之后再加回来
+type resolver struct {
+	name     string
+	registry registry.Registry
+	builder  loadbalance.Builder
+	// 注册中心通知实例变化并且刷新之后调用
+	onChange func()
+
+	lock      sync.RWMutex
+	instances []registry.ServiceInstance
+	// 健康检查失败的实例，key 是地址
+	unhealthy map[string]struct{}
+	// 只包含健康的实例
+	balancer loadbalance.Balancer
+}
+
+func newResolver(name string, r registry.Registry, builder loadbalance.Builder,
+	hc *healthCheck, onChange func(), done <-chan struct{}) (*resolver, error) {
+	// 先订阅再拉取，避免漏掉两者之间发生的变化
+	// 客户端关闭的时候取消订阅，注册中心不会一直保留这个订阅方
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := r.Subscribe(ctx, name)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res := &resolver{
+		name:      name,
+		registry:  r,
+		builder:   builder,
+		onChange:  onChange,
+		unhealthy: make(map[string]struct{}, 4),
+	}
+	if err = res.refresh(); err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		defer cancel()
+		res.watch(events, done)
+	}()
+	if hc != nil {
+		go res.checkHealth(hc, done)
+	}
+	return res, nil
+}
+
+func (r *resolver) watch(events <-chan registry.Event, done <-chan struct{}) {
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			// 事件可能会被合并，所以每次都拉取全量的实例
+			if r.refresh() == nil && r.onChange != nil {
+				r.onChange()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *resolver) refresh() error {
+	instances, err := r.registry.ListServices(context.Background(), r.name)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.instances = instances
+	r.rebuild()
+	r.lock.Unlock()
+	return nil
+}
+
+// list 返回注册中心里面所有的实例，包括健康检查失败的
+func (r *resolver) list() []registry.ServiceInstance {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.instances
+}
+
+func (r *resolver) pick(info loadbalance.PickInfo) (loadbalance.PickResult, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.balancer.Pick(info)
+}
+
+// markUnhealthy 连接不上的实例在下一次健康检查通过之前不会再被选中
+func (r *resolver) markUnhealthy(addr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.unhealthy[addr]; ok {
+		return
+	}
+	r.unhealthy[addr] = struct{}{}
+	r.rebuild()
+}
+
+func (r *resolver) checkHealth(hc *healthCheck, done <-chan struct{}) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		r.lock.RLock()
+		instances := r.instances
+		r.lock.RUnlock()
+
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		unhealthy := make(map[string]struct{}, len(instances))
+		for _, ins := range instances {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				if err := hc.check(addr); err != nil {
+					lock.Lock()
+					unhealthy[addr] = struct{}{}
+					lock.Unlock()
+				}
+			}(ins.Address)
+		}
+		wg.Wait()
+
+		r.lock.Lock()
+		if !sameKeys(unhealthy, r.unhealthy) {
+			r.unhealthy = unhealthy
+			r.rebuild()
+		}
+		r.lock.Unlock()
+	}
+}
+
+// rebuild 必须在持有写锁的时候调用
+func (r *resolver) rebuild() {
+	healthy := make([]registry.ServiceInstance, 0, len(r.instances))
+	for _, ins := range r.instances {
+		if _, ok := r.unhealthy[ins.Address]; !ok {
+			healthy = append(healthy, ins)
+		}
+	}
+	r.balancer = r.builder.Build(healthy)
+}
+
+type healthCheck struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// check 能够建立 TCP 连接就认为是健康的
+func (hc *healthCheck) check(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, hc.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func sameKeys(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
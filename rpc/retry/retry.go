@@ -0,0 +1,155 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"geek_micro/rpc"
+	"geek_micro/rpc/circuitbreaker"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Condition 判断一个错误能不能重试
+type Condition func(err error) bool
+
+// Network 建立连接失败、连接被断开之类的网络错误，服务端返回的错误不算
+func Network(err error) bool {
+	if _, ok := status.FromError(err); ok {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return !netErr.Timeout()
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed)
+}
+
+// Timeout 网络超时或者服务端返回的 DeadlineExceeded
+// 调用方自己的 ctx 过期之后不会再重试
+func Timeout(err error) bool {
+	return status.CodeOf(err) == status.DeadlineExceeded
+}
+
+// Codes 服务端返回了这些错误码
+func Codes(codes ...status.Code) Condition {
+	return func(err error) bool {
+		e, ok := status.FromError(err)
+		if !ok {
+			return false
+		}
+		for _, code := range codes {
+			if e.Code == code {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Policy 重试策略，零值使用默认的配置
+// 只有幂等的调用才会重试，见 rpc.CtxWithIdempotent 和 rpc:"idempotent" 标签
+type Policy struct {
+	// 最多调用的次数，包括第一次，默认是 3
+	MaxAttempts int
+	// 第一次重试之前等待的时间，默认是 10ms
+	InitialBackoff time.Duration
+	// 等待时间的上限，默认是 1s
+	MaxBackoff time.Duration
+	// 每次重试等待的时间是上一次的多少倍，默认是 2
+	Multiplier float64
+	// 等待时间随机浮动的比例，取值 (0, 1]，避免大量客户端同时重试，默认是 0.2
+	// 小于 0 的时候不加随机抖动
+	Jitter float64
+	// 满足其中一个条件的错误才会重试，默认是网络错误、超时和 status.Unavailable
+	// 熔断器打开的时候冷却之前重试也没有意义，circuitbreaker.ErrOpen 不管满足什么条件都不会重试
+	RetryOn []Condition
+}
+
+// Interceptor 返回按照 p 重试的客户端拦截器
+// 等待的时间超过了 ctx 剩下的时间就不再重试，直接返回最后一次的结果
+func Interceptor(p Policy) rpc.ClientInterceptor {
+	p.setDefaults()
+	return func(ctx context.Context, req *message.Request, next rpc.Invoker) (*message.Response, error) {
+		if !rpc.IsIdempotent(ctx) {
+			return next(ctx, req)
+		}
+		for attempt := 1; ; attempt++ {
+			resp, err := next(ctx, req)
+			if attempt >= p.MaxAttempts || !p.retryable(resp, err) || !p.wait(ctx, attempt) {
+				return resp, err
+			}
+		}
+	}
+}
+
+func (p *Policy) setDefaults() {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Millisecond * 10
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Second
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	switch {
+	case p.Jitter == 0:
+		p.Jitter = 0.2
+	case p.Jitter < 0:
+		p.Jitter = 0
+	}
+	if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = []Condition{Network, Timeout, Codes(status.Unavailable)}
+	}
+}
+
+// retryable 服务端返回的错误在 resp.Error 里面，err 为 nil
+func (p *Policy) retryable(resp *message.Response, err error) bool {
+	if err == nil && resp != nil && len(resp.Error) > 0 {
+		err = status.Decode(resp.Error)
+	}
+	if err == nil || errors.Is(err, circuitbreaker.ErrOpen) {
+		return false
+	}
+	for _, cond := range p.RetryOn {
+		if cond(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// wait 等待第 attempt 次重试之前的退避时间，ctx 等不到重试的时候返回 false
+func (p *Policy) wait(ctx context.Context, attempt int) bool {
+	backoff := p.backoff(attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+		return false
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// backoff 第 attempt 次调用失败之后等待的时间，指数增长并且加上随机抖动
+func (p *Policy) backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	backoff = math.Min(backoff, float64(p.MaxBackoff))
+	backoff *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(backoff)
+}
@@ -0,0 +1,233 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"geek_micro/rpc"
+	"geek_micro/rpc/circuitbreaker"
+	"geek_micro/rpc/internal/rpctest"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInterceptor(t *testing.T) {
+	netErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	unavailable := &message.Response{Error: status.Encode(status.New(status.Unavailable, "deploying"))}
+	ok := &message.Response{Data: []byte("ok")}
+
+	testCases := []struct {
+		name   string
+		policy Policy
+		ctx    rpctest.Context
+		// 每次调用的结果，用完之后一直返回最后一个
+		results []result
+
+		wantAttempts int
+		wantResp     *message.Response
+		wantErr      error
+	}{
+		{
+			name:         "not idempotent",
+			ctx:          rpctest.Ctx(context.Background()),
+			results:      []result{{err: netErr}, {resp: ok}},
+			wantAttempts: 1,
+			wantErr:      netErr,
+		},
+		{
+			name:         "success after retry",
+			ctx:          rpctest.Ctx(idempotent),
+			results:      []result{{err: netErr}, {err: io.EOF}, {resp: ok}},
+			wantAttempts: 3,
+			wantResp:     ok,
+		},
+		{
+			name:         "max attempts",
+			policy:       Policy{MaxAttempts: 4},
+			ctx:          rpctest.Ctx(idempotent),
+			results:      []result{{err: netErr}},
+			wantAttempts: 4,
+			wantErr:      netErr,
+		},
+		{
+			// 服务端返回的错误在响应里面
+			name:         "retryable code",
+			ctx:          rpctest.Ctx(idempotent),
+			results:      []result{{resp: unavailable}, {resp: ok}},
+			wantAttempts: 2,
+			wantResp:     ok,
+		},
+		{
+			name: "not retryable code",
+			ctx:  rpctest.Ctx(idempotent),
+			results: []result{
+				{resp: &message.Response{Error: status.Encode(status.New(status.InvalidArgument, "bad"))}},
+			},
+			wantAttempts: 1,
+			wantResp:     &message.Response{Error: status.Encode(status.New(status.InvalidArgument, "bad"))},
+		},
+		{
+			// 熔断器打开的时候马上重试也没有用
+			name:         "circuit open",
+			ctx:          rpctest.Ctx(idempotent),
+			results:      []result{{err: circuitbreaker.ErrOpen}},
+			wantAttempts: 1,
+			wantErr:      circuitbreaker.ErrOpen,
+		},
+		{
+			name:         "custom conditions",
+			policy:       Policy{RetryOn: []Condition{Codes(status.ResourceExhausted)}},
+			ctx:          rpctest.Ctx(idempotent),
+			results:      []result{{err: netErr}},
+			wantAttempts: 1,
+			wantErr:      netErr,
+		},
+		{
+			// 剩下的时间不够等到下一次重试
+			name:         "deadline",
+			policy:       Policy{InitialBackoff: time.Second},
+			ctx:          rpctest.Timeout(idempotent, time.Millisecond*100),
+			results:      []result{{err: netErr}},
+			wantAttempts: 1,
+			wantErr:      netErr,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			next := func(ctx context.Context, req *message.Request) (*message.Response, error) {
+				res := tc.results[min(attempts, len(tc.results)-1)]
+				attempts++
+				return res.resp, res.err
+			}
+			ctx, cancel := tc.ctx()
+			defer cancel()
+			resp, err := Interceptor(tc.policy)(ctx, &message.Request{}, next)
+			assert.Equal(t, tc.wantAttempts, attempts)
+			assert.Equal(t, tc.wantResp, resp)
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+}
+
+type result struct {
+	resp *message.Response
+	err  error
+}
+
+var idempotent = rpc.CtxWithIdempotent(context.Background())
+
+func TestBackoff(t *testing.T) {
+	p := Policy{InitialBackoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 50}
+	p.setDefaults()
+	testCases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: time.Millisecond * 10},
+		{attempt: 2, want: time.Millisecond * 20},
+		{attempt: 3, want: time.Millisecond * 40},
+		{attempt: 4, want: time.Millisecond * 50},
+		{attempt: 10, want: time.Millisecond * 50},
+	}
+	for _, tc := range testCases {
+		for i := 0; i < 100; i++ {
+			backoff := p.backoff(tc.attempt)
+			assert.InDelta(t, tc.want, backoff, float64(tc.want)*p.Jitter)
+		}
+	}
+}
+
+func TestBackoffNoJitter(t *testing.T) {
+	p := Policy{InitialBackoff: time.Millisecond * 10, Jitter: -1}
+	p.setDefaults()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, time.Millisecond*20, p.backoff(2))
+	}
+	// 零值使用默认的抖动
+	p = Policy{}
+	p.setDefaults()
+	assert.Equal(t, 0.2, p.Jitter)
+}
+
+func TestConditions(t *testing.T) {
+	testCases := []struct {
+		name        string
+		err         error
+		wantNetwork bool
+		wantTimeout bool
+	}{
+		{
+			name:        "eof",
+			err:         io.EOF,
+			wantNetwork: true,
+		},
+		{
+			name:        "op error",
+			err:         &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			wantNetwork: true,
+		},
+		{
+			name:        "net timeout",
+			err:         os.ErrDeadlineExceeded,
+			wantTimeout: true,
+		},
+		{
+			name:        "server timeout",
+			err:         status.New(status.DeadlineExceeded, "timeout"),
+			wantTimeout: true,
+		},
+		{
+			name: "server error",
+			err:  status.New(status.Unavailable, "closing"),
+		},
+		{
+			name: "other",
+			err:  errors.New("other"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantNetwork, Network(tc.err))
+			assert.Equal(t, tc.wantTimeout, Timeout(tc.err))
+		})
+	}
+	assert.True(t, Codes(status.Unavailable, status.Aborted)(status.New(status.Aborted, "")))
+	assert.False(t, Codes(status.Unavailable)(errors.New("other")))
+}
+
+func TestRetryE2E(t *testing.T) {
+	// 前两次调用都返回 Unavailable
+	var getCnt, createCnt atomic.Int32
+	unavailable := func(cnt *atomic.Int32) func(ctx context.Context, req *rpctest.Req) (*rpctest.Resp, error) {
+		return func(ctx context.Context, req *rpctest.Req) (*rpctest.Resp, error) {
+			if cnt.Add(1) < 3 {
+				return nil, status.New(status.Unavailable, "deploying")
+			}
+			return &rpctest.Resp{Msg: "ok"}, nil
+		}
+	}
+	uc := rpctest.Start(t, rpc.NewServer(), &rpctest.UserServer{
+		OnGet:    unavailable(&getCnt),
+		OnCreate: unavailable(&createCnt),
+	}, rpc.ClientWithInterceptors(Interceptor(Policy{})))
+
+	// 标记了幂等的方法重试到成功
+	resp, err := uc.Get(context.Background(), &rpctest.Req{})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp.Msg)
+	assert.Equal(t, int32(3), getCnt.Load())
+
+	// 其它方法不重试
+	_, err = uc.Create(context.Background(), &rpctest.Req{})
+	assert.Equal(t, status.Unavailable, status.CodeOf(err))
+	assert.Equal(t, int32(1), createCnt.Load())
+}
@@ -2,28 +2,169 @@ package rpc
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"geek_micro/rpc/compress"
 	"geek_micro/rpc/message"
+	"geek_micro/rpc/metadata"
+	"geek_micro/rpc/registry"
 	"geek_micro/rpc/serialize"
 	"geek_micro/rpc/serialize/json"
+	"geek_micro/rpc/status"
+	"log"
 	"net"
-	"reflect"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
 )
 
 type Serve struct {
-	services map[string]reflectionStub
+	services map[string]*serviceStub
 	// 服务端得支持多种序列化协议
 	serializes map[uint8]serialize.Serialize
+	// 支持的压缩算法，请求头部的 Compresser 为 0 表示没有压缩
+	compressors map[uint8]compress.Compressor
+
+	// 不为 nil 的时候，启动时把所有服务注册上去，关闭时注销
+	registry registry.Registry
+	// 注册到注册中心的地址，为空的时候使用监听的地址
+	advertiseAddr string
+	// 注册到注册中心的权重
+	weight uint32
+
+	// 单个请求的最大长度
+	maxFrameSize uint32
+	// 支持的协议版本，其它版本的请求会被拒绝
+	versions []uint8
+
+	interceptors []ServerInterceptor
+	// 拦截器和业务方法组装起来的调用链
+	handler Handler
+	// 流式调用的拦截器，每个流单独组装调用链
+	streamInterceptors []StreamServerInterceptor
+
+	// 不为 nil 的时候，读到请求之后马上检查并发上限，超过的请求不会再解压和启动 goroutine
+	limiter ConcurrencyLimiter
+
+	// 记录业务方法的 panic，默认是标准库的 log
+	logger Logger
+
+	lock     sync.Mutex
+	listener net.Listener
+	// 已经注册到注册中心的实例
+	instances []registry.ServiceInstance
+	// 所有还没有关闭的连接
+	conns map[net.Conn]struct{}
+	// 正在处理的请求
+	inflight sync.WaitGroup
+	closed   bool
+}
+
+type ServerOptions func(server *Serve)
+
+// ServerWithRegistry 启动的时候把服务注册到 r，关闭的时候注销
+func ServerWithRegistry(r registry.Registry) ServerOptions {
+	return func(server *Serve) {
+		server.registry = r
+	}
+}
+
+// ServerWithAdvertiseAddr 设置注册到注册中心的地址
+// 监听 :8081 这种地址的时候，客户端需要一个可以连上的地址
+func ServerWithAdvertiseAddr(addr string) ServerOptions {
+	return func(server *Serve) {
+		server.advertiseAddr = addr
+	}
+}
+
+// ServerWithWeight 设置注册到注册中心的权重，客户端使用加权负载均衡的时候生效
+func ServerWithWeight(weight uint32) ServerOptions {
+	return func(server *Serve) {
+		server.weight = weight
+	}
+}
+
+// ServerWithInterceptors 按照顺序把拦截器包在业务方法外面，第一个拦截器在最外层
+func ServerWithInterceptors(interceptors ...ServerInterceptor) ServerOptions {
+	return func(server *Serve) {
+		server.interceptors = append(server.interceptors, interceptors...)
+	}
+}
+
+// ServerWithStreamInterceptors 按照顺序把拦截器包在流式方法外面，第一个拦截器在最外层
+// 流式调用不经过 ServerWithInterceptors 设置的拦截器
+func ServerWithStreamInterceptors(interceptors ...StreamServerInterceptor) ServerOptions {
+	return func(server *Serve) {
+		server.streamInterceptors = append(server.streamInterceptors, interceptors...)
+	}
+}
+
+// ServerWithMaxFrameSize 设置单个请求（头部加数据）的最大长度，默认是 DefaultMaxFrameSize
+// 超过的时候服务端会断开这个连接
+func ServerWithMaxFrameSize(size uint32) ServerOptions {
+	return func(server *Serve) {
+		server.maxFrameSize = size
+	}
+}
+
+// ServerWithProtocolVersions 设置支持的协议版本，默认支持 message 包实现的所有版本
+// 灰度发布新的协议版本之前，可以先让服务端只支持旧的版本，客户端会自动降级
+// message 包没有实现的版本没法处理，会被忽略，协商的时候也不会告诉客户端
+func ServerWithProtocolVersions(versions ...uint8) ServerOptions {
+	return func(server *Serve) {
+		res := make([]uint8, 0, len(versions))
+		for _, v := range versions {
+			if v >= message.Version1 && v <= message.LatestVersion && !slices.Contains(res, v) {
+				res = append(res, v)
+			}
+		}
+		server.versions = res
+	}
+}
+
+// ConcurrencyLimiter 限制服务端同时处理的一元请求个数，concurrency.Limiter 实现了这个接口
+type ConcurrencyLimiter interface {
+	// Acquire 没有达到上限的时候返回 true，请求处理完之后调用 release
+	// dropped 表示请求超时了
+	Acquire() (release func(dropped bool), ok bool)
+}
+
+// ServerWithConcurrencyLimiter 读到一元请求之后马上检查并发上限
+// 超过上限的请求在解压、启动 goroutine 和调用拦截器之前就返回 ErrOverloaded，oneway 请求直接丢弃
+// 流不占用名额，需要的话使用 concurrency.StreamInterceptor
+func ServerWithConcurrencyLimiter(l ConcurrencyLimiter) ServerOptions {
+	return func(server *Serve) {
+		server.limiter = l
+	}
+}
+
+// ServerWithLogger 设置记录 panic 之类的内部错误的日志，nil 会被忽略，仍然使用 log.Default()
+func ServerWithLogger(logger Logger) ServerOptions {
+	return func(server *Serve) {
+		if logger != nil {
+			server.logger = logger
+		}
+	}
 }
 
-func NewServer() *Serve {
+func NewServer(opts ...ServerOptions) *Serve {
 	res := &Serve{
-		services:   make(map[string]reflectionStub, 16),
-		serializes: make(map[uint8]serialize.Serialize, 4),
+		services:     make(map[string]*serviceStub, 16),
+		serializes:   make(map[uint8]serialize.Serialize, 4),
+		compressors:  make(map[uint8]compress.Compressor, 4),
+		conns:        make(map[net.Conn]struct{}, 16),
+		maxFrameSize: DefaultMaxFrameSize,
+		versions:     []uint8{message.Version1, message.Version2},
+		logger:       log.Default(),
 	}
 	// 设置默认序列化协议
 	s := &json.Serializer{}
 	res.serializes[s.Code()] = s
+	for _, opt := range opts {
+		opt(res)
+	}
+	res.handler = buildServerChain(res.interceptors, res.handle)
 	return res
 }
 
@@ -31,133 +172,445 @@ func (s *Serve) RegisterSerialize(sl serialize.Serialize) {
 	s.serializes[sl.Code()] = sl
 }
 
-func (s *Serve) RegisterService(service Service) {
-	s.services[service.Name()] = reflectionStub{
-		s:          service,
-		value:      reflect.ValueOf(service),
-		serializes: s.serializes,
+func (s *Serve) RegisterCompressor(c compress.Compressor) {
+	s.compressors[c.Code()] = c
+}
+
+// RegisterService 注册服务，方法表在这里构建
+// 实现了 HandlerService 的服务（例如生成的代码）调用方法的时候不经过反射
+// 除了 Name 之外，所有导出的方法都必须是一元方法或者流式方法，否则返回所有签名不对的方法
+func (s *Serve) RegisterService(service Service) error {
+	stub, err := newServiceStub(service, s.serializes)
+	if err != nil {
+		return err
 	}
+	s.services[service.Name()] = stub
+	return nil
 }
 
+// Start 监听 address 并且开始处理请求，直到服务端被关闭
 func (s *Serve) Start(network, address string) error {
+	if err := s.Listen(network, address); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen 监听 address 并且注册到注册中心，返回之后客户端就可以建立连接了
+// 监听 :0 的时候可以通过 Addr 拿到实际的端口
+func (s *Serve) Listen(network, address string) error {
 	listener, err := net.Listen(network, address)
 	if err != nil {
 		return err
 	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.lock.Unlock()
+
+	if err = s.register(listener.Addr().String()); err != nil {
+		_ = s.Close()
+		return err
+	}
+	return nil
+}
+
+// Addr 返回监听的地址，调用 Listen 之前返回 nil
+func (s *Serve) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Serve 开始接收连接，服务端被关闭之后返回 ErrServerClosed
+func (s *Serve) Serve() error {
+	s.lock.Lock()
+	listener := s.listener
+	s.lock.Unlock()
+	if listener == nil {
+		return errors.New("micro: 需要先调用 Listen")
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
+		if !s.trackConn(conn) {
+			_ = conn.Close()
+			return ErrServerClosed
+		}
 		go func() {
 			if err := s.handleConn(conn); err != nil {
 				_ = conn.Close()
 			}
+			s.untrackConn(conn)
 		}()
 	}
 }
 
+// Shutdown 优雅退出
+// 先从注册中心注销并且停止接收新的连接，然后等待正在处理的请求（包括 oneway 请求）结束，
+// 最后关闭所有的连接。ctx 过期的时候不再等待，直接关闭所有连接并返回 ctx 的错误
+func (s *Serve) Shutdown(ctx context.Context) error {
+	err := s.stopListening()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.closeConns()
+	return err
+}
+
+// Close 从注册中心注销，并且立刻关闭监听和所有的连接，不等待正在处理的请求
+func (s *Serve) Close() error {
+	err := s.stopListening()
+	s.closeConns()
+	return err
+}
+
+func (s *Serve) stopListening() error {
+	s.lock.Lock()
+	s.closed = true
+	listener := s.listener
+	instances := s.instances
+	s.instances = nil
+	s.lock.Unlock()
+
+	var err error
+	// 先注销，客户端不会再把新的请求发过来
+	for _, si := range instances {
+		if er := s.registry.Unregister(context.Background(), si); er != nil {
+			err = er
+		}
+	}
+	if listener != nil {
+		if er := listener.Close(); er != nil && !errors.Is(er, net.ErrClosed) {
+			err = er
+		}
+	}
+	return err
+}
+
+func (s *Serve) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func (s *Serve) trackConn(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Serve) untrackConn(conn net.Conn) {
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+}
+
+func (s *Serve) closeConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// startRequest 关闭之后不再接收新的请求
+// 和 Shutdown 里面的 Wait 用同一把锁保证不会在 Wait 之后 Add
+func (s *Serve) startRequest() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+func (s *Serve) register(listenAddr string) error {
+	if s.registry == nil {
+		return nil
+	}
+	addr := s.advertiseAddr
+	if addr == "" {
+		addr = listenAddr
+	}
+	for name := range s.services {
+		si := registry.ServiceInstance{
+			Name:    name,
+			Address: addr,
+			Weight:  s.weight,
+		}
+		if err := s.registry.Register(context.Background(), si); err != nil {
+			return err
+		}
+		s.lock.Lock()
+		s.instances = append(s.instances, si)
+		s.lock.Unlock()
+	}
+	return nil
+}
+
 func (s *Serve) handleConn(conn net.Conn) error {
+	// 请求是并发处理的，写响应的时候要保证一个响应被完整写入
+	var writeLock sync.Mutex
+	writeResp := func(resp *message.Response) {
+		resp.SetHeadLength()
+		resp.SetBodyLength()
+
+		writeLock.Lock()
+		_, err := conn.Write(message.EncodeResp(resp))
+		writeLock.Unlock()
+		if err != nil {
+			// 关闭连接之后，读循环也会随之退出
+			_ = conn.Close()
+		}
+	}
+	streams := newServerStreams(s, writeResp)
+	defer streams.closeAll()
 	for {
-		data, err := ReadMsg(conn)
+		// 超过长度上限或者格式错误的消息，后面的数据已经没法解析了，直接断开连接
+		data, release, err := readPooledFrame(conn, s.maxFrameSize)
 		if err != nil {
 			return err
 		}
 
-		// 还原调用信息
-		req := message.DecodeReq(data)
-
-		ctx := context.Background()
-		oneway, ok := req.Meta["one-way"]
-		if ok && oneway == "true" {
-			ctx = CtxWithOneWay(ctx)
+		// 长度字段已经校验过了，固定头部是可信的
+		messageId, version := binary.BigEndian.Uint32(data[8:12]), data[12]
+		if !s.supportsVersion(version) {
+			// 用所有客户端都认识的版本返回，客户端根据附加信息里面的版本降级重试
+			writeResp(&message.Response{
+				MessageId: messageId,
+				Version:   message.Version1,
+				Error:     status.Encode(errUnsupportedVersion(version, s.versions)),
+			})
+			release()
+			continue
 		}
 
-		resp, err := s.Invoke(ctx, req)
-		// 这个你的业务 error
+		// 还原调用信息，req.Data 引用的是 data 里面的数据
+		req, err := message.DecodeReq(data)
 		if err != nil {
-			// 所有的错误都在这里进行捕获塞入
-			resp.Error = []byte(err.Error())
+			// 请求本身不合法
+			writeResp(&message.Response{
+				MessageId: messageId,
+				Version:   version,
+				Error:     status.Encode(status.New(status.InvalidArgument, err.Error())),
+			})
+			release()
+			continue
 		}
 
-		resp.SetHeadLength()
-		resp.SetBodyLength()
+		if req.ServiceName == handshakeService {
+			// 响应数据的每一个字节都是一个支持的版本
+			writeResp(&message.Response{
+				MessageId: req.MessageId,
+				Version:   version,
+				Data:      s.versions,
+			})
+			release()
+			continue
+		}
 
-		_, err = conn.Write(message.EncodeResp(resp))
-		if err != nil {
-			return err
+		if req.Flags&message.FlagStream != 0 {
+			streams.handle(req)
+			release()
+			continue
 		}
+
+		// oneway 请求没有响应，客户端也不会等待
+		oneway := req.Meta[metaOneWay] == "true"
+
+		// 正在关闭，让客户端换一个实例
+		if !s.startRequest() {
+			if !oneway {
+				writeResp(&message.Response{
+					MessageId:  req.MessageId,
+					Version:    req.Version,
+					Serializer: req.Serializer,
+					Error:      status.Encode(errServerClosing),
+				})
+			}
+			release()
+			continue
+		}
+
+		// 过载的时候在这里就丢弃，不再为请求解压和启动 goroutine
+		var done func(dropped bool)
+		if s.limiter != nil {
+			var ok bool
+			done, ok = s.limiter.Acquire()
+			if !ok {
+				s.inflight.Done()
+				if !oneway {
+					writeResp(&message.Response{
+						MessageId:  req.MessageId,
+						Version:    req.Version,
+						Serializer: req.Serializer,
+						Error:      status.Encode(ErrOverloaded),
+					})
+				}
+				release()
+				continue
+			}
+		}
+
+		// 每个请求单独处理，响应按照处理完成的顺序写回，客户端通过 MessageId 对应
+		go func() {
+			defer s.inflight.Done()
+			ctx := context.Background()
+			if oneway {
+				ctx = CtxWithOneWay(ctx)
+			}
+
+			start := time.Now()
+			// oneway 请求也在这个 goroutine 里面执行，不再另外启动
+			resp, err := s.invoke(ctx, req, false)
+			if done != nil {
+				// 超时的请求说明延迟已经超出了客户端能接受的范围
+				timeout, ok := timeoutOf(req)
+				done(status.CodeOf(err) == status.DeadlineExceeded || (ok && time.Since(start) >= timeout))
+			}
+			if oneway {
+				release()
+				return
+			}
+			// 这个你的业务 error
+			if err != nil {
+				// 所有的错误都在这里进行捕获塞入，普通的 error 会被当做 Unknown
+				resp.Error = status.Encode(status.Convert(err))
+			}
+			writeResp(resp)
+			release()
+		}()
 	}
 }
 
+func (s *Serve) supportsVersion(version uint8) bool {
+	version = normalizeVersion(version)
+	return slices.Contains(s.versions, version)
+}
+
 func (s *Serve) Invoke(ctx context.Context, req *message.Request) (*message.Response, error) {
+	return s.invoke(ctx, req, true)
+}
+
+// invoke 调用业务方法，async 为 true 的时候 oneway 请求在新的 goroutine 里面执行，马上返回
+func (s *Serve) invoke(ctx context.Context, req *message.Request, async bool) (*message.Response, error) {
 	resp := &message.Response{
 		MessageId:  req.MessageId,
 		Version:    req.Version,
 		Compresser: req.Compresser,
 		Serializer: req.Serializer,
 	}
+	// 没有注册的服务和方法不经过拦截器，拦截器按照服务名和方法名保存的状态不会被随意撑大
 	service, ok := s.services[req.ServiceName]
 	if !ok {
-		return resp, errors.New("你要调用的服务不存在")
+		return resp, errServiceNotFound
+	}
+	if !service.hasUnary(req.MethodName) {
+		return resp, errMethodNotFound
 	}
 
-	if isOneWay(ctx) {
+	// 响应使用和请求相同的压缩算法
+	var compressor compress.Compressor
+	if req.Compresser != 0 {
+		compressor, ok = s.compressors[req.Compresser]
+		if !ok {
+			resp.Compresser = 0
+			return resp, errUnsupportedCompressor
+		}
+		if len(req.Data) > 0 {
+			data, err := decompress(compressor, req.Data, s.maxFrameSize)
+			if err != nil {
+				return resp, err
+			}
+			req.Data = data
+		}
+	}
+
+	// 客户端的超时时间和元数据，业务方法通过 ctx 感知
+	ctx, cancel := withTimeout(ctx, req)
+	if len(req.Meta) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, incomingMeta(req.Meta))
+	}
+	if async && isOneWay(ctx) {
+		// Shutdown 也要等待 oneway 请求执行完
+		s.inflight.Add(1)
 		go func() {
-			_, _ = service.invoke(ctx, req)
+			defer s.inflight.Done()
+			defer cancel()
+			_, _ = s.safeHandle(ctx, req)
 		}()
-		return resp, errors.New("micro: 微服务端服务端 oneway 请求")
+		// 业务方法还没有执行完，这个响应不会发给客户端
+		return resp, nil
 	}
+	defer cancel()
 
-	respData, err := service.invoke(ctx, req)
-	resp.Data = respData
+	res, err := s.safeHandle(ctx, req)
+	if isOneWay(ctx) {
+		// 响应不会发给客户端，不需要压缩
+		return resp, err
+	}
+	if res != nil && len(res.Data) > 0 {
+		respData := res.Data
+		if compressor != nil {
+			var er error
+			respData, er = compressor.Compress(respData)
+			if er != nil {
+				return resp, status.Errorf(status.Internal, "micro: 压缩响应数据失败 %v", er)
+			}
+		}
+		resp.Data = respData
+	}
 
 	return resp, err
 }
 
-type reflectionStub struct {
-	s          Service
-	value      reflect.Value
-	serializes map[uint8]serialize.Serialize
+// safeHandle 调用拦截器链，拦截器和业务方法的 panic 不会让整个进程退出
+func (s *Serve) safeHandle(ctx context.Context, req *message.Request) (resp *message.Response, err error) {
+	defer s.recoverPanic(req.ServiceName, req.MethodName, &err)
+	return s.handler(ctx, req)
 }
 
-func (s *reflectionStub) invoke(ctx context.Context, req *message.Request) ([]byte, error) {
-
-	method := s.value.MethodByName(req.MethodName)
-	in := make([]reflect.Value, 2)
-
-	// in[0]：需要传入context
-	in[0] = reflect.ValueOf(context.Background())
-
-	// in[1]: GetByIdReq数据
-	inReq := reflect.New(method.Type().In(1).Elem())
-	serializer, ok := s.serializes[req.Serializer]
-	if !ok {
-		return nil, errors.New("micro: 不支持的序列化协议")
-	}
-	err := serializer.Decode(req.Data, inReq.Interface())
-
-	if err != nil {
-		return nil, err
-	}
-
-	in[1] = inReq
-	result := method.Call(in)
-
-	if result[1].Interface() != nil {
-		// 执行返回的错误
-		err = result[1].Interface().(error)
+// recoverPanic 必须直接 defer 调用，把 panic 转换成 Internal 错误并且把调用栈记录到日志里面
+func (s *Serve) recoverPanic(serviceName, methodName string, err *error) {
+	if r := recover(); r != nil {
+		s.logger.Printf("micro: %s.%s panic: %v\n%s", serviceName, methodName, r, debug.Stack())
+		*err = errServerPanic
 	}
+}
 
-	var res []byte
-	if result[0].IsNil() {
-		return nil, err
-	} else {
-		var er error
-		res, er = serializer.Encode(result[0].Interface())
-		if er != nil {
-			return nil, er
-		}
+// handle 是拦截器链的最里层，找到服务并且调用业务方法
+func (s *Serve) handle(ctx context.Context, req *message.Request) (*message.Response, error) {
+	service, ok := s.services[req.ServiceName]
+	if !ok {
+		return nil, errServiceNotFound
 	}
-	return res, err
+	data, err := service.invoke(ctx, req)
+	return &message.Response{Data: data}, err
 }
@@ -0,0 +1,223 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"geek_micro/rpc/compress"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/metadata"
+	"geek_micro/rpc/status"
+	"io"
+	"sync"
+)
+
+// serverStreams 一个连接上正在进行的流，流只经过 ServerWithStreamInterceptors 设置的拦截器
+type serverStreams struct {
+	s     *Serve
+	write func(resp *message.Response)
+
+	lock    sync.Mutex
+	streams map[uint32]*serverStream
+}
+
+func newServerStreams(s *Serve, write func(resp *message.Response)) *serverStreams {
+	return &serverStreams{
+		s:       s,
+		write:   write,
+		streams: make(map[uint32]*serverStream, 4),
+	}
+}
+
+// handle 处理带有 FlagStream 的请求，req.Data 在返回之后就不能再引用了
+func (ss *serverStreams) handle(req *message.Request) {
+	ss.lock.Lock()
+	st, ok := ss.streams[req.MessageId]
+	ss.lock.Unlock()
+	if !ok {
+		// 只有带着服务名的消息才能打开流，其它的是已经结束的流剩下的消息
+		if req.ServiceName != "" &&
+			req.Flags&(message.FlagEndStream|message.FlagWindowUpdate|message.FlagReset) == 0 {
+			ss.open(req)
+		}
+		return
+	}
+
+	switch {
+	case req.Flags&message.FlagReset != 0:
+		st.core.terminate(context.Canceled)
+		st.cancel()
+	case req.Flags&message.FlagWindowUpdate != 0:
+		if len(req.Data) == 4 {
+			st.core.addCredits(binary.BigEndian.Uint32(req.Data))
+		}
+	case req.Flags&message.FlagEndStream != 0:
+		st.core.deliver(streamFrame{end: true})
+	default:
+		data := make([]byte, len(req.Data))
+		copy(data, req.Data)
+		st.core.deliver(streamFrame{data: data, compresser: req.Compresser})
+	}
+}
+
+func (ss *serverStreams) open(req *message.Request) {
+	s := ss.s
+	if !s.startRequest() {
+		ss.finish(req, errServerClosing)
+		return
+	}
+	service, ok := s.services[req.ServiceName]
+	if !ok {
+		s.inflight.Done()
+		ss.finish(req, errServiceNotFound)
+		return
+	}
+	// 和一元调用一样，没有注册的方法不经过拦截器
+	if !service.hasStream(req.MethodName) {
+		s.inflight.Done()
+		ss.finish(req, errNotStreamMethod(req.MethodName))
+		return
+	}
+	var compressor compress.Compressor
+	if req.Compresser != 0 {
+		compressor, ok = s.compressors[req.Compresser]
+		if !ok {
+			s.inflight.Done()
+			ss.finish(req, errUnsupportedCompressor)
+			return
+		}
+	}
+
+	ctx, cancelTimeout := withTimeout(context.Background(), req)
+	ctx, cancel := context.WithCancel(ctx)
+	if len(req.Meta) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, incomingMeta(req.Meta))
+	}
+	st := &serverStream{
+		ss:         ss,
+		cancel:     cancel,
+		compressor: compressor,
+		header: message.Response{
+			MessageId:  req.MessageId,
+			Version:    req.Version,
+			Compresser: req.Compresser,
+			Serializer: req.Serializer,
+		},
+	}
+	st.core = newStreamCore(ctx, st.windowUpdate)
+	ss.lock.Lock()
+	ss.streams[req.MessageId] = st
+	ss.lock.Unlock()
+
+	// req.Data 在返回之后就不能再引用了，拦截器拿到的是没有数据的副本
+	info := *req
+	info.Data = nil
+	handler := buildStreamChain(s.streamInterceptors, func(ctx context.Context, req *message.Request) error {
+		return service.invokeStream(ctx, req.MethodName, req.Serializer, st)
+	})
+	go func() {
+		defer s.inflight.Done()
+		defer cancelTimeout()
+		defer cancel()
+		err := func() (err error) {
+			defer s.recoverPanic(info.ServiceName, info.MethodName, &err)
+			return handler(ctx, &info)
+		}()
+
+		ss.lock.Lock()
+		delete(ss.streams, st.header.MessageId)
+		ss.lock.Unlock()
+		// 方法返回之后还在调用 Send 的 goroutine 会拿到 io.EOF
+		st.core.terminate(io.EOF)
+		resp := st.header
+		resp.Flags = message.FlagStream | message.FlagEndStream
+		if err != nil {
+			resp.Error = status.Encode(status.Convert(err))
+		}
+		ss.write(&resp)
+	}()
+}
+
+// finish 在打开流之前就拒绝了请求
+func (ss *serverStreams) finish(req *message.Request, err error) {
+	ss.write(&message.Response{
+		MessageId:  req.MessageId,
+		Version:    req.Version,
+		Serializer: req.Serializer,
+		Flags:      message.FlagStream | message.FlagEndStream,
+		Error:      status.Encode(status.Convert(err)),
+	})
+}
+
+// closeAll 连接断开的时候取消所有的流
+func (ss *serverStreams) closeAll() {
+	ss.lock.Lock()
+	streams := ss.streams
+	ss.streams = make(map[uint32]*serverStream)
+	ss.lock.Unlock()
+	for _, st := range streams {
+		st.core.terminate(errConnClosed)
+		st.cancel()
+	}
+}
+
+// serverStream 服务端的流，所有的消息使用客户端打开流的时候的 MessageId
+type serverStream struct {
+	ss     *serverStreams
+	core   *streamCore
+	cancel context.CancelFunc
+	header message.Response
+	// 为 nil 的时候不压缩
+	compressor compress.Compressor
+}
+
+func (st *serverStream) Context() context.Context {
+	return st.core.ctx
+}
+
+func (st *serverStream) SendMsg(data []byte) error {
+	if err := st.core.acquire(); err != nil {
+		return err
+	}
+	if st.compressor != nil {
+		var err error
+		data, err = st.compressor.Compress(data)
+		if err != nil {
+			return status.Errorf(status.Internal, "micro: 压缩响应数据失败 %v", err)
+		}
+	}
+	st.send(message.FlagStream, data)
+	return nil
+}
+
+func (st *serverStream) RecvMsg() ([]byte, error) {
+	f, err := st.core.recv()
+	if err != nil {
+		return nil, err
+	}
+	if f.compresser == 0 || len(f.data) == 0 {
+		return f.data, nil
+	}
+	if st.compressor == nil || st.compressor.Code() != f.compresser {
+		return nil, errUnsupportedCompressor
+	}
+	return decompress(st.compressor, f.data, st.ss.s.maxFrameSize)
+}
+
+// CloseSend 服务端的流在方法返回的时候结束
+func (st *serverStream) CloseSend() error {
+	return nil
+}
+
+func (st *serverStream) windowUpdate(n uint32) error {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, n)
+	st.send(message.FlagStream|message.FlagWindowUpdate, data)
+	return nil
+}
+
+func (st *serverStream) send(flags uint8, data []byte) {
+	resp := st.header
+	resp.Flags = flags
+	resp.Data = data
+	st.ss.write(&resp)
+}
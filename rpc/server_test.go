@@ -0,0 +1,472 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"geek_micro/rpc/compress/gzip"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/serialize/json"
+	"geek_micro/rpc/status"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeShutdown(t *testing.T) {
+	testCases := []struct {
+		name   string
+		oneway bool
+		// 业务方法开始执行之后多久放行
+		release time.Duration
+		timeout time.Duration
+
+		wantErr     error
+		wantCallErr bool
+	}{
+		{
+			name:    "wait for in-flight call",
+			release: time.Millisecond * 200,
+			timeout: time.Second * 3,
+		},
+		{
+			name:    "wait for oneway call",
+			oneway:  true,
+			release: time.Millisecond * 200,
+			timeout: time.Second * 3,
+		},
+		{
+			name:        "timeout",
+			release:     time.Second,
+			timeout:     time.Millisecond * 100,
+			wantErr:     context.DeadlineExceeded,
+			wantCallErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			service := &gateServer{entered: make(chan struct{}, 1), release: make(chan struct{})}
+			server := NewServer()
+			server.RegisterService(service)
+			require.NoError(t, server.Listen("tcp", "127.0.0.1:0"))
+			addr := server.Addr().String()
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- server.Serve()
+			}()
+
+			us := &gateService{}
+			client, err := NewClient(addr)
+			require.NoError(t, err)
+			defer func() {
+				_ = client.Close()
+			}()
+			require.NoError(t, client.InitService(us))
+
+			callErr := make(chan error, 1)
+			go func() {
+				ctx := context.Background()
+				if tc.oneway {
+					ctx = CtxWithOneWay(ctx)
+				}
+				_, er := us.Wait(ctx, &GetByIdReq{Id: 1})
+				callErr <- er
+			}()
+			<-service.entered
+			time.AfterFunc(tc.release, func() {
+				close(service.release)
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			err = server.Shutdown(ctx)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, ErrServerClosed, <-serveErr)
+			if tc.wantErr == nil {
+				// 正在执行的请求（包括 oneway 请求）都执行完了
+				assert.True(t, service.done.Load())
+			}
+			if !tc.oneway {
+				er := <-callErr
+				assert.Equal(t, tc.wantCallErr, er != nil)
+			}
+
+			// 不再接收新的连接
+			_, err = net.DialTimeout("tcp", addr, time.Millisecond*100)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestServeListen(t *testing.T) {
+	server := NewServer()
+	assert.Nil(t, server.Addr())
+	assert.Error(t, server.Serve())
+
+	require.NoError(t, server.Close())
+	// 关闭之后不能再启动
+	assert.Equal(t, ErrServerClosed, server.Listen("tcp", "127.0.0.1:0"))
+}
+
+type gateService struct {
+	Wait func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+}
+
+func (s *gateService) Name() string {
+	return "gate"
+}
+
+// gateServer 阻塞到 release 被关闭
+type gateServer struct {
+	entered chan struct{}
+	release chan struct{}
+	done    atomic.Bool
+}
+
+func (s *gateServer) Wait(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	s.entered <- struct{}{}
+	<-s.release
+	s.done.Store(true)
+	return &GetByIdResp{}, nil
+}
+
+func (s *gateServer) Name() string {
+	return "gate"
+}
+
+func TestServePanic(t *testing.T) {
+	logger := &recordLogger{}
+	server := NewServer(ServerWithLogger(logger))
+	require.NoError(t, server.RegisterService(&panicServer{}))
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	ps := &panicService{}
+	require.NoError(t, client.InitService(ps))
+
+	_, err = ps.Unary(context.Background(), &GetByIdReq{Id: 1})
+	assert.Equal(t, errServerPanic, err)
+
+	stream, err := ps.Stream(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, errServerPanic, err)
+
+	_, _ = ps.Unary(CtxWithOneWay(context.Background()), &GetByIdReq{Id: 1})
+	assert.Eventually(t, func() bool {
+		return len(logger.logs()) == 3
+	}, time.Second, time.Millisecond*10)
+	for _, log := range logger.logs() {
+		// 日志里面有 panic 的值和调用栈
+		assert.Contains(t, log, "panic: boom")
+		assert.Contains(t, log, "panicServer")
+	}
+
+	// 连接还可以继续使用
+	resp, err := ps.Echo(context.Background(), &GetByIdReq{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, &GetByIdResp{Msg: "echo"}, resp)
+}
+
+func TestServerWithLogger(t *testing.T) {
+	// 记录 panic 的时候不能因为 nil 再 panic 一次
+	server := NewServer(ServerWithLogger(nil))
+	assert.Equal(t, log.Default(), server.logger)
+	require.NoError(t, server.RegisterService(&panicServer{}))
+	_, err := server.Invoke(context.Background(), &message.Request{
+		ServiceName: "panic",
+		MethodName:  "Unary",
+		Serializer:  (&json.Serializer{}).Code(),
+		Data:        []byte(`{}`),
+	})
+	assert.Equal(t, errServerPanic, err)
+}
+
+func TestRegisterService(t *testing.T) {
+	testCases := []struct {
+		name    string
+		service Service
+		wantErr string
+	}{
+		{
+			name:    "nil",
+			wantErr: "micro: 不支持 nil",
+		},
+		{
+			name:    "unary and stream",
+			service: &streamServer{},
+		},
+		{
+			name:    "handler service",
+			service: &echoHandlerServer{},
+		},
+		{
+			name:    "bad handlers",
+			service: &badHandlerServer{},
+			wantErr: "micro: bad-handler 的 Handlers 里面的 Echo 是流式方法，不能使用 MethodHandler\n" +
+				"micro: bad-handler 的 Handlers 里面的 Missing 没有对应的方法\n" +
+				"micro: bad-handler 的 Handlers 里面的 Sum 为 nil",
+		},
+		{
+			// 所有签名不对的方法一起报告
+			name:    "bad signatures",
+			service: &badServer{},
+			wantErr: "micro: bad 的方法 NoCtx 的签名 func(*rpc.GetByIdReq) (*rpc.GetByIdResp, error) 不支持，" +
+				"只支持 func(context.Context, *Req) (*Resp, error) 和 func(context.Context, *rpc.Stream[Resp, Req]) error\n" +
+				"micro: bad 的方法 NoErr 的签名 func(context.Context, *rpc.GetByIdReq) *rpc.GetByIdResp 不支持，" +
+				"只支持 func(context.Context, *Req) (*Resp, error) 和 func(context.Context, *rpc.Stream[Resp, Req]) error\n" +
+				"micro: bad 的方法 Reset 的签名 func() 不支持，" +
+				"只支持 func(context.Context, *Req) (*Resp, error) 和 func(context.Context, *rpc.Stream[Resp, Req]) error",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer()
+			err := server.RegisterService(tc.service)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				assert.Empty(t, server.services)
+				return
+			}
+			require.NoError(t, err)
+			assert.Contains(t, server.services, tc.service.Name())
+		})
+	}
+}
+
+func TestServeInvokeMethod(t *testing.T) {
+	testCases := []struct {
+		name   string
+		method string
+		data   string
+
+		wantData string
+		wantErr  error
+	}{
+		{
+			name:     "ok",
+			method:   "Echo",
+			data:     `{"Id":12}`,
+			wantData: `{"Msg":"echo"}`,
+		},
+		{
+			name:    "error without response",
+			method:  "Fail",
+			data:    `{"Id":12}`,
+			wantErr: status.New(status.Aborted, "fail"),
+		},
+		{
+			name:    "invalid data",
+			method:  "Echo",
+			data:    `{`,
+			wantErr: status.New(status.InvalidArgument, "micro: 反序列化请求数据失败 unexpected end of JSON input"),
+		},
+		{
+			name:    "method not found",
+			method:  "Unknown",
+			data:    `{}`,
+			wantErr: errMethodNotFound,
+		},
+		{
+			name:    "not a method",
+			method:  "Name",
+			data:    `{}`,
+			wantErr: errMethodNotFound,
+		},
+	}
+
+	// 反射和生成的代码两种方式的结果一样
+	for _, service := range []Service{&echoServer{}, &echoHandlerServer{}} {
+		server := NewServer()
+		server.RegisterService(service)
+		for _, tc := range testCases {
+			t.Run(fmt.Sprintf("%T %s", service, tc.name), func(t *testing.T) {
+				resp, err := server.Invoke(context.Background(), &message.Request{
+					ServiceName: "echo",
+					MethodName:  tc.method,
+					Serializer:  (&json.Serializer{}).Code(),
+					Data:        []byte(tc.data),
+				})
+				assert.Equal(t, tc.wantErr, err)
+				assert.Equal(t, tc.wantData, string(resp.Data))
+			})
+		}
+	}
+}
+
+func TestServeDecompressLimit(t *testing.T) {
+	server := NewServer(ServerWithMaxFrameSize(1024))
+	server.RegisterService(&echoServer{})
+	c := &gzip.Compressor{}
+	server.RegisterCompressor(c)
+	data, err := c.Compress([]byte(`{"Id":12,"Msg":"` + strings.Repeat("a", 4096) + `"}`))
+	require.NoError(t, err)
+	require.Less(t, len(data), 1024)
+
+	_, err = server.Invoke(context.Background(), &message.Request{
+		ServiceName: "echo",
+		MethodName:  "Echo",
+		Compresser:  c.Code(),
+		Serializer:  (&json.Serializer{}).Code(),
+		Data:        data,
+	})
+	assert.Equal(t, status.ResourceExhausted, status.CodeOf(err))
+}
+
+// 对比反射和生成的代码两种调用方式，-benchmem 可以看到每次调用的内存分配
+func BenchmarkServeInvoke(b *testing.B) {
+	testCases := []struct {
+		name    string
+		service Service
+	}{
+		{
+			name:    "reflection",
+			service: &echoServer{},
+		},
+		{
+			name:    "handler",
+			service: &echoHandlerServer{},
+		},
+	}
+	for _, tc := range testCases {
+		b.Run(tc.name, func(b *testing.B) {
+			server := NewServer()
+			server.RegisterService(tc.service)
+			req := &message.Request{
+				ServiceName: "echo",
+				MethodName:  "Echo",
+				Serializer:  (&json.Serializer{}).Code(),
+				Data:        []byte(`{"Id":12}`),
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := server.Invoke(context.Background(), req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type echoServer struct{}
+
+func (s *echoServer) Name() string {
+	return "echo"
+}
+
+func (s *echoServer) Echo(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	return &GetByIdResp{Msg: "echo"}, nil
+}
+
+func (s *echoServer) Fail(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	return nil, status.New(status.Aborted, "fail")
+}
+
+type panicService struct {
+	Unary  func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	Echo   func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error)
+	Stream func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error)
+}
+
+func (s *panicService) Name() string {
+	return "panic"
+}
+
+type panicServer struct{}
+
+func (s *panicServer) Name() string {
+	return "panic"
+}
+
+func (s *panicServer) Unary(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	panic("boom")
+}
+
+func (s *panicServer) Echo(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	return &GetByIdResp{Msg: "echo"}, nil
+}
+
+func (s *panicServer) Stream(ctx context.Context, stream *Stream[GetByIdResp, GetByIdReq]) error {
+	panic("boom")
+}
+
+type recordLogger struct {
+	lock    sync.Mutex
+	entries []string
+}
+
+func (l *recordLogger) Printf(format string, args ...any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) logs() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.entries...)
+}
+
+type badServer struct{}
+
+func (s *badServer) Name() string {
+	return "bad"
+}
+
+func (s *badServer) GetById(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	return &GetByIdResp{}, nil
+}
+
+func (s *badServer) NoCtx(req *GetByIdReq) (*GetByIdResp, error) {
+	return &GetByIdResp{}, nil
+}
+
+func (s *badServer) NoErr(ctx context.Context, req *GetByIdReq) *GetByIdResp {
+	return &GetByIdResp{}
+}
+
+func (s *badServer) Reset() {}
+
+// badHandlerServer 的 Handlers 和方法对不上
+type badHandlerServer struct {
+	streamServer
+}
+
+func (s *badHandlerServer) Name() string {
+	return "bad-handler"
+}
+
+func (s *badHandlerServer) Handlers() map[string]MethodHandler {
+	echo := func(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+		return &GetByIdResp{}, nil
+	}
+	return map[string]MethodHandler{
+		"Echo":    UnaryHandler(echo),
+		"Missing": UnaryHandler(echo),
+		"Sum":     nil,
+	}
+}
+
+// echoHandlerServer 模拟生成的代码
+type echoHandlerServer struct {
+	echoServer
+}
+
+func (s *echoHandlerServer) Handlers() map[string]MethodHandler {
+	return map[string]MethodHandler{
+		"Echo": UnaryHandler(s.Echo),
+		"Fail": UnaryHandler(s.Fail),
+	}
+}
@@ -0,0 +1,254 @@
+package status
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// Code 错误码，和业务无关，调用方可以根据它决定是否重试、是否熔断
+type Code uint32
+
+const (
+	OK Code = iota
+	// Canceled 调用方取消了调用
+	Canceled
+	// Unknown 没有指定错误码的错误，业务方法直接返回的普通 error 都是这个
+	Unknown
+	// InvalidArgument 请求数据有问题，例如反序列化失败
+	InvalidArgument
+	// DeadlineExceeded 超时
+	DeadlineExceeded
+	// NotFound 服务或者方法不存在
+	NotFound
+	AlreadyExists
+	PermissionDenied
+	// ResourceExhausted 被限流或者资源不足
+	ResourceExhausted
+	FailedPrecondition
+	Aborted
+	OutOfRange
+	// Unimplemented 不支持的序列化协议、压缩算法等
+	Unimplemented
+	// Internal 框架内部错误，例如业务方法 panic
+	Internal
+	// Unavailable 服务暂时不可用，一般可以重试
+	Unavailable
+	DataLoss
+	Unauthenticated
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+// Detail 错误的附加信息，Type 告诉接收方如何解析 Value
+type Detail struct {
+	Type  string
+	Value []byte
+}
+
+// Error 跨越网络传递的错误，客户端可以用 errors.As 拿到它
+type Error struct {
+	Code    Code
+	Message string
+	Details []Detail
+}
+
+func New(code Code, msg string) *Error {
+	return &Error{
+		Code:    code,
+		Message: msg,
+	}
+}
+
+func Errorf(code Code, format string, args ...any) *Error {
+	return New(code, fmt.Sprintf(format, args...))
+}
+
+// Error 只返回 Message，和以前直接传递错误字符串的时候保持一致
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithDetails 返回一个带有附加信息的副本
+func (e *Error) WithDetails(details ...Detail) *Error {
+	res := *e
+	res.Details = append(append([]Detail(nil), e.Details...), details...)
+	return &res
+}
+
+// FromError 如果 err 的链上有 *Error 就返回它
+func FromError(err error) (*Error, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
+
+// DetailOverloaded 服务端过载主动丢弃请求的时候带上这个附加信息
+// 客户端通过它区分主动丢弃的请求和真正的故障，例如熔断器不把它算作失败
+const DetailOverloaded = "micro.Overloaded"
+
+// IsOverloaded 判断 err 是不是服务端过载主动丢弃请求返回的错误
+func IsOverloaded(err error) bool {
+	e, ok := FromError(err)
+	if !ok {
+		return false
+	}
+	for _, d := range e.Details {
+		if d.Type == DetailOverloaded {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert 把任意的 error 转换为 *Error，nil 转换为 nil
+func Convert(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := FromError(err); ok {
+		return e
+	}
+	return New(CodeOf(err), err.Error())
+}
+
+// CodeOf 返回 err 对应的错误码
+// 除了 *Error 之外，还能识别超时、取消和网络错误
+func CodeOf(err error) Code {
+	if err == nil {
+		return OK
+	}
+	if e, ok := FromError(err); ok {
+		return e.Code
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return Canceled
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return DeadlineExceeded
+		}
+		return Unavailable
+	}
+	return Unknown
+}
+
+// Encode 编码之后放在响应头部的 Error 里面
+// code(4) | message 长度(4) | message | detail 个数(2) | (type 长度(2) | type | value 长度(4) | value)...
+// message 和 value 的长度受消息最大长度的限制，不会超过 4 个字节
+// type 的长度放不下的 detail 会被丢掉，超过 math.MaxUint16 个的 detail 只保留前面的
+func Encode(e *Error) []byte {
+	if e == nil {
+		return nil
+	}
+	details := make([]Detail, 0, min(len(e.Details), math.MaxUint16))
+	for _, d := range e.Details {
+		if len(details) == math.MaxUint16 {
+			break
+		}
+		if len(d.Type) <= math.MaxUint16 {
+			details = append(details, d)
+		}
+	}
+	size := 4 + 4 + len(e.Message) + 2
+	for _, d := range details {
+		size += 2 + len(d.Type) + 4 + len(d.Value)
+	}
+	bs := make([]byte, 0, size)
+	bs = binary.BigEndian.AppendUint32(bs, uint32(e.Code))
+	bs = binary.BigEndian.AppendUint32(bs, uint32(len(e.Message)))
+	bs = append(bs, e.Message...)
+	bs = binary.BigEndian.AppendUint16(bs, uint16(len(details)))
+	for _, d := range details {
+		bs = binary.BigEndian.AppendUint16(bs, uint16(len(d.Type)))
+		bs = append(bs, d.Type...)
+		bs = binary.BigEndian.AppendUint32(bs, uint32(len(d.Value)))
+		bs = append(bs, d.Value...)
+	}
+	return bs
+}
+
+// Decode 还原响应头部的错误，data 为空的时候返回 nil
+// 旧版本的服务端直接传递错误字符串，这种数据会被当做 Unknown 错误
+func Decode(data []byte) *Error {
+	if len(data) == 0 {
+		return nil
+	}
+	e, ok := decode(data)
+	if !ok {
+		return New(Unknown, string(data))
+	}
+	return e
+}
+
+func decode(data []byte) (*Error, bool) {
+	if len(data) < 10 {
+		return nil, false
+	}
+	e := &Error{Code: Code(binary.BigEndian.Uint32(data[:4]))}
+	msgLen := int(binary.BigEndian.Uint32(data[4:8]))
+	data = data[8:]
+	if len(data) < msgLen+2 {
+		return nil, false
+	}
+	e.Message = string(data[:msgLen])
+	data = data[msgLen:]
+	cnt := int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+	for i := 0; i < cnt; i++ {
+		if len(data) < 2 {
+			return nil, false
+		}
+		typeLen := int(binary.BigEndian.Uint16(data[:2]))
+		data = data[2:]
+		if len(data) < typeLen+4 {
+			return nil, false
+		}
+		d := Detail{Type: string(data[:typeLen])}
+		data = data[typeLen:]
+		valueLen := int(binary.BigEndian.Uint32(data[:4]))
+		data = data[4:]
+		if len(data) < valueLen {
+			return nil, false
+		}
+		d.Value = data[:valueLen:valueLen]
+		data = data[valueLen:]
+		e.Details = append(e.Details, d)
+	}
+	// 必须正好用完所有的数据，否则大概率是旧版本的错误字符串
+	return e, len(data) == 0
+}
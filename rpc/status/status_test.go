@@ -0,0 +1,135 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  *Error
+	}{
+		{
+			name: "no details",
+			err:  New(NotFound, "你要调用的服务不存在"),
+		},
+		{
+			name: "empty message",
+			err:  New(Internal, ""),
+		},
+		{
+			name: "details",
+			err: Errorf(InvalidArgument, "id %d 不合法", 12).WithDetails(
+				Detail{Type: "field", Value: []byte("Id")},
+				Detail{Type: "empty"},
+			),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := Decode(Encode(tc.err))
+			assert.Equal(t, tc.err.Code, res.Code)
+			assert.Equal(t, tc.err.Message, res.Message)
+			assert.Equal(t, len(tc.err.Details), len(res.Details))
+			for i, d := range tc.err.Details {
+				assert.Equal(t, d.Type, res.Details[i].Type)
+				assert.Equal(t, string(d.Value), string(res.Details[i].Value))
+			}
+		})
+	}
+}
+
+func TestEncodeOversized(t *testing.T) {
+	// type 太长的 detail 被丢掉，不影响后面的 detail
+	e := New(Internal, "oversized").WithDetails(
+		Detail{Type: strings.Repeat("a", math.MaxUint16+1), Value: []byte("x")},
+		Detail{Type: "field", Value: []byte("Id")},
+	)
+	res := Decode(Encode(e))
+	assert.Equal(t, "oversized", res.Message)
+	assert.Equal(t, []Detail{{Type: "field", Value: []byte("Id")}}, res.Details)
+
+	// 个数放不下的只保留前面的
+	details := make([]Detail, math.MaxUint16+2)
+	for i := range details {
+		details[i] = Detail{Type: "i", Value: []byte{}}
+	}
+	res = Decode(Encode(New(Internal, "too many").WithDetails(details...)))
+	assert.Equal(t, "too many", res.Message)
+	assert.Len(t, res.Details, math.MaxUint16)
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	assert.Nil(t, Decode(nil))
+	// 旧版本服务端直接传递的错误字符串
+	assert.Equal(t, New(Unknown, "error"), Decode([]byte("error")))
+	assert.Equal(t, New(Unknown, "你要调用的服务不存在"), Decode([]byte("你要调用的服务不存在")))
+}
+
+func TestConvert(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		wantCode Code
+		wantMsg  string
+	}{
+		{
+			name:     "status",
+			err:      fmt.Errorf("wrap: %w", New(NotFound, "not found")),
+			wantCode: NotFound,
+			wantMsg:  "not found",
+		},
+		{
+			name:     "plain",
+			err:      errors.New("error"),
+			wantCode: Unknown,
+			wantMsg:  "error",
+		},
+		{
+			name:     "deadline",
+			err:      context.DeadlineExceeded,
+			wantCode: DeadlineExceeded,
+			wantMsg:  context.DeadlineExceeded.Error(),
+		},
+		{
+			name:     "canceled",
+			err:      context.Canceled,
+			wantCode: Canceled,
+			wantMsg:  context.Canceled.Error(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := Convert(tc.err)
+			assert.Equal(t, tc.wantCode, res.Code)
+			assert.Equal(t, tc.wantMsg, res.Message)
+			assert.Equal(t, tc.wantCode, CodeOf(tc.err))
+		})
+	}
+	assert.Nil(t, Convert(nil))
+	assert.Equal(t, OK, CodeOf(nil))
+}
+
+func TestIsOverloaded(t *testing.T) {
+	overloaded := New(Unavailable, "overloaded").WithDetails(Detail{Type: DetailOverloaded})
+	assert.True(t, IsOverloaded(overloaded))
+	assert.True(t, IsOverloaded(fmt.Errorf("wrap: %w", overloaded)))
+	assert.True(t, IsOverloaded(Decode(Encode(overloaded))))
+	assert.False(t, IsOverloaded(New(Unavailable, "unavailable")))
+	assert.False(t, IsOverloaded(errors.New("error")))
+	assert.False(t, IsOverloaded(nil))
+}
+
+func TestCodeString(t *testing.T) {
+	assert.Equal(t, "ResourceExhausted", ResourceExhausted.String())
+	assert.Equal(t, "Code(100)", Code(100).String())
+}
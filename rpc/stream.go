@@ -0,0 +1,219 @@
+package rpc
+
+import (
+	"context"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/serialize"
+	"geek_micro/rpc/status"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// streamWindow 流的每个方向上，发送出去但是还没有被对端处理的消息最多有这么多个
+// 超过之后发送方会阻塞，直到接收方通过 FlagWindowUpdate 归还额度
+const streamWindow = 16
+
+var errStreamFlowControl = status.New(status.ResourceExhausted, "micro: 对端发送的消息超过了流量控制的窗口")
+
+// RawStream 传输序列化之后的数据的流，Stream 在它的基础上做序列化
+// SendMsg 和 RecvMsg 可以在两个 goroutine 里面同时调用，但是都不能并发调用
+type RawStream interface {
+	Context() context.Context
+	SendMsg(data []byte) error
+	// RecvMsg 对端正常结束之后返回 io.EOF，否则返回对端的错误
+	RecvMsg() ([]byte, error)
+	// CloseSend 告诉对端不会再发送消息了
+	CloseSend() error
+}
+
+// StreamProxy 支持流式调用的 Proxy，流不经过拦截器
+type StreamProxy interface {
+	Proxy
+	NewStream(ctx context.Context, req *message.Request) (RawStream, error)
+}
+
+// Stream 流式调用中的一端，S 是这一端发送的消息，R 是这一端接收的消息
+// 客户端的字段形如 func(ctx context.Context) (*Stream[Req, Resp], error)
+// 服务端的方法形如 func(ctx context.Context, stream *Stream[Resp, Req]) error，方法返回的时候流结束
+type Stream[S any, R any] struct {
+	raw        RawStream
+	serializer serialize.Serialize
+}
+
+// streamBinder 由 Stream 实现，用来识别流式的字段和方法
+type streamBinder interface {
+	bind(raw RawStream, serializer serialize.Serialize)
+}
+
+var streamBinderType = reflect.TypeOf((*streamBinder)(nil)).Elem()
+
+func (s *Stream[S, R]) bind(raw RawStream, serializer serialize.Serialize) {
+	s.raw = raw
+	s.serializer = serializer
+}
+
+// Context 客户端是发起调用的 ctx，服务端的 ctx 带着客户端的超时时间和元数据
+func (s *Stream[S, R]) Context() context.Context {
+	return s.raw.Context()
+}
+
+// Send 发送一个消息，对端来不及处理的时候会阻塞
+// 对端已经结束的时候返回 io.EOF，具体的错误通过 Recv 获取
+func (s *Stream[S, R]) Send(msg *S) error {
+	data, err := s.serializer.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return s.raw.SendMsg(data)
+}
+
+// Recv 接收一个消息，对端正常结束之后返回 io.EOF
+func (s *Stream[S, R]) Recv() (*R, error) {
+	data, err := s.raw.RecvMsg()
+	if err != nil {
+		return nil, err
+	}
+	res := new(R)
+	if err = s.serializer.Decode(data, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// CloseSend 告诉对端不会再发送消息了，服务端的流在方法返回的时候自动结束
+func (s *Stream[S, R]) CloseSend() error {
+	return s.raw.CloseSend()
+}
+
+// isStreamFunc 判断字段是不是 func(ctx context.Context) (*Stream[Req, Resp], error)
+func isStreamFunc(typ reflect.Type) bool {
+	return typ.Kind() == reflect.Func && !typ.IsVariadic() &&
+		typ.NumIn() == 1 && typ.In(0) == contextType &&
+		typ.NumOut() == 2 && typ.Out(0).Implements(streamBinderType) && typ.Out(1) == errorType
+}
+
+type streamFrame struct {
+	data       []byte
+	compresser uint8
+	// 对端结束了，err 为 nil 表示正常结束
+	end bool
+	err error
+}
+
+// streamCore 是客户端和服务端的流共用的流量控制和接收缓冲
+type streamCore struct {
+	ctx context.Context
+
+	// 发送方剩下的额度，每发送一个消息消耗一个
+	credits chan struct{}
+	// 收到了但是还没有被处理的消息，对端遵守流量控制的时候不会写满
+	frames chan streamFrame
+	// 已经处理但是还没有归还给对端的额度
+	consumed uint32
+	// 接收方向结束之后，Recv 一直返回这个错误
+	recvErr error
+	// 把额度归还给对端
+	windowUpdate func(n uint32) error
+
+	// 流终止之后 done 会被关闭，err 记录了原因
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+func newStreamCore(ctx context.Context, windowUpdate func(n uint32) error) *streamCore {
+	res := &streamCore{
+		ctx:          ctx,
+		credits:      make(chan struct{}, streamWindow),
+		frames:       make(chan streamFrame, streamWindow+1),
+		windowUpdate: windowUpdate,
+		done:         make(chan struct{}),
+	}
+	for i := 0; i < streamWindow; i++ {
+		res.credits <- struct{}{}
+	}
+	return res
+}
+
+// acquire 等待对端给出发送一个消息的额度
+func (sc *streamCore) acquire() error {
+	// 已经终止的流优先返回错误，避免再往连接上写数据
+	select {
+	case <-sc.done:
+		return sc.err
+	default:
+	}
+	select {
+	case <-sc.credits:
+		return nil
+	case <-sc.ctx.Done():
+		return sc.ctx.Err()
+	case <-sc.done:
+		return sc.err
+	}
+}
+
+func (sc *streamCore) recv() (streamFrame, error) {
+	if sc.recvErr != nil {
+		return streamFrame{}, sc.recvErr
+	}
+	var f streamFrame
+	select {
+	case f = <-sc.frames:
+	case <-sc.ctx.Done():
+		return streamFrame{}, sc.ctx.Err()
+	case <-sc.done:
+		// 终止之前收到的消息还是要交给调用方
+		select {
+		case f = <-sc.frames:
+		default:
+			sc.recvErr = sc.err
+			return streamFrame{}, sc.recvErr
+		}
+	}
+	if f.end {
+		sc.recvErr = f.err
+		if sc.recvErr == nil {
+			sc.recvErr = io.EOF
+		}
+		return streamFrame{}, sc.recvErr
+	}
+	// 攒够半个窗口再归还，避免每个消息都带一个额外的消息
+	sc.consumed++
+	if sc.consumed >= streamWindow/2 {
+		n := sc.consumed
+		sc.consumed = 0
+		if err := sc.windowUpdate(n); err != nil {
+			return streamFrame{}, err
+		}
+	}
+	return f, nil
+}
+
+// deliver 由读取连接的 goroutine 调用，不能阻塞
+func (sc *streamCore) deliver(f streamFrame) {
+	select {
+	case sc.frames <- f:
+	default:
+		sc.terminate(errStreamFlowControl)
+	}
+}
+
+func (sc *streamCore) addCredits(n uint32) {
+	for ; n > 0; n-- {
+		select {
+		case sc.credits <- struct{}{}:
+		default:
+			// 对端归还的额度超过了窗口，多出来的忽略
+			return
+		}
+	}
+}
+
+func (sc *streamCore) terminate(err error) {
+	sc.doneOnce.Do(func() {
+		sc.err = err
+		close(sc.done)
+	})
+}
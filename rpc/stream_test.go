@@ -0,0 +1,364 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geek_micro/rpc/compress/gzip"
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	server := NewServer()
+	server.RegisterCompressor(&gzip.Compressor{})
+	ss := &streamServer{canceled: make(chan struct{})}
+	server.RegisterService(ss)
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	testCases := []struct {
+		name string
+		opts []ClientOptions
+	}{
+		{
+			name: "no compress",
+		},
+		{
+			name: "gzip",
+			opts: []ClientOptions{ClientWithCompressor(&gzip.Compressor{})},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClient(addr, tc.opts...)
+			require.NoError(t, err)
+			defer func() {
+				_ = client.Close()
+			}()
+			us := &streamService{}
+			require.NoError(t, client.InitService(us))
+
+			t.Run("bidirectional", func(t *testing.T) {
+				stream, err := us.Echo(context.Background())
+				require.NoError(t, err)
+				// 发送的消息远多于窗口，双方都需要归还额度
+				const cnt = 100
+				go func() {
+					for i := 0; i < cnt; i++ {
+						_ = stream.Send(&GetByIdReq{Id: i})
+					}
+					_ = stream.CloseSend()
+				}()
+				for i := 0; i < cnt; i++ {
+					resp, err := stream.Recv()
+					require.NoError(t, err)
+					assert.Equal(t, &GetByIdResp{Msg: fmt.Sprint(i)}, resp)
+				}
+				_, err = stream.Recv()
+				assert.Equal(t, io.EOF, err)
+			})
+
+			t.Run("server stream", func(t *testing.T) {
+				stream, err := us.List(context.Background())
+				require.NoError(t, err)
+				require.NoError(t, stream.Send(&GetByIdReq{Id: 3}))
+				require.NoError(t, stream.CloseSend())
+				var msgs []string
+				for {
+					resp, err := stream.Recv()
+					if err == io.EOF {
+						break
+					}
+					require.NoError(t, err)
+					msgs = append(msgs, resp.Msg)
+				}
+				assert.Equal(t, []string{"0", "1", "2"}, msgs)
+			})
+
+			t.Run("client stream", func(t *testing.T) {
+				stream, err := us.Sum(context.Background())
+				require.NoError(t, err)
+				for i := 1; i <= 50; i++ {
+					require.NoError(t, stream.Send(&GetByIdReq{Id: i}))
+				}
+				require.NoError(t, stream.CloseSend())
+				resp, err := stream.Recv()
+				require.NoError(t, err)
+				assert.Equal(t, &GetByIdResp{Msg: "1275"}, resp)
+				_, err = stream.Recv()
+				assert.Equal(t, io.EOF, err)
+			})
+
+			t.Run("error", func(t *testing.T) {
+				stream, err := us.Fail(context.Background())
+				require.NoError(t, err)
+				_, err = stream.Recv()
+				assert.Equal(t, status.New(status.PermissionDenied, "no permission"), err)
+				// 服务端结束之后再发送返回 io.EOF
+				assert.Equal(t, io.EOF, stream.Send(&GetByIdReq{}))
+			})
+
+			t.Run("method not stream", func(t *testing.T) {
+				stream, err := us.Unknown(context.Background())
+				require.NoError(t, err)
+				_, err = stream.Recv()
+				assert.Equal(t, status.Unimplemented, status.CodeOf(err))
+			})
+		})
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	server := NewServer()
+	ss := &streamServer{canceled: make(chan struct{})}
+	server.RegisterService(ss)
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	us := &streamService{}
+	require.NoError(t, client.InitService(us))
+
+	stream, err := us.Flood(context.Background())
+	require.NoError(t, err)
+	// 客户端不接收的时候，服务端发送完一个窗口就会阻塞
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, int32(streamWindow), ss.sent.Load())
+
+	for i := 0; i < 100; i++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(i), resp.Msg)
+	}
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, int32(100), ss.sent.Load())
+}
+
+func TestStreamCancel(t *testing.T) {
+	server := NewServer()
+	ss := &streamServer{canceled: make(chan struct{})}
+	server.RegisterService(ss)
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	us := &streamService{}
+	require.NoError(t, client.InitService(us))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := us.Block(ctx)
+	require.NoError(t, err)
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, context.Canceled, err)
+
+	// 服务端的 ctx 也被取消了
+	select {
+	case <-ss.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("服务端没有取消调用")
+	}
+
+	// 客户端的超时时间也会传给服务端
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	stream, err = us.Block(ctx)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestStreamInterceptors(t *testing.T) {
+	var methods []string
+	var lock sync.Mutex
+	server := NewServer(ServerWithStreamInterceptors(
+		func(ctx context.Context, req *message.Request, next StreamHandler) error {
+			lock.Lock()
+			methods = append(methods, req.MethodName)
+			lock.Unlock()
+			return next(ctx, req)
+		},
+		func(ctx context.Context, req *message.Request, next StreamHandler) error {
+			if req.MethodName == "List" {
+				return status.New(status.ResourceExhausted, "limited")
+			}
+			return next(ctx, req)
+		},
+	), ServerWithInterceptors(func(ctx context.Context, req *message.Request, next Handler) (*message.Response, error) {
+		t.Error("流式调用不经过一元调用的拦截器")
+		return next(ctx, req)
+	}))
+	server.RegisterService(&streamServer{canceled: make(chan struct{})})
+	addr := startServer(t, server, "127.0.0.1:0")
+
+	client, err := NewClient(addr)
+	require.NoError(t, err)
+	defer func() {
+		_ = client.Close()
+	}()
+	us := &streamService{}
+	require.NoError(t, client.InitService(us))
+
+	// 被拦截器拒绝，流式方法不会执行
+	stream, err := us.List(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, status.ResourceExhausted, status.CodeOf(err))
+
+	stream, err = us.Sum(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&GetByIdReq{Id: 1}))
+	require.NoError(t, stream.CloseSend())
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "1", resp.Msg)
+
+	// 不是流式方法，不经过拦截器
+	stream, err = us.Unknown(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, status.Unimplemented, status.CodeOf(err))
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"List", "Sum"}, methods)
+}
+
+func TestStreamCore(t *testing.T) {
+	var returned []uint32
+	core := newStreamCore(context.Background(), func(n uint32) error {
+		returned = append(returned, n)
+		return nil
+	})
+
+	// 对端没有遵守流量控制
+	for i := 0; i < streamWindow+2; i++ {
+		core.deliver(streamFrame{data: []byte{byte(i)}})
+	}
+	for i := 0; i < streamWindow+1; i++ {
+		f, err := core.recv()
+		require.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, f.data)
+	}
+	_, err := core.recv()
+	assert.Equal(t, errStreamFlowControl, err)
+	// 每处理半个窗口归还一次额度
+	assert.Equal(t, []uint32{streamWindow / 2, streamWindow / 2}, returned)
+
+	// 额度用完之后 acquire 会阻塞，超过窗口的额度被忽略
+	core = newStreamCore(context.Background(), nil)
+	core.addCredits(streamWindow)
+	for i := 0; i < streamWindow; i++ {
+		require.NoError(t, core.acquire())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	core.ctx = ctx
+	assert.Equal(t, context.DeadlineExceeded, core.acquire())
+}
+
+type streamService struct {
+	Echo    func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error)
+	List    func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error)
+	Sum     func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error)
+	Fail    func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error)
+	Flood   func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error)
+	Block   func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error)
+	Unknown func(ctx context.Context) (*Stream[GetByIdReq, GetByIdResp], error)
+}
+
+func (s *streamService) Name() string {
+	return "stream-service"
+}
+
+type streamServer struct {
+	sent     atomic.Int32
+	canceled chan struct{}
+}
+
+func (s *streamServer) Name() string {
+	return "stream-service"
+}
+
+func (s *streamServer) Echo(ctx context.Context, stream *Stream[GetByIdResp, GetByIdReq]) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(&GetByIdResp{Msg: fmt.Sprint(req.Id)}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *streamServer) List(ctx context.Context, stream *Stream[GetByIdResp, GetByIdReq]) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < req.Id; i++ {
+		if err = stream.Send(&GetByIdResp{Msg: fmt.Sprint(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *streamServer) Sum(ctx context.Context, stream *Stream[GetByIdResp, GetByIdReq]) error {
+	sum := 0
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.Send(&GetByIdResp{Msg: fmt.Sprint(sum)})
+		}
+		if err != nil {
+			return err
+		}
+		sum += req.Id
+	}
+}
+
+func (s *streamServer) Fail(ctx context.Context, stream *Stream[GetByIdResp, GetByIdReq]) error {
+	return status.New(status.PermissionDenied, "no permission")
+}
+
+func (s *streamServer) Flood(ctx context.Context, stream *Stream[GetByIdResp, GetByIdReq]) error {
+	for i := 0; i < 100; i++ {
+		if err := stream.Send(&GetByIdResp{Msg: fmt.Sprint(i)}); err != nil {
+			return err
+		}
+		s.sent.Add(1)
+	}
+	return nil
+}
+
+func (s *streamServer) Block(ctx context.Context, stream *Stream[GetByIdResp, GetByIdReq]) error {
+	<-ctx.Done()
+	if errors.Is(ctx.Err(), context.Canceled) {
+		close(s.canceled)
+	}
+	return ctx.Err()
+}
+
+func (s *streamServer) Unknown(ctx context.Context, req *GetByIdReq) (*GetByIdResp, error) {
+	return &GetByIdResp{}, nil
+}
@@ -2,26 +2,102 @@ package rpc
 
 import (
 	"encoding/binary"
-	"net"
+	"errors"
+	"fmt"
+	"geek_micro/rpc/compress"
+	"geek_micro/rpc/status"
+	"io"
+	"sync"
 )
 
 const numOfLengthBytes = 8
 
-func ReadMsg(conn net.Conn) ([]byte, error) {
-	lengthByte := make([]byte, numOfLengthBytes)
-	_, err := conn.Read(lengthByte)
+// minHeadLength 头部固定部分的长度：头部长度、数据长度、消息 ID、版本、压缩算法、序列化协议
+const minHeadLength = 15
+
+// DefaultMaxFrameSize 默认的单个消息（头部加数据）的最大长度
+const DefaultMaxFrameSize = 4 << 20
+
+var (
+	// ErrFrameTooLarge 消息的长度超过了上限，连接上剩下的数据已经没法解析，只能关闭连接
+	ErrFrameTooLarge = errors.New("micro: 消息超过了最大长度")
+	// ErrInvalidFrame 消息头部的长度字段不合法
+	ErrInvalidFrame = errors.New("micro: 消息格式错误")
+)
+
+// ReadMsg 读取一个完整的消息，消息被拆成多个 TCP 分段的时候也能读完整
+func ReadMsg(r io.Reader) ([]byte, error) {
+	return readFrame(r, DefaultMaxFrameSize, nil)
+}
+
+// bufPool 服务端读取请求用的缓冲，避免每个请求都分配一次
+var bufPool = sync.Pool{
+	New: func() any {
+		bs := make([]byte, 0, 4096)
+		return &bs
+	},
+}
+
+// readPooledFrame 和 ReadMsg 一样，但是数据放在 bufPool 的缓冲里面
+// 数据用完之后调用 release，之后不能再引用数据
+func readPooledFrame(r io.Reader, maxFrameSize uint32) ([]byte, func(), error) {
+	buf := bufPool.Get().(*[]byte)
+	data, err := readFrame(r, maxFrameSize, *buf)
 	if err != nil {
+		bufPool.Put(buf)
+		return nil, nil, err
+	}
+	return data, func() {
+		// 太大的缓冲不放回去，避免一个大消息长期占着内存
+		if cap(data) <= 64<<10 {
+			*buf = data[:0]
+			bufPool.Put(buf)
+		}
+	}, nil
+}
+
+// readFrame 读取一个完整的消息，buf 的容量够用的时候复用 buf
+func readFrame(r io.Reader, maxFrameSize uint32, buf []byte) ([]byte, error) {
+	var lengthBytes [numOfLengthBytes]byte
+	if _, err := io.ReadFull(r, lengthBytes[:]); err != nil {
 		return nil, err
 	}
-	headerLength := binary.BigEndian.Uint32(lengthByte[:4])
-	bodyLength := binary.BigEndian.Uint32(lengthByte[4:8])
-	length := headerLength + bodyLength
+	headLength := binary.BigEndian.Uint32(lengthBytes[:4])
+	bodyLength := binary.BigEndian.Uint32(lengthBytes[4:8])
+	if headLength < minHeadLength {
+		return nil, fmt.Errorf("%w: 头部长度 %d 小于 %d", ErrInvalidFrame, headLength, minHeadLength)
+	}
+	// 用 uint64 避免两个长度相加溢出
+	length := uint64(headLength) + uint64(bodyLength)
+	if length > uint64(maxFrameSize) {
+		return nil, fmt.Errorf("%w: 消息长度 %d 超过了 %d", ErrFrameTooLarge, length, maxFrameSize)
+	}
 
-	data := make([]byte, length)
-	_, err = conn.Read(data[8:])
-	if err != nil {
+	var data []byte
+	if uint64(cap(buf)) >= length {
+		data = buf[:length]
+	} else {
+		data = make([]byte, length)
+	}
+	copy(data, lengthBytes[:])
+	if _, err := io.ReadFull(r, data[numOfLengthBytes:]); err != nil {
+		// 连接在消息中间断开了
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
-	copy(data[:8], lengthByte)
-	return data, err
+	return data, nil
+}
+
+// decompress 解压之后的数据也不能超过 maxFrameSize，避免很小的压缩数据解压出非常大的数据
+func decompress(c compress.Compressor, data []byte, maxFrameSize uint32) ([]byte, error) {
+	res, err := c.Decompress(data, int(maxFrameSize))
+	if errors.Is(err, compress.ErrTooLarge) {
+		return nil, status.Errorf(status.ResourceExhausted, "micro: 解压数据失败 %v", err)
+	}
+	if err != nil {
+		return nil, status.Errorf(status.InvalidArgument, "micro: 解压数据失败 %v", err)
+	}
+	return res, nil
 }
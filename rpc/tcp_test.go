@@ -0,0 +1,121 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"geek_micro/rpc/message"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFrame(t *testing.T) {
+	req := &message.Request{
+		MessageId:   1,
+		ServiceName: "user-service",
+		MethodName:  "GetById",
+		Data:        bytes.Repeat([]byte("a"), 1024),
+	}
+	req.SetHeadLength()
+	req.SetBodyLength()
+	frame := message.EncodeReq(req)
+
+	header := func(headLength, bodyLength uint32) []byte {
+		bs := make([]byte, numOfLengthBytes)
+		binary.BigEndian.PutUint32(bs[:4], headLength)
+		binary.BigEndian.PutUint32(bs[4:], bodyLength)
+		return bs
+	}
+
+	testCases := []struct {
+		name         string
+		r            io.Reader
+		maxFrameSize uint32
+
+		wantData []byte
+		wantErr  error
+	}{
+		{
+			name:         "whole frame",
+			r:            bytes.NewReader(frame),
+			maxFrameSize: DefaultMaxFrameSize,
+			wantData:     frame,
+		},
+		{
+			// 模拟消息被拆成了很多个 TCP 分段
+			name:         "one byte per read",
+			r:            iotest.OneByteReader(bytes.NewReader(frame)),
+			maxFrameSize: DefaultMaxFrameSize,
+			wantData:     frame,
+		},
+		{
+			name:         "too large",
+			r:            bytes.NewReader(frame),
+			maxFrameSize: 100,
+			wantErr:      ErrFrameTooLarge,
+		},
+		{
+			// 两个长度相加溢出 uint32
+			name:         "overflow",
+			r:            bytes.NewReader(header(0xFFFFFFFF, 0xFFFFFFFF)),
+			maxFrameSize: DefaultMaxFrameSize,
+			wantErr:      ErrFrameTooLarge,
+		},
+		{
+			name:         "head too short",
+			r:            bytes.NewReader(header(3, 0)),
+			maxFrameSize: DefaultMaxFrameSize,
+			wantErr:      ErrInvalidFrame,
+		},
+		{
+			name:         "truncated body",
+			r:            bytes.NewReader(frame[:len(frame)-1]),
+			maxFrameSize: DefaultMaxFrameSize,
+			wantErr:      io.ErrUnexpectedEOF,
+		},
+		{
+			name:         "truncated length",
+			r:            bytes.NewReader(frame[:4]),
+			maxFrameSize: DefaultMaxFrameSize,
+			wantErr:      io.ErrUnexpectedEOF,
+		},
+		{
+			name:         "eof",
+			r:            bytes.NewReader(nil),
+			maxFrameSize: DefaultMaxFrameSize,
+			wantErr:      io.EOF,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, release, err := readPooledFrame(tc.r, tc.maxFrameSize)
+			assert.ErrorIs(t, err, tc.wantErr)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tc.wantData, data)
+			release()
+		})
+	}
+}
+
+func TestReadPooledFrameReuse(t *testing.T) {
+	req := &message.Request{ServiceName: "user-service", MethodName: "GetById", Data: []byte("hello")}
+	req.SetHeadLength()
+	req.SetBodyLength()
+	frame := message.EncodeReq(req)
+	r := bytes.NewReader(append(append([]byte{}, frame...), frame...))
+
+	first, release, err := readPooledFrame(r, DefaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, frame, first)
+	release()
+	second, release, err := readPooledFrame(r, DefaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, frame, second)
+	release()
+}
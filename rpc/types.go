@@ -12,3 +12,8 @@ type Service interface {
 type Proxy interface {
 	Invoke(ctx context.Context, req *message.Request) (*message.Response, error)
 }
+
+// Logger 记录框架内部的错误，例如业务方法的 panic，*log.Logger 实现了这个接口
+type Logger interface {
+	Printf(format string, args ...any)
+}
@@ -0,0 +1,51 @@
+package rpc
+
+import (
+	"geek_micro/rpc/message"
+	"geek_micro/rpc/status"
+)
+
+// detailSupportedVersions 服务端拒绝请求的协议版本时，通过这个附加信息告诉客户端自己支持哪些版本
+// Value 的每一个字节都是一个版本
+const detailSupportedVersions = "micro.SupportedVersions"
+
+// handshakeService 客户端建立连接之后用 Version1 发送这个服务的请求，询问服务端支持的协议版本
+// 服务端不会把它交给拦截器和业务方法，旧的服务端会返回服务不存在
+const handshakeService = "micro.Handshake"
+
+func errUnsupportedVersion(version uint8, supported []uint8) *status.Error {
+	return status.Errorf(status.Unimplemented, "micro: 不支持的协议版本 %d", version).
+		WithDetails(status.Detail{Type: detailSupportedVersions, Value: supported})
+}
+
+// supportedVersions 从服务端返回的错误里面取出服务端支持的协议版本
+func supportedVersions(e *status.Error) ([]uint8, bool) {
+	if e.Code != status.Unimplemented {
+		return nil, false
+	}
+	for _, d := range e.Details {
+		if d.Type == detailSupportedVersions {
+			return d.Value, true
+		}
+	}
+	return nil, false
+}
+
+// negotiate 在服务端支持的版本里面挑选一个不超过 max 的最高版本
+func negotiate(supported []uint8, max uint8) (uint8, bool) {
+	var res uint8
+	for _, v := range supported {
+		if v <= max && v > res {
+			res = v
+		}
+	}
+	return res, res != 0
+}
+
+// normalizeVersion 没有设置版本的旧客户端按照 Version1 处理
+func normalizeVersion(version uint8) uint8 {
+	if version == 0 {
+		return message.Version1
+	}
+	return version
+}
@@ -0,0 +1,50 @@
+package rpc
+
+import (
+	"geek_micro/rpc/message"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	testCases := []struct {
+		name      string
+		supported []uint8
+		max       uint8
+
+		wantVersion uint8
+		wantOk      bool
+	}{
+		{
+			name:        "highest common",
+			supported:   []uint8{message.Version1, message.Version2, 3},
+			max:         message.Version2,
+			wantVersion: message.Version2,
+			wantOk:      true,
+		},
+		{
+			name:        "lower",
+			supported:   []uint8{message.Version1},
+			max:         message.Version2,
+			wantVersion: message.Version1,
+			wantOk:      true,
+		},
+		{
+			name:      "no common",
+			supported: []uint8{message.Version2},
+			max:       message.Version1,
+		},
+		{
+			name: "empty",
+			max:  message.Version2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			version, ok := negotiate(tc.supported, tc.max)
+			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.wantVersion, version)
+		})
+	}
+}